@@ -9,6 +9,12 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		src.Replay()
+		return
+	}
+
 	c := make(chan os.Signal, 3)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, os.Kill)
 	go func() {
@@ -0,0 +1,239 @@
+package accesslog
+
+// dedicated access log: one json line per request
+// fields are chosen in config, files are rotated by size and by time
+// sample rates are set per route template, errors are always written
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/utils"
+)
+
+type AccessLogConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	Path          string   `default:"/home/centos/linkit/access/" yaml:"path"`
+	RotateMB      int64    `default:"100" yaml:"rotate_mb"`
+	RotateMinutes int      `default:"60" yaml:"rotate_minutes"`
+	Fields        []string `yaml:"fields"`
+	// route template: part of requests written, 1 - all, 0 - none
+	// "*" - for the routes not listed
+	Sample map[string]float64 `yaml:"sample"`
+}
+
+const (
+	FieldTime         = "time"
+	FieldTid          = "tid"
+	FieldRequestId    = "request_id"
+	FieldMethod       = "method"
+	FieldRoute        = "route"
+	FieldPath         = "path"
+	FieldCampaignId   = "campaign_id"
+	FieldOperatorCode = "operator_code"
+	FieldStatus       = "status"
+	FieldLatencyMs    = "latency_ms"
+	FieldBytes        = "bytes"
+	FieldIP           = "ip"
+	FieldUAClass      = "ua_class"
+	FieldError        = "error"
+)
+
+var AllFields = []string{
+	FieldTime,
+	FieldTid,
+	FieldRequestId,
+	FieldMethod,
+	FieldRoute,
+	FieldPath,
+	FieldCampaignId,
+	FieldOperatorCode,
+	FieldStatus,
+	FieldLatencyMs,
+	FieldBytes,
+	FieldIP,
+	FieldUAClass,
+	FieldError,
+}
+
+type Entry struct {
+	Time         time.Time
+	Tid          string
+	RequestId    string
+	Method       string
+	Route        string
+	Path         string
+	CampaignId   string
+	OperatorCode int64
+	Status       int
+	Latency      time.Duration
+	Bytes        int
+	IP           string
+	UserAgent    string
+	Error        string
+}
+
+type accessLog struct {
+	conf   AccessLogConfig
+	fields []string
+	file   *utils.RotatingFile
+}
+
+var al *accessLog
+
+func Init(conf AccessLogConfig) {
+	if !conf.Enabled {
+		return
+	}
+	fields := conf.Fields
+	if len(fields) == 0 {
+		fields = AllFields
+	}
+	for _, f := range fields {
+		if !known(f) {
+			log.WithField("field", f).Fatal("unknown access log field")
+		}
+	}
+	file, err := utils.NewRotatingFile(conf.Path, "access-", ".jsonl",
+		conf.RotateMB<<20, time.Duration(conf.RotateMinutes)*time.Minute)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  conf.Path,
+			"error": err.Error(),
+		}).Fatal("cannot init access log")
+	}
+	al = &accessLog{
+		conf:   conf,
+		fields: fields,
+		file:   file,
+	}
+	log.WithFields(log.Fields{
+		"path":   conf.Path,
+		"fields": fields,
+		"sample": conf.Sample,
+	}).Info("access log init")
+}
+
+func Enabled() bool {
+	return al != nil
+}
+
+func Close() {
+	if al != nil {
+		al.file.Close()
+	}
+}
+
+func Write(e Entry) {
+	if al == nil || !al.sampled(e) {
+		return
+	}
+	line, err := json.Marshal(al.record(e))
+	if err != nil {
+		m.AccessLogErrors.Inc()
+		log.WithFields(log.Fields{
+			"tid":   e.Tid,
+			"error": err.Error(),
+		}).Error("access log marshal")
+		return
+	}
+	if err := al.file.Write(append(line, '\n'), e.Time); err != nil {
+		m.AccessLogErrors.Inc()
+		log.WithFields(log.Fields{
+			"tid":   e.Tid,
+			"error": err.Error(),
+		}).Error("access log write")
+	}
+}
+
+func (a *accessLog) sampled(e Entry) bool {
+	if e.Status >= 500 || e.Error != "" {
+		return true
+	}
+	rate, ok := a.conf.Sample[e.Route]
+	if !ok {
+		if rate, ok = a.conf.Sample["*"]; !ok {
+			return true
+		}
+	}
+	return rand.Float64() < rate
+}
+
+func (a *accessLog) record(e Entry) map[string]interface{} {
+	res := make(map[string]interface{}, len(a.fields))
+	for _, f := range a.fields {
+		switch f {
+		case FieldTime:
+			res[f] = e.Time.UTC().Format(time.RFC3339Nano)
+		case FieldTid:
+			res[f] = e.Tid
+		case FieldRequestId:
+			res[f] = e.RequestId
+		case FieldMethod:
+			res[f] = e.Method
+		case FieldRoute:
+			res[f] = e.Route
+		case FieldPath:
+			res[f] = e.Path
+		case FieldCampaignId:
+			res[f] = e.CampaignId
+		case FieldOperatorCode:
+			res[f] = e.OperatorCode
+		case FieldStatus:
+			res[f] = e.Status
+		case FieldLatencyMs:
+			res[f] = float64(e.Latency.Nanoseconds()) / 1e6
+		case FieldBytes:
+			// -1 when nothing is written
+			if e.Bytes < 0 {
+				e.Bytes = 0
+			}
+			res[f] = e.Bytes
+		case FieldIP:
+			res[f] = e.IP
+		case FieldUAClass:
+			res[f] = UAClass(e.UserAgent)
+		case FieldError:
+			if e.Error != "" {
+				res[f] = e.Error
+			}
+		}
+	}
+	return res
+}
+
+func known(field string) bool {
+	for _, f := range AllFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// UAClass is bot, mobile, desktop or unknown
+func UAClass(ua string) string {
+	if ua == "" {
+		return "unknown"
+	}
+	ua = strings.ToLower(ua)
+	for _, s := range []string{"bot", "crawler", "spider", "curl", "wget", "python", "java/", "go-http-client"} {
+		if strings.Contains(ua, s) {
+			return "bot"
+		}
+	}
+	for _, s := range []string{"mobile", "android", "iphone", "ipad", "opera mini", "windows phone", "blackberry", "symbian"} {
+		if strings.Contains(ua, s) {
+			return "mobile"
+		}
+	}
+	if strings.Contains(ua, "mozilla") {
+		return "desktop"
+	}
+	return "unknown"
+}
@@ -0,0 +1,31 @@
+package accesslog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampled(t *testing.T) {
+	a := &accessLog{conf: AccessLogConfig{Sample: map[string]float64{
+		"/static/*filepath": 0,
+		"*":                 1,
+	}}}
+	assert.False(t, a.sampled(Entry{Route: "/static/*filepath", Status: 200}), "route sample rate")
+	assert.True(t, a.sampled(Entry{Route: "/static/*filepath", Status: 502}), "errors are always written")
+	assert.True(t, a.sampled(Entry{Route: "/campaign/:campaign_hash/:campaign_page", Status: 200}), "default rate")
+}
+
+func TestRecord(t *testing.T) {
+	a := &accessLog{fields: []string{FieldTid, FieldBytes, FieldUAClass, FieldError}}
+	rec := a.record(Entry{
+		Tid:       "1477597462-3f66f7ea",
+		Bytes:     -1,
+		UserAgent: "Mozilla/5.0 (Linux; Android 6.0.1; SM-G920F) Mobile Safari/537.36",
+	})
+	assert.Equal(t, map[string]interface{}{
+		FieldTid:     "1477597462-3f66f7ea",
+		FieldBytes:   0,
+		FieldUAClass: "mobile",
+	}, rec, "only configured fields")
+}
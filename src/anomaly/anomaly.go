@@ -0,0 +1,331 @@
+package anomaly
+
+// per-campaign conversion anomaly detection
+//
+// events are counted in minute buckets per campaign, every check compares
+// the rates of the last WindowMinutes with the BaselineMinutes before them:
+//
+//	access_to_agree   agree / landing        alert on drop
+//	agree_to_notified notified / agree       alert on drop
+//	error_ratio       errors / requests      alert on spike
+//	not_found         404 per minute         alert on spike
+//
+// alerts go to the webhook (or to the log when there is no webhook),
+// an anomaly is alerted again after the cooldown, recovery is always alerted
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+type AnomalyConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	CheckSec        int           `default:"60" yaml:"check_sec"`
+	WindowMinutes   int           `default:"15" yaml:"window_minutes"`
+	BaselineMinutes int           `default:"1440" yaml:"baseline_minutes"`
+	MinSamples      int64         `default:"50" yaml:"min_samples"`
+	DropRatio       float64       `default:"0.5" yaml:"drop_ratio"`
+	SpikeRatio      float64       `default:"1" yaml:"spike_ratio"`
+	CooldownMinutes int           `default:"30" yaml:"cooldown_minutes"`
+	Webhook         WebhookConfig `yaml:"webhook"`
+}
+
+type WebhookConfig struct {
+	Url     string `yaml:"url"`
+	Timeout int    `default:"5" yaml:"timeout"`
+}
+
+// counted events
+const (
+	Requests = iota
+	Landing
+	Agree
+	Notified
+	Errors
+	NotFound
+	numEvents
+)
+
+const (
+	AccessToAgree   = "access_to_agree"
+	AgreeToNotified = "agree_to_notified"
+	ErrorRatio      = "error_ratio"
+	NotFoundRate    = "not_found"
+)
+
+const (
+	Drop     = "drop"
+	Spike    = "spike"
+	Resolved = "resolved"
+)
+
+type rate struct {
+	name       string
+	num, denom int // denom -1: per minute
+	direction  string
+}
+
+var rates = []rate{
+	{AccessToAgree, Agree, Landing, Drop},
+	{AgreeToNotified, Notified, Agree, Drop},
+	{ErrorRatio, Errors, Requests, Spike},
+	{NotFoundRate, NotFound, -1, Spike},
+}
+
+type bucket struct {
+	minute int64
+	counts [numEvents]int64
+}
+
+type State struct {
+	CampaignId string    `json:"campaign_id"`
+	Metric     string    `json:"metric"`
+	Current    float64   `json:"current"`
+	Baseline   float64   `json:"baseline"`
+	Samples    int64     `json:"samples"`
+	Anomaly    string    `json:"anomaly,omitempty"`
+	Since      time.Time `json:"since"`
+	AlertedAt  time.Time `json:"alerted_at"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+type Alert struct {
+	State
+	Event string `json:"event"`
+}
+
+type stateKey struct {
+	campaignId string
+	metric     string
+}
+
+type detector struct {
+	conf     AnomalyConfig
+	mu       sync.Mutex
+	counts   map[string][]bucket
+	states   map[stateKey]*State
+	client   *http.Client
+	now      func() time.Time
+	alertsFn func(Alert)
+}
+
+var d *detector
+
+func Init(conf AnomalyConfig) {
+	if !conf.Enabled {
+		return
+	}
+	d = newDetector(conf)
+	d.alertsFn = d.send
+	go func() {
+		for range time.Tick(time.Duration(conf.CheckSec) * time.Second) {
+			d.check()
+		}
+	}()
+	log.WithFields(log.Fields{
+		"window":   conf.WindowMinutes,
+		"baseline": conf.BaselineMinutes,
+		"webhook":  conf.Webhook.Url,
+	}).Info("anomaly detection init")
+}
+
+func newDetector(conf AnomalyConfig) *detector {
+	if conf.WindowMinutes <= 0 {
+		conf.WindowMinutes = 15
+	}
+	if conf.BaselineMinutes <= 0 {
+		conf.BaselineMinutes = 1440
+	}
+	return &detector{
+		conf:   conf,
+		counts: make(map[string][]bucket),
+		states: make(map[stateKey]*State),
+		client: &http.Client{Timeout: time.Duration(conf.Webhook.Timeout) * time.Second},
+		now:    time.Now,
+	}
+}
+
+// Count is called by the handlers, campaignId is empty for the requests without campaign
+func Count(campaignId string, event int) {
+	if d == nil {
+		return
+	}
+	d.count(campaignId, event)
+}
+
+func (d *detector) count(campaignId string, event int) {
+	minute := d.now().Unix() / 60
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	buckets, ok := d.counts[campaignId]
+	if !ok {
+		buckets = make([]bucket, d.conf.WindowMinutes+d.conf.BaselineMinutes)
+		d.counts[campaignId] = buckets
+	}
+	b := &buckets[minute%int64(len(buckets))]
+	if b.minute != minute {
+		*b = bucket{minute: minute}
+	}
+	b.counts[event]++
+}
+
+// sums of the current window and of the baseline before it
+func (d *detector) sums(buckets []bucket, now int64) (current, baseline [numEvents]int64) {
+	window := int64(d.conf.WindowMinutes)
+	total := int64(len(buckets))
+	for _, b := range buckets {
+		age := now - b.minute
+		if age < 0 || age >= total {
+			continue
+		}
+		for i, c := range b.counts {
+			if age < window {
+				current[i] += c
+			} else {
+				baseline[i] += c
+			}
+		}
+	}
+	return
+}
+
+func (d *detector) value(r rate, counts [numEvents]int64, minutes int) (value float64, samples int64) {
+	if r.denom < 0 {
+		return float64(counts[r.num]) / float64(minutes), counts[r.num]
+	}
+	if counts[r.denom] == 0 {
+		return 0, 0
+	}
+	return float64(counts[r.num]) / float64(counts[r.denom]), counts[r.denom]
+}
+
+func (d *detector) check() {
+	now := d.now()
+	minute := now.Unix() / 60
+	var alerts []Alert
+
+	d.mu.Lock()
+	for campaignId, buckets := range d.counts {
+		current, baseline := d.sums(buckets, minute)
+		for _, r := range rates {
+			cur, samples := d.value(r, current, d.conf.WindowMinutes)
+			base, baseSamples := d.value(r, baseline, d.conf.BaselineMinutes)
+			key := stateKey{campaignId, r.name}
+			st, ok := d.states[key]
+			if !ok {
+				st = &State{CampaignId: campaignId, Metric: r.name}
+				d.states[key] = st
+			}
+			st.Current, st.Baseline, st.Samples, st.CheckedAt = cur, base, samples, now
+
+			anomaly := ""
+			if samples >= d.conf.MinSamples && baseSamples >= d.conf.MinSamples {
+				switch {
+				case r.direction == Drop && cur < base*(1-d.conf.DropRatio):
+					anomaly = Drop
+				case r.direction == Spike && cur > base*(1+d.conf.SpikeRatio):
+					anomaly = Spike
+				}
+			}
+			if alert, ok := d.transition(st, anomaly, now); ok {
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	for _, alert := range alerts {
+		d.alertsFn(alert)
+	}
+}
+
+func (d *detector) transition(st *State, anomaly string, now time.Time) (Alert, bool) {
+	cooldown := time.Duration(d.conf.CooldownMinutes) * time.Minute
+	switch {
+	case anomaly == "" && st.Anomaly == "":
+		return Alert{}, false
+	case anomaly == "":
+		st.Anomaly = ""
+		st.Since = time.Time{}
+		return Alert{State: *st, Event: Resolved}, true
+	case st.Anomaly == "":
+		st.Since = now
+	case now.Sub(st.AlertedAt) < cooldown:
+		st.Anomaly = anomaly
+		return Alert{}, false
+	}
+	st.Anomaly = anomaly
+	st.AlertedAt = now
+	return Alert{State: *st, Event: anomaly}, true
+}
+
+func (d *detector) send(alert Alert) {
+	m.AnomalyAlerts.Inc()
+	logCtx := log.WithFields(log.Fields{
+		"campaign_id": alert.CampaignId,
+		"metric":      alert.Metric,
+		"event":       alert.Event,
+		"current":     alert.Current,
+		"baseline":    alert.Baseline,
+		"samples":     alert.Samples,
+	})
+	if d.conf.Webhook.Url == "" {
+		logCtx.Warn("anomaly")
+		return
+	}
+	go func() {
+		if err := d.post(alert); err != nil {
+			m.AnomalyWebhookErrors.Inc()
+			logCtx.WithField("error", err.Error()).Error("anomaly webhook")
+			return
+		}
+		logCtx.Info("anomaly webhook sent")
+	}()
+}
+
+func (d *detector) post(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+	resp, err := d.client.Post(d.conf.Webhook.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("client.Post: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status: %s", resp.Status)
+	}
+	return nil
+}
+
+// States returns the last check results, only anomalies when anomalous is set
+func States(anomalous bool) []State {
+	res := []State{}
+	if d == nil {
+		return res
+	}
+	d.mu.Lock()
+	for _, st := range d.states {
+		if !anomalous || st.Anomaly != "" {
+			res = append(res, *st)
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].CampaignId != res[j].CampaignId {
+			return res[i].CampaignId < res[j].CampaignId
+		}
+		return res[i].Metric < res[j].Metric
+	})
+	return res
+}
@@ -0,0 +1,89 @@
+package anomaly
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testDetector(now *time.Time) (*detector, *[]Alert) {
+	d := newDetector(AnomalyConfig{
+		WindowMinutes:   10,
+		BaselineMinutes: 60,
+		MinSamples:      10,
+		DropRatio:       0.5,
+		SpikeRatio:      1,
+		CooldownMinutes: 30,
+	})
+	d.now = func() time.Time { return *now }
+	alerts := []Alert{}
+	d.alertsFn = func(a Alert) { alerts = append(alerts, a) }
+	return d, &alerts
+}
+
+func fill(d *detector, now *time.Time, minutes, landings, agrees int) {
+	for i := 0; i < minutes; i++ {
+		for j := 0; j < landings; j++ {
+			d.count("1", Landing)
+		}
+		for j := 0; j < agrees; j++ {
+			d.count("1", Agree)
+		}
+		*now = now.Add(time.Minute)
+	}
+}
+
+func TestAnomalyDrop(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	d, alerts := testDetector(&now)
+
+	// baseline: 50% access to agree
+	fill(d, &now, 60, 10, 5)
+	// window: 10%
+	fill(d, &now, 10, 10, 1)
+	d.check()
+
+	assert.Equal(t, 1, len(*alerts))
+	alert := (*alerts)[0]
+	assert.Equal(t, AccessToAgree, alert.Metric)
+	assert.Equal(t, Drop, alert.Event)
+	assert.InDelta(t, 0.5, alert.Baseline, 0.01)
+	assert.InDelta(t, 0.1, alert.Current, 0.01)
+
+	// still anomalous: cooldown
+	d.check()
+	assert.Equal(t, 1, len(*alerts))
+
+	// recovered
+	fill(d, &now, 10, 10, 5)
+	d.check()
+	assert.Equal(t, 2, len(*alerts))
+	assert.Equal(t, Resolved, (*alerts)[1].Event)
+}
+
+func TestAnomalyCooldown(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	d, alerts := testDetector(&now)
+	st := &State{}
+
+	_, ok := d.transition(st, Spike, now)
+	assert.True(t, ok)
+	_, ok = d.transition(st, Spike, now.Add(10*time.Minute))
+	assert.False(t, ok)
+	alert, ok := d.transition(st, Spike, now.Add(31*time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, now, alert.Since)
+	assert.Equal(t, 0, len(*alerts))
+}
+
+func TestAnomalyMinSamples(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	d, alerts := testDetector(&now)
+
+	fill(d, &now, 60, 10, 5)
+	fill(d, &now, 10, 0, 0)
+	d.count("1", Landing)
+	d.check()
+	assert.Equal(t, 0, len(*alerts))
+}
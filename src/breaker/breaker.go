@@ -0,0 +1,187 @@
+package breaker
+
+// circuit breakers around the rpc clients: mid, contentd, partners
+//
+// closed: calls pass, Failures consecutive failed calls open the breaker
+// open: calls are rejected with ErrOpen for OpenSec seconds
+// half open: HalfOpenCalls probe calls pass, a successful probe closes the breaker,
+// a failed one opens it again
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+type BreakersConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Mid      BreakerConfig `yaml:"mid"`
+	Contentd BreakerConfig `yaml:"contentd"`
+	Partners BreakerConfig `yaml:"partners"`
+	// the open ones fail the readiness, every instance shares the upstreams:
+	// empty keeps the fleet in the load balancer on the fallbacks
+	Critical []string `yaml:"critical"`
+}
+
+type BreakerConfig struct {
+	Failures      int `default:"5" yaml:"failures"`
+	OpenSec       int `default:"30" yaml:"open_sec"`
+	HalfOpenCalls int `default:"1" yaml:"half_open_calls"`
+}
+
+const (
+	Closed   = "closed"
+	HalfOpen = "half_open"
+	Open     = "open"
+)
+
+var stateValue = map[string]float64{
+	Closed:   0,
+	HalfOpen: 1,
+	Open:     2,
+}
+
+var ErrOpen = errors.New("circuit breaker open")
+
+var (
+	breakers = make(map[string]*Breaker)
+	critical []string
+)
+
+// names are the upstream names used in the upstream metrics
+func Init(conf BreakersConfig) {
+	if !conf.Enabled {
+		return
+	}
+	breakers = map[string]*Breaker{
+		"mid":      New("mid", conf.Mid),
+		"contentd": New("contentd", conf.Contentd),
+		"partners": New("partners", conf.Partners),
+	}
+	critical = conf.Critical
+	log.WithFields(log.Fields{
+		"mid":      conf.Mid,
+		"contentd": conf.Contentd,
+		"partners": conf.Partners,
+	}).Info("circuit breakers init")
+}
+
+// Get returns nil for the upstreams without breaker, nil breaker allows every call
+func Get(name string) *Breaker {
+	return breakers[name]
+}
+
+func States() map[string]string {
+	res := make(map[string]string, len(breakers))
+	for name, b := range breakers {
+		res[name] = b.State()
+	}
+	return res
+}
+
+// Ready is false while a critical breaker is open
+func Ready() bool {
+	for _, name := range critical {
+		if b := breakers[name]; b != nil && b.State() == Open {
+			return false
+		}
+	}
+	return true
+}
+
+type Breaker struct {
+	name     string
+	conf     BreakerConfig
+	mu       sync.Mutex
+	state    string
+	failures int
+	probes   int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+func New(name string, conf BreakerConfig) *Breaker {
+	if conf.Failures <= 0 {
+		conf.Failures = 5
+	}
+	if conf.HalfOpenCalls <= 0 {
+		conf.HalfOpenCalls = 1
+	}
+	b := &Breaker{
+		name:  name,
+		conf:  conf,
+		state: Closed,
+		now:   time.Now,
+	}
+	m.BreakerState.WithLabelValues(name).Set(stateValue[Closed])
+	return b
+}
+
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open {
+		if b.now().Sub(b.openedAt) < time.Duration(b.conf.OpenSec)*time.Second {
+			return ErrOpen
+		}
+		b.setState(HalfOpen)
+		b.probes = 0
+	}
+	if b.state == HalfOpen {
+		if b.probes >= b.conf.HalfOpenCalls {
+			return ErrOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// Record is called with the result of every allowed call
+func (b *Breaker) Record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		if b.state != Closed {
+			b.setState(Closed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.conf.Failures) {
+		b.openedAt = b.now()
+		b.setState(Open)
+	}
+}
+
+func (b *Breaker) State() string {
+	if b == nil {
+		return Closed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *Breaker) setState(state string) {
+	log.WithFields(log.Fields{
+		"breaker":  b.name,
+		"from":     b.state,
+		"to":       state,
+		"failures": b.failures,
+	}).Warn("circuit breaker state")
+	b.state = state
+	m.BreakerState.WithLabelValues(b.name).Set(stateValue[state])
+}
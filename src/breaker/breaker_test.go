@@ -0,0 +1,57 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+func TestBreaker(t *testing.T) {
+	m.Init("dispatcherd_test")
+
+	now := time.Now()
+	b := New("mid", BreakerConfig{Failures: 2, OpenSec: 30, HalfOpenCalls: 1})
+	b.now = func() time.Time { return now }
+	failed := errors.New("connection refused")
+
+	assert.NoError(t, b.Allow())
+	b.Record(failed)
+	assert.Equal(t, Closed, b.State(), "one failure")
+	b.Record(failed)
+	assert.Equal(t, Open, b.State(), "threshold reached")
+	assert.Equal(t, ErrOpen, b.Allow(), "open rejects")
+
+	now = now.Add(31 * time.Second)
+	assert.NoError(t, b.Allow(), "probe after open timeout")
+	assert.Equal(t, HalfOpen, b.State())
+	assert.Equal(t, ErrOpen, b.Allow(), "only one probe")
+	b.Record(failed)
+	assert.Equal(t, Open, b.State(), "failed probe opens again")
+
+	now = now.Add(31 * time.Second)
+	assert.NoError(t, b.Allow())
+	b.Record(nil)
+	assert.Equal(t, Closed, b.State(), "successful probe closes")
+
+	var none *Breaker
+	assert.NoError(t, none.Allow(), "no breaker configured")
+}
+
+func TestReady(t *testing.T) {
+	m.Init("dispatcherd_test")
+	conf := BreakerConfig{Failures: 1, OpenSec: 30, HalfOpenCalls: 1}
+	Init(BreakersConfig{Enabled: true, Mid: conf, Contentd: conf, Partners: conf})
+	Get("contentd").Record(errors.New("connection refused"))
+	assert.True(t, Ready(), "no critical breakers")
+	assert.Equal(t, Open, States()["contentd"])
+
+	Init(BreakersConfig{Enabled: true, Mid: conf, Contentd: conf, Partners: conf, Critical: []string{"mid"}})
+	Get("contentd").Record(errors.New("connection refused"))
+	assert.True(t, Ready(), "contentd is not critical")
+	Get("mid").Record(errors.New("connection refused"))
+	assert.False(t, Ready())
+}
@@ -0,0 +1,314 @@
+package capture
+
+// debug capture of the requests of chosen msisdn, tid or campaign
+// rules are added at runtime through the admin api and expire after the ttl
+//
+// while any rule is active every request keeps a trail:
+// inbound request, rpc and operator calls, published events, response.
+// the trail is kept only if the request matches a rule when it ends,
+// kept records go to a bounded ring buffer and are read back as a timeline
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type CaptureConfig struct {
+	BufferSize    int      `default:"10000" yaml:"buffer_size"`
+	MaxRules      int      `default:"20" yaml:"max_rules"`
+	MaxTrail      int      `default:"200" yaml:"max_trail"`
+	DefaultTTLMin int      `default:"60" yaml:"default_ttl_minutes"`
+	MaskKeys      []string `yaml:"mask_keys"`
+	MaxBodyBytes  int      `default:"16384" yaml:"max_body_bytes"`
+}
+
+const (
+	KindRequest  = "request"
+	KindUpstream = "upstream"
+	KindEvent    = "event"
+	KindResponse = "response"
+)
+
+type Rule struct {
+	Id         string    `json:"id"`
+	Msisdn     string    `json:"msisdn,omitempty"`
+	Tid        string    `json:"tid,omitempty"`
+	CampaignId string    `json:"campaign_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func (r Rule) match(tid, msisdn, campaignId string) bool {
+	return (r.Tid != "" && r.Tid == tid) ||
+		(r.Msisdn != "" && r.Msisdn == msisdn) ||
+		(r.CampaignId != "" && r.CampaignId == campaignId)
+}
+
+type Record struct {
+	Time       time.Time   `json:"time"`
+	Tid        string      `json:"tid,omitempty"`
+	Msisdn     string      `json:"msisdn,omitempty"`
+	CampaignId string      `json:"campaign_id,omitempty"`
+	RuleId     string      `json:"rule_id,omitempty"`
+	Kind       string      `json:"kind"`
+	Name       string      `json:"name"`
+	TookMs     float64     `json:"took_ms,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+type capture struct {
+	conf   CaptureConfig
+	masker masker
+	mu     sync.Mutex
+	rules  map[string]Rule
+	seq    int64
+	ring   []Record
+	next   int
+	full   bool
+	active int32
+}
+
+var cp *capture
+
+func Init(conf CaptureConfig) {
+	if conf.BufferSize <= 0 {
+		conf.BufferSize = 10000
+	}
+	if conf.MaxTrail <= 0 {
+		conf.MaxTrail = 200
+	}
+	cp = &capture{
+		conf:   conf,
+		masker: newMasker(conf.MaskKeys),
+		rules:  make(map[string]Rule),
+		ring:   make([]Record, conf.BufferSize),
+	}
+}
+
+// Active is the fast path: no rules - no trails
+func Active() bool {
+	return cp != nil && atomic.LoadInt32(&cp.active) > 0
+}
+
+func AddRule(r Rule, ttl time.Duration) (Rule, error) {
+	if cp == nil {
+		return r, fmt.Errorf("capture is not initialised")
+	}
+	if r.Msisdn == "" && r.Tid == "" && r.CampaignId == "" {
+		return r, fmt.Errorf("msisdn, tid or campaign_id required")
+	}
+	if ttl <= 0 {
+		ttl = time.Duration(cp.conf.DefaultTTLMin) * time.Minute
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.expire(time.Now())
+	if cp.conf.MaxRules > 0 && len(cp.rules) >= cp.conf.MaxRules {
+		return r, fmt.Errorf("too many capture rules: %d", len(cp.rules))
+	}
+	cp.seq++
+	r.Id = strconv.FormatInt(cp.seq, 10)
+	r.CreatedAt = time.Now().UTC()
+	r.ExpiresAt = r.CreatedAt.Add(ttl)
+	cp.rules[r.Id] = r
+	atomic.StoreInt32(&cp.active, int32(len(cp.rules)))
+	return r, nil
+}
+
+func RemoveRule(id string) bool {
+	if cp == nil {
+		return false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	_, ok := cp.rules[id]
+	delete(cp.rules, id)
+	atomic.StoreInt32(&cp.active, int32(len(cp.rules)))
+	return ok
+}
+
+func Rules() []Rule {
+	res := []Rule{}
+	if cp == nil {
+		return res
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.expire(time.Now())
+	for _, r := range cp.rules {
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	return res
+}
+
+func (c *capture) expire(now time.Time) {
+	for id, r := range c.rules {
+		if now.After(r.ExpiresAt) {
+			delete(c.rules, id)
+		}
+	}
+	atomic.StoreInt32(&c.active, int32(len(c.rules)))
+}
+
+func (c *capture) matchRule(tid, msisdn, campaignId string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(time.Now())
+	for id, r := range c.rules {
+		if r.match(tid, msisdn, campaignId) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func (c *capture) store(records []Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range records {
+		c.ring[c.next] = r
+		c.next = (c.next + 1) % len(c.ring)
+		if c.next == 0 {
+			c.full = true
+		}
+	}
+}
+
+type Filter struct {
+	Tid        string
+	Msisdn     string
+	CampaignId string
+	RuleId     string
+}
+
+// Timeline returns the kept records in time order
+func Timeline(f Filter) []Record {
+	res := []Record{}
+	if cp == nil {
+		return res
+	}
+	cp.mu.Lock()
+	records := cp.ring[:cp.next]
+	if cp.full {
+		records = append(append([]Record{}, cp.ring[cp.next:]...), cp.ring[:cp.next]...)
+	}
+	for _, r := range records {
+		if (f.Tid == "" || f.Tid == r.Tid) &&
+			(f.Msisdn == "" || f.Msisdn == r.Msisdn) &&
+			(f.CampaignId == "" || f.CampaignId == r.CampaignId) &&
+			(f.RuleId == "" || f.RuleId == r.RuleId) {
+			res = append(res, r)
+		}
+	}
+	cp.mu.Unlock()
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	return res
+}
+
+// Trail collects the records of one request
+type Trail struct {
+	mu         sync.Mutex
+	tid        string
+	msisdn     string
+	campaignId string
+	records    []Record
+	dropped    int
+}
+
+// NewTrail is nil when no rule is active, nil trail ignores records
+func NewTrail(tid, msisdn string) *Trail {
+	if !Active() {
+		return nil
+	}
+	return &Trail{tid: tid, msisdn: msisdn}
+}
+
+func (t *Trail) SetCampaign(campaignId string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.campaignId = campaignId
+	t.mu.Unlock()
+}
+
+// Add masks the data and keeps the record
+func (t *Trail) Add(kind, name string, took time.Duration, err error, data interface{}) {
+	if t == nil {
+		return
+	}
+	r := Record{
+		Time:   time.Now().UTC(),
+		Kind:   kind,
+		Name:   name,
+		TookMs: float64(took.Nanoseconds()) / 1e6,
+		Data:   cp.masker.mask(data),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.records) >= cp.conf.MaxTrail {
+		t.dropped++
+		return
+	}
+	t.records = append(t.records, r)
+}
+
+// Finish keeps the trail if the request matches a rule
+func (t *Trail) Finish() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ruleId, ok := cp.matchRule(t.tid, t.msisdn, t.campaignId)
+	if !ok {
+		return
+	}
+	if t.dropped > 0 {
+		t.records = append(t.records, Record{
+			Time:  time.Now().UTC(),
+			Kind:  KindResponse,
+			Name:  "trail_truncated",
+			Error: fmt.Sprintf("records dropped: %d", t.dropped),
+		})
+	}
+	for i := range t.records {
+		t.records[i].Tid = t.tid
+		t.records[i].Msisdn = t.msisdn
+		t.records[i].CampaignId = t.campaignId
+		t.records[i].RuleId = ruleId
+	}
+	cp.store(t.records)
+}
+
+func MaxBodyBytes() int {
+	if cp == nil {
+		return 0
+	}
+	return cp.conf.MaxBodyBytes
+}
+
+type trailKey struct{}
+
+func NewContext(ctx context.Context, t *Trail) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, trailKey{}, t)
+}
+
+// FromContext is nil when the request has no trail
+func FromContext(ctx context.Context) *Trail {
+	t, _ := ctx.Value(trailKey{}).(*Trail)
+	return t
+}
@@ -0,0 +1,220 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// secrets are masked in headers, query strings and in the data fields
+var defaultMaskKeys = []string{
+	"authorization",
+	"cookie",
+	"set-cookie",
+	"pass",
+	"password",
+	"secret",
+	"token",
+	"key",
+	"aes_key",
+	"auth",
+}
+
+const masked = "***"
+
+type masker map[string]struct{}
+
+func newMasker(keys []string) masker {
+	if len(keys) == 0 {
+		keys = defaultMaskKeys
+	}
+	m := make(masker, len(keys))
+	for _, k := range keys {
+		m[normalizeKey(k)] = struct{}{}
+	}
+	return m
+}
+
+func (m masker) secret(key string) bool {
+	_, ok := m[normalizeKey(key)]
+	return ok
+}
+
+// aes_key, AesKey and aes-key are the same key
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+}
+
+// Mask returns the data as json values with the secrets replaced,
+// the default keys are used when the capture is not initialized
+func Mask(data interface{}) interface{} {
+	if cp == nil {
+		return newMasker(nil).mask(data)
+	}
+	return cp.masker.mask(data)
+}
+
+// mask turns the data into json values with the secrets replaced
+func (m masker) mask(data interface{}) interface{} {
+	switch v := data.(type) {
+	case nil:
+		return nil
+	case string:
+		return m.maskString(v)
+	case http.Header:
+		res := make(map[string]string, len(v))
+		for k := range v {
+			if m.secret(k) {
+				res[k] = masked
+			} else {
+				res[k] = v.Get(k)
+			}
+		}
+		return res
+	case url.Values:
+		return m.maskValues(v)
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err.Error()
+	}
+	var generic interface{}
+	if err := json.Unmarshal(body, &generic); err != nil {
+		return string(body)
+	}
+	return m.maskJSON(generic)
+}
+
+func (m masker) maskJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if m.secret(k) {
+				t[k] = masked
+			} else {
+				t[k] = m.maskJSON(val)
+			}
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = m.maskJSON(t[i])
+		}
+	case string:
+		return m.maskString(t)
+	}
+	return v
+}
+
+// urls: user password and secret query values
+func (m masker) maskString(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return s
+	}
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	if u.RawQuery != "" {
+		values, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			return s
+		}
+		u.RawQuery = m.maskValues(values).Encode()
+	}
+	return u.String()
+}
+
+func (m masker) maskValues(values url.Values) url.Values {
+	res := make(url.Values, len(values))
+	for k, vv := range values {
+		if m.secret(k) {
+			res[k] = []string{masked}
+		} else {
+			res[k] = vv
+		}
+	}
+	return res
+}
+
+// the map values keyed by a name are all secrets, i.e. link_api.accounts user: password
+var configSecretMaps = []string{"accounts"}
+
+// MaskConfig returns the config as json values keyed by the yaml names with the secrets replaced:
+// the keys ending with a mask key (secret_key, access_key, pass) and the values of configSecretMaps
+func MaskConfig(conf interface{}) interface{} {
+	// the default keys are always masked in the config
+	m := newMasker(nil)
+	if cp != nil {
+		for k := range cp.masker {
+			m[k] = struct{}{}
+		}
+	}
+	body, err := yaml.Marshal(conf)
+	if err != nil {
+		return err.Error()
+	}
+	var generic interface{}
+	if err := yaml.Unmarshal(body, &generic); err != nil {
+		return err.Error()
+	}
+	secretMaps := newMasker(configSecretMaps)
+	return m.maskConfig(generic, secretMaps)
+}
+
+func (m masker) secretSuffix(key string) bool {
+	key = normalizeKey(key)
+	for k := range m {
+		if strings.HasSuffix(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskConfig turns the yaml values into json ones
+func (m masker) maskConfig(v interface{}, secretMaps masker) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			key := fmt.Sprint(k)
+			switch {
+			case m.secretSuffix(key):
+				res[key] = masked
+			case secretMaps.secret(key):
+				res[key] = maskAll(val)
+			default:
+				res[key] = m.maskConfig(val, secretMaps)
+			}
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(t))
+		for i := range t {
+			res[i] = m.maskConfig(t[i], secretMaps)
+		}
+		return res
+	case string:
+		return m.maskString(t)
+	}
+	return v
+}
+
+func maskAll(v interface{}) interface{} {
+	t, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return masked
+	}
+	res := make(map[string]interface{}, len(t))
+	for k := range t {
+		res[fmt.Sprint(k)] = masked
+	}
+	return res
+}
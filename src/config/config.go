@@ -11,20 +11,65 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	content_client "github.com/linkit360/go-contentd/rpcclient"
+	"github.com/linkit360/go-dispatcherd/src/accesslog"
+	"github.com/linkit360/go-dispatcherd/src/anomaly"
+	"github.com/linkit360/go-dispatcherd/src/breaker"
+	"github.com/linkit360/go-dispatcherd/src/capture"
+	"github.com/linkit360/go-dispatcherd/src/guard"
+	"github.com/linkit360/go-dispatcherd/src/history"
+	"github.com/linkit360/go-dispatcherd/src/links"
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/postback"
 	"github.com/linkit360/go-dispatcherd/src/rbmq"
 	"github.com/linkit360/go-dispatcherd/src/sessions"
+	"github.com/linkit360/go-dispatcherd/src/store"
+	"github.com/linkit360/go-dispatcherd/src/throttle"
+	"github.com/linkit360/go-dispatcherd/src/timing"
+	"github.com/linkit360/go-dispatcherd/src/tracing"
+	"github.com/linkit360/go-dispatcherd/src/variants"
 	mid "github.com/linkit360/go-mid/rpcclient"
 	redirect_client "github.com/linkit360/go-partners/rpcclient"
 )
 
 type AppConfig struct {
 	AppName        string                          `yaml:"app_name"`
+	LogLevel       string                          `default:"debug" yaml:"log_level"`
 	Server         ServerConfig                    `yaml:"server"`
 	Service        ServiceConfig                   `yaml:"service"`
 	ContentClient  content_client.ClientConfig     `yaml:"content_client"`
 	MidConfig      mid.ClientConfig                `yaml:"mid_client"`
 	RedirectConfig redirect_client.RPCClientConfig `yaml:"redirect_client"`
 	Notifier       rbmq.NotifierConfig             `yaml:"notifier"`
+	Postback       postback.PostbackConfig         `yaml:"postback"`
+	Funnel         m.FunnelConfig                  `yaml:"funnel"`
+	Admin          AdminConfig                     `yaml:"admin"`
+	Tracing        tracing.TracingConfig           `yaml:"tracing"`
+	Breakers       breaker.BreakersConfig          `yaml:"breakers"`
+	AccessLog      accesslog.AccessLogConfig       `yaml:"access_log"`
+	Capture        capture.CaptureConfig           `yaml:"capture"`
+	Anomaly        anomaly.AnomalyConfig           `yaml:"anomaly"`
+	Store          store.StoreConfig               `yaml:"store"`
+	Links          links.LinksConfig               `yaml:"links"`
+	Guard          guard.GuardConfig               `yaml:"download_guard"`
+	Variants       variants.VariantsConfig         `yaml:"variants"`
+	History        history.HistoryConfig           `yaml:"content_history"`
+	Throttle       throttle.ThrottleConfig         `yaml:"download_throttle"`
+	LinkApi        LinkApiConfig                   `yaml:"link_api"`
+}
+
+type AdminConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	User    string `default:"admin" yaml:"user"`
+	Pass    string `yaml:"pass"`
+	// host:port of the separate admin listener, empty: on the main server
+	Listen string `yaml:"listen"`
+}
+
+// content link api of the mt and sms teams, basic auth
+type LinkApiConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// user: password
+	Accounts map[string]string `yaml:"accounts"`
 }
 
 type ServerConfig struct {
@@ -33,6 +78,7 @@ type ServerConfig struct {
 	Path     string                  `default:"/var/www/xmp.linkit360.ru/web/" yaml:"path"`
 	Url      string                  `default:"http://platform.pk.linkit360.ru" yaml:"url"`
 	Sessions sessions.SessionsConfig `yaml:"sessions"`
+	Timing   timing.TimingConfig     `yaml:"server_timing"`
 }
 type ServiceConfig struct {
 	ContentServiceCodeDefault string         `yaml:"content_service_code_default"`
@@ -48,6 +94,26 @@ type ServiceConfig struct {
 	OperatorCode              int64          `yaml:"operator_code" default:"25099"`
 	CountryCode               int64          `yaml:"country_code" default:"7"`
 	LandingPages              LPsConfig      `yaml:"landings"`
+	// campaign id: content file served when contentd is unavailable,
+	// relative to <server.path>/uploaded_content/
+	FallbackContent map[string]string `yaml:"fallback_content"`
+	ContentPage     ContentPageConfig `yaml:"content_page"`
+}
+
+// page with the content info and the download button instead of the file at once
+type ContentPageConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// <server.path>/campaign/<campaign id>/<template>, campaigns without it get the file at once
+	Template string `default:"content.html" yaml:"template"`
+	// thumbnail near the content: <content path without extension><preview_suffix>
+	PreviewSuffix string `default:"_preview.jpg" yaml:"preview_suffix"`
+	// campaign id: texts of the page
+	Campaigns map[string]ContentPageCampaign `yaml:"campaigns"`
+}
+
+type ContentPageCampaign struct {
+	ServiceName string `yaml:"service_name"`
+	Unsubscribe string `yaml:"unsubscribe"`
 }
 
 type RejectedConfig struct {
@@ -66,7 +132,6 @@ type BeelineLandingConf struct {
 	Enabled      bool   `yaml:"enabled"`
 	Url          string `yaml:"url"`
 	SessionPath  string `yaml:"session_path"`
-	MOQueue      string `yaml:"mo"`
 	OperatorCode int64  `yaml:"operator_code" default:"25099"`
 	CountryCode  int64  `yaml:"country_code" default:"7"`
 	Timeout      int    `yaml:"timeout"`
@@ -97,11 +162,6 @@ type MobilinkLandingConf struct {
 	Enabled      bool  `yaml:"enabled"`
 	OperatorCode int64 `yaml:"operator_code" default:"41001"`
 	CountryCode  int64 `yaml:"country_code" default:"92"`
-
-	Queues struct {
-		MO        string `yaml:"mo"`
-		Responses string `yaml:"responses"`
-	} `yaml:"queues"`
 }
 
 func LoadConfig() AppConfig {
@@ -123,6 +183,32 @@ func LoadConfig() AppConfig {
 		log.Fatal("app name must be without '-' : it's not a valid metric name")
 	}
 
+	level, err := log.ParseLevel(appConfig.LogLevel)
+	if err != nil {
+		log.WithField("log_level", appConfig.LogLevel).Fatal("wrong log level")
+	}
+	log.SetLevel(level)
+
+	if appConfig.Admin.Enabled && appConfig.Admin.Pass == "" {
+		log.Fatal("admin api enabled without password")
+	}
+
+	if appConfig.History.Enabled && len(rbmq.NewRouter(appConfig.Notifier.Routes).
+		Match(rbmq.EventSendSMS, appConfig.Service.OperatorCode, "")) == 0 {
+		log.Fatal("content history enabled without a send_sms route: the login pin cannot be sent")
+	}
+
+	if appConfig.LinkApi.Enabled {
+		if len(appConfig.LinkApi.Accounts) == 0 {
+			log.Fatal("link_api enabled without accounts: set link_api.accounts")
+		}
+		for user, pass := range appConfig.LinkApi.Accounts {
+			if user == "" || pass == "" {
+				log.Fatal("link_api.accounts: empty user or password")
+			}
+		}
+	}
+
 	if appConfig.Service.Rejected.TrafficRedirectEnabled &&
 		!appConfig.RedirectConfig.Enabled {
 		log.Infof("implicitly enabled redirect service")
@@ -131,6 +217,9 @@ func LoadConfig() AppConfig {
 
 	appConfig.Server.Port = envString("PORT", appConfig.Server.Port)
 	appConfig.Server.Path = envString("SERVER_PATH", appConfig.Server.Path)
+	if appConfig.Store.Path == "" {
+		appConfig.Store.Path = appConfig.Server.Path + "uploaded_content/"
+	}
 
 	appConfig.ContentClient.DSN = envString("CONTENT_DSN", appConfig.ContentClient.DSN)
 	appConfig.ContentClient.Timeout = envInt("CONTENT_TIMEOUT", appConfig.ContentClient.Timeout)
@@ -1,12 +1,16 @@
 package config
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"testing"
 
 	"github.com/jinzhu/configor"
 	"github.com/stretchr/testify/assert"
 	yaml "gopkg.in/yaml.v2"
+
+	"github.com/linkit360/go-dispatcherd/src/capture"
+	"github.com/linkit360/go-dispatcherd/src/links"
 )
 
 func TestConfig(t *testing.T) {
@@ -31,3 +35,30 @@ func TestConfig(t *testing.T) {
 		assert.Equal(t, appConfigCYaml2.Server, appConfigConfigor.Server, "server configs differ")
 	}
 }
+
+func TestMaskConfig(t *testing.T) {
+	var appConfig AppConfig
+	assert.NoError(t, configor.Load(&appConfig, "../../dev/dispatcherd.yml"))
+	secrets := []string{
+		"S3ACCESSKEYVALUE", "S3SECRETKEYVALUE", "mtpassword", "smspassword", "ADMINPASS",
+		"SESSIONSECRET", "SESSIONKEY", "LINKSECRET", "AESKEYVALUE", "BEELINEPASS", "QRTECHPASS",
+	}
+	appConfig.Store.S3.AccessKey = secrets[0]
+	appConfig.Store.S3.SecretKey = secrets[1]
+	appConfig.LinkApi.Accounts = map[string]string{"mt": secrets[2], "sms": secrets[3]}
+	appConfig.Admin.Pass = secrets[4]
+	appConfig.Server.Sessions.Secret = secrets[5]
+	appConfig.Server.Sessions.Key = secrets[6]
+	appConfig.Links.Keys = []links.Key{{Id: "k1", Secret: secrets[7]}}
+	appConfig.Service.LandingPages.QRTech.AesKey = secrets[8]
+	appConfig.Service.LandingPages.Beeline.Auth.Pass = secrets[9]
+	appConfig.Service.LandingPages.QRTech.Auth.Pass = secrets[10]
+
+	dump, err := json.Marshal(capture.MaskConfig(appConfig))
+	assert.NoError(t, err)
+	for _, secret := range secrets {
+		assert.NotContains(t, string(dump), secret)
+	}
+	assert.Contains(t, string(dump), `"accounts":{"mt":"***","sms":"***"}`)
+	assert.Contains(t, string(dump), `"bucket"`, "yaml names")
+}
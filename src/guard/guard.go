@@ -0,0 +1,288 @@
+package guard
+
+// download limits of the unique urls and brute force protection of /u/ and /d/
+//
+// every unique url may be downloaded max_downloads times: each ip it is sent to
+// is one download, and all the requests of the url (ranges, resumes, repeats)
+// may send max_downloads times the file size; the counters are kept
+// for counter_hours and saved on exit, failed downloads are not counted
+// the download is reserved before it is sent (a download in flight is taken
+// for the whole file) and settled after it, so concurrent requests cannot pass the quota together
+// the counters are of the node: behind a balancer without the url affinity
+// a url may be downloaded max_downloads times from every node
+// one ip may open rate_per_minute links a minute, ban_after invalid urls
+// in ban_window_min ban the ip for ban_min
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+type GuardConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// downloads of one unique url, 0: unlimited
+	MaxDownloads int    `default:"3" yaml:"max_downloads"`
+	CounterHours int    `default:"72" yaml:"counter_hours"`
+	CounterPath  string `yaml:"counter_path"`
+	// requests of one ip a minute, 0: unlimited
+	RatePerMinute int `default:"30" yaml:"rate_per_minute"`
+	// invalid urls of one ip to ban it, 0: never banned
+	BanAfter     int `default:"10" yaml:"ban_after"`
+	BanWindowMin int `default:"10" yaml:"ban_window_min"`
+	BanMin       int `default:"60" yaml:"ban_min"`
+	// never limited: monitoring, operator proxies
+	Whitelist []string `yaml:"whitelist"`
+}
+
+var (
+	ErrRateLimited   = errors.New("too many requests")
+	ErrBanned        = errors.New("ip banned")
+	ErrQuotaExceeded = errors.New("download quota exceeded")
+)
+
+var (
+	conf      GuardConfig
+	whitelist map[string]struct{}
+	// unique url: *linkDownloads
+	downloadsMu sync.Mutex
+	downloads   *cache.Cache
+	// rate, invalid url counters and bans by ip
+	limits *cache.Cache
+)
+
+func Init(guardConf GuardConfig) {
+	conf = guardConf
+	if !conf.Enabled {
+		return
+	}
+	whitelist = make(map[string]struct{}, len(conf.Whitelist))
+	for _, ip := range conf.Whitelist {
+		whitelist[ip] = struct{}{}
+	}
+	limits = cache.New(time.Duration(conf.BanMin)*time.Minute, time.Minute)
+	loadState()
+	log.WithFields(log.Fields{
+		"max_downloads":   conf.MaxDownloads,
+		"rate_per_minute": conf.RatePerMinute,
+		"ban_after":       conf.BanAfter,
+	}).Info("download guard init")
+}
+
+// Allow is called for every link request of the ip
+func Allow(ip string) error {
+	if !conf.Enabled || whitelisted(ip) {
+		return nil
+	}
+	if _, banned := limits.Get("ban-" + ip); banned {
+		return ErrBanned
+	}
+	if conf.RatePerMinute <= 0 {
+		return nil
+	}
+	// fixed window: the counter expires a minute after the first request
+	if incr(limits, "rate-"+ip, time.Minute) > conf.RatePerMinute {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// Invalid counts the unknown or forged url of the ip, true when the ip is banned now
+func Invalid(ip string) bool {
+	if !conf.Enabled || conf.BanAfter <= 0 || whitelisted(ip) {
+		return false
+	}
+	if incr(limits, "invalid-"+ip, time.Duration(conf.BanWindowMin)*time.Minute) < conf.BanAfter {
+		return false
+	}
+	limits.Delete("invalid-" + ip)
+	limits.Set("ban-"+ip, time.Now(), time.Duration(conf.BanMin)*time.Minute)
+	m.DownloadBans.Inc()
+	log.WithFields(log.Fields{
+		"ip":      ip,
+		"invalid": conf.BanAfter,
+		"ban_min": conf.BanMin,
+	}).Warn("ip banned")
+	return true
+}
+
+// linkDownloads is what was sent by the unique url
+type linkDownloads struct {
+	// every ip is one download
+	IPs   map[string]bool `json:"ips"`
+	Bytes int64           `json:"bytes"`
+	// the file size, the byte budget is max_downloads sizes
+	Size int64 `json:"size"`
+	// ip: the downloads in flight, not saved
+	reserved map[string]int
+	inFlight int64
+}
+
+// Download reserves the download of the unique url by the ip when the quota allows it,
+// the count includes this one; the reservation is settled by Downloaded
+func Download(uniqueUrl, ip string) (int, error) {
+	if !conf.Enabled || conf.MaxDownloads <= 0 {
+		return 0, nil
+	}
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	var d *linkDownloads
+	if v, ok := downloads.Get(uniqueUrl); ok {
+		d = v.(*linkDownloads)
+	} else {
+		// the counter expires counter_hours after the first download
+		d = &linkDownloads{IPs: make(map[string]bool)}
+		downloads.SetDefault(uniqueUrl, d)
+	}
+	if d.reserved == nil {
+		d.reserved = make(map[string]int)
+	}
+	count := len(d.IPs)
+	for reservedIP := range d.reserved {
+		if !d.IPs[reservedIP] {
+			count++
+		}
+	}
+	if !d.IPs[ip] && d.reserved[ip] == 0 {
+		count++
+	}
+	if count > conf.MaxDownloads {
+		return count, ErrQuotaExceeded
+	}
+	if d.Size > 0 && d.Bytes+d.inFlight*d.Size >= int64(conf.MaxDownloads)*d.Size {
+		return count, ErrQuotaExceeded
+	}
+	d.reserved[ip]++
+	d.inFlight++
+	return count, nil
+}
+
+// Downloaded settles the reservation of Download with the bytes sent,
+// the ip is not counted when nothing was sent
+func Downloaded(uniqueUrl, ip string, bytes, size int64) {
+	if !conf.Enabled || conf.MaxDownloads <= 0 {
+		return
+	}
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	var d *linkDownloads
+	if v, ok := downloads.Get(uniqueUrl); ok {
+		d = v.(*linkDownloads)
+	} else {
+		// expired in between
+		d = &linkDownloads{IPs: make(map[string]bool)}
+		downloads.SetDefault(uniqueUrl, d)
+	}
+	if d.reserved[ip] > 0 {
+		d.inFlight--
+		if d.reserved[ip]--; d.reserved[ip] == 0 {
+			delete(d.reserved, ip)
+		}
+	}
+	if bytes <= 0 {
+		return
+	}
+	d.IPs[ip] = true
+	d.Bytes += bytes
+	if size > 0 {
+		d.Size = size
+	}
+}
+
+func whitelisted(ip string) bool {
+	_, ok := whitelist[ip]
+	return ok
+}
+
+// incr does not prolong the expiration of the existing counter
+func incr(c *cache.Cache, key string, expiration time.Duration) int {
+	if err := c.Add(key, 1, expiration); err == nil {
+		return 1
+	}
+	count, err := c.IncrementInt(key, 1)
+	if err != nil {
+		// expired in between
+		c.Set(key, 1, expiration)
+		return 1
+	}
+	return count
+}
+
+// savedLink is the counter of the unique url in the state file
+type savedLink struct {
+	linkDownloads
+	Expires int64 `json:"expires"`
+}
+
+func loadState() {
+	expiration := time.Duration(conf.CounterHours) * time.Hour
+	downloads = cache.New(expiration, time.Minute)
+	if conf.CounterPath == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(conf.CounterPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Debug("load download counters")
+		return
+	}
+	var saved map[string]savedLink
+	if err = json.Unmarshal(data, &saved); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("load download counters")
+		return
+	}
+	now := time.Now()
+	for uniqueUrl, link := range saved {
+		expires := time.Unix(0, link.Expires)
+		if link.IPs == nil || !expires.After(now) {
+			continue
+		}
+		d := link.linkDownloads
+		downloads.Set(uniqueUrl, &d, expires.Sub(now))
+	}
+	log.WithFields(log.Fields{
+		"len": downloads.ItemCount(),
+	}).Debug("load download counters")
+}
+
+func SaveState() {
+	if !conf.Enabled || conf.CounterPath == "" {
+		return
+	}
+	downloadsMu.Lock()
+	saved := make(map[string]savedLink, downloads.ItemCount())
+	for uniqueUrl, item := range downloads.Items() {
+		saved[uniqueUrl] = savedLink{
+			linkDownloads: *item.Object.(*linkDownloads),
+			Expires:       item.Expiration,
+		}
+	}
+	data, err := json.Marshal(saved)
+	downloadsMu.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": fmt.Errorf("json.Marshal: %s", err.Error()),
+		}).Error("download counters save state")
+		return
+	}
+	if err := ioutil.WriteFile(conf.CounterPath, data, 0666); err != nil {
+		log.WithFields(log.Fields{
+			"error": fmt.Errorf("ioutil.WriteFile: %s", err.Error()),
+		}).Error("download counters save state")
+		return
+	}
+	log.WithFields(log.Fields{
+		"len": len(saved),
+	}).Info("download counters save state ok")
+}
@@ -0,0 +1,123 @@
+package guard
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+func TestMain(t *testing.M) {
+	m.Init("dispatcherd_test")
+	os.Exit(t.Run())
+}
+
+func testConf() GuardConfig {
+	return GuardConfig{
+		Enabled:       true,
+		MaxDownloads:  2,
+		CounterHours:  1,
+		RatePerMinute: 3,
+		BanAfter:      2,
+		BanWindowMin:  10,
+		BanMin:        60,
+		Whitelist:     []string{"10.0.0.1"},
+	}
+}
+
+func TestLimits(t *testing.T) {
+	Init(testConf())
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, Allow("1.1.1.1"))
+	}
+	assert.Equal(t, ErrRateLimited, Allow("1.1.1.1"))
+	assert.NoError(t, Allow("2.2.2.2"), "other ip")
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, Allow("10.0.0.1"), "whitelisted")
+	}
+
+	assert.False(t, Invalid("2.2.2.2"))
+	assert.True(t, Invalid("2.2.2.2"))
+	assert.Equal(t, ErrBanned, Allow("2.2.2.2"))
+	assert.False(t, Invalid("10.0.0.1"))
+	assert.False(t, Invalid("10.0.0.1"))
+
+	Init(GuardConfig{})
+	assert.NoError(t, Allow("2.2.2.2"), "disabled")
+}
+
+func TestDownloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guard")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := testConf()
+	conf.CounterPath = filepath.Join(dir, "counters.json")
+	Init(conf)
+
+	count, err := Download("abc", "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	// failed: not counted
+	Downloaded("abc", "1.1.1.1", 0, 0)
+	count, err = Download("abc", "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	Downloaded("abc", "1.1.1.1", 10, 1000)
+
+	// one download of the ip, any ranges
+	count, err = Download("abc", "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	Downloaded("abc", "1.1.1.1", 1, 1000)
+	count, err = Download("abc", "2.2.2.2")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	Downloaded("abc", "2.2.2.2", 1000, 1000)
+	count, err = Download("abc", "3.3.3.3")
+	assert.Equal(t, ErrQuotaExceeded, err, "third ip")
+	assert.Equal(t, 3, count)
+
+	// the downloads in flight are reserved
+	_, err = Download("jkl", "1.1.1.1")
+	assert.NoError(t, err)
+	_, err = Download("jkl", "2.2.2.2")
+	assert.NoError(t, err)
+	_, err = Download("jkl", "3.3.3.3")
+	assert.Equal(t, ErrQuotaExceeded, err, "two ips in flight")
+	_, err = Download("mno", "1.1.1.1")
+	assert.NoError(t, err)
+	Downloaded("mno", "1.1.1.1", 500, 500)
+	_, err = Download("mno", "1.1.1.1")
+	assert.NoError(t, err)
+	_, err = Download("mno", "1.1.1.1")
+	assert.Equal(t, ErrQuotaExceeded, err, "one size sent, one in flight")
+
+	// the ranges of one ip are limited by the bytes
+	for i := 0; i < 9; i++ {
+		_, err = Download("def", "1.1.1.1")
+		assert.NoError(t, err)
+		Downloaded("def", "1.1.1.1", 100, 500)
+	}
+	_, err = Download("def", "1.1.1.1")
+	assert.NoError(t, err)
+	Downloaded("def", "1.1.1.1", 100, 500)
+	_, err = Download("def", "1.1.1.1")
+	assert.Equal(t, ErrQuotaExceeded, err, "two sizes sent")
+
+	// the counters survive the restart
+	SaveState()
+	Init(conf)
+	_, err = Download("abc", "3.3.3.3")
+	assert.Equal(t, ErrQuotaExceeded, err)
+	_, err = Download("def", "1.1.1.1")
+	assert.Equal(t, ErrQuotaExceeded, err)
+	count, err = Download("ghi", "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
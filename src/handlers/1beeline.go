@@ -13,10 +13,11 @@ import (
 	cache "github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/linkit360/go-dispatcherd/src/anomaly"
 	m "github.com/linkit360/go-dispatcherd/src/metrics"
 	"github.com/linkit360/go-dispatcherd/src/rbmq"
 	"github.com/linkit360/go-dispatcherd/src/sessions"
-	mid_client "github.com/linkit360/go-mid/rpcclient"
+	"github.com/linkit360/go-dispatcherd/src/timing"
 	rec "github.com/linkit360/go-utils/rec"
 )
 
@@ -130,7 +131,7 @@ func notifyBeeline(c *gin.Context) {
 		action.CampaignId = land.CampaignId
 		action.Tid = land.Tid
 
-		if err := notifierService.ActionNotify(action); err != nil {
+		if err := notifierService.ActionNotify(c.Request.Context(), action); err != nil {
 			log.WithFields(log.Fields{
 				"error": err.Error(),
 				"tid":   land.Tid,
@@ -173,7 +174,7 @@ func notifyBeeline(c *gin.Context) {
 	}
 	req.SetBasicAuth(cnf.Service.LandingPages.Beeline.Auth.User, cnf.Service.LandingPages.Beeline.Auth.Pass)
 
-	resp, err := httpClient.Do(req)
+	resp, err := httpDo(c, upstreamBeeline, "notify", &httpClient, req)
 	if err != nil {
 		err = fmt.Errorf("Beeline Notify: httpClient.Do: %s, url: %s", err.Error(), notifyBeelineUrl)
 		return
@@ -186,7 +187,7 @@ func notifyBeeline(c *gin.Context) {
 	}
 	beelineCache.Delete(serviceId)
 
-	if err = notifierService.NewSubscriptionNotify(cnf.Service.LandingPages.Beeline.MOQueue, land); err != nil {
+	if err = notifierService.NewSubscriptionNotify(c.Request.Context(), land); err != nil {
 		m.NotifyNewSubscriptionError.Inc()
 
 		err = fmt.Errorf("notifierService.NewSubscriptionNotify: %s", err.Error())
@@ -196,6 +197,8 @@ func notifyBeeline(c *gin.Context) {
 		}).Error("notify new subscription")
 		return
 	}
+	m.Funnel(m.FunnelNotified, land.CampaignId, land.OperatorCode, land.Publisher)
+	anomaly.Count(land.CampaignId, anomaly.Notified)
 	return
 }
 
@@ -224,9 +227,11 @@ func redirectUserBeeline(c *gin.Context) {
 		}
 		action.Msisdn = msg.Msisdn
 		action.CampaignId = msg.CampaignId
+		action.OperatorCode = msg.OperatorCode
+		action.Publisher = sessions.GetFromSession("publisher", c)
 		action.Tid = msg.Tid
 
-		if err := notifierService.ActionNotify(action); err != nil {
+		if err := notifierService.ActionNotify(c.Request.Context(), action); err != nil {
 			log.WithFields(log.Fields{
 				"error": err.Error(),
 				"tid":   r.Tid,
@@ -236,7 +241,7 @@ func redirectUserBeeline(c *gin.Context) {
 				"tid": msg.Tid,
 			}).Info("notify action ok")
 		}
-		if errAccessCampaign := notifierService.AccessCampaignNotify(msg); errAccessCampaign != nil {
+		if errAccessCampaign := notifierService.AccessCampaignNotify(c.Request.Context(), msg); errAccessCampaign != nil {
 			log.WithFields(log.Fields{
 				"tid":   r.Tid,
 				"error": errAccessCampaign.Error(),
@@ -258,8 +263,9 @@ func redirectUserBeeline(c *gin.Context) {
 	msg.CampaignHash = campaign.Hash
 	msg.CountryCode = cnf.Service.LandingPages.Beeline.CountryCode
 	msg.OperatorCode = cnf.Service.LandingPages.Beeline.OperatorCode
+	setRequestInfo(c, msg.Tid, msg.CampaignId, msg.OperatorCode)
 
-	service, err := mid_client.GetServiceByCode(msg.ServiceCode)
+	service, err := getServiceByCode(c, msg.ServiceCode)
 	if err != nil {
 		err = fmt.Errorf("mid_client.GetServiceById: %s", err.Error())
 		log.WithFields(log.Fields{
@@ -302,7 +308,7 @@ func redirectUserBeeline(c *gin.Context) {
 		Timeout: time.Duration(cnf.Service.LandingPages.Beeline.Timeout) * time.Second,
 	}
 
-	resp, err := httpClient.Do(req)
+	resp, err := httpDo(c, upstreamBeeline, "subscribe", &httpClient, req)
 	if err != nil {
 		err = fmt.Errorf("Cann't make request: %s", err.Error())
 		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
@@ -418,8 +424,9 @@ func returnBackCampaignPage(c *gin.Context) {
 		}
 	}
 
-	if err = notifierService.ActionNotify(action); err != nil {
+	if err = notifierService.ActionNotify(c.Request.Context(), action); err != nil {
 		return
 	}
+	defer requestTimings(c).Since(timing.Render, time.Now())
 	c.HTML(http.StatusOK, campaignPage+".html", nil)
 }
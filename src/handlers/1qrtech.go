@@ -17,10 +17,10 @@ import (
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/linkit360/go-dispatcherd/src/anomaly"
 	m "github.com/linkit360/go-dispatcherd/src/metrics"
 	"github.com/linkit360/go-dispatcherd/src/rbmq"
 	"github.com/linkit360/go-dispatcherd/src/sessions"
-	mid_client "github.com/linkit360/go-mid/rpcclient"
 	"github.com/linkit360/go-utils/rec"
 	xmp_api_structs "github.com/linkit360/xmp-api/src/structs"
 )
@@ -48,6 +48,8 @@ func qrTechHandler(c *gin.Context) {
 	defer func() {
 		action.Msisdn = msg.Msisdn
 		action.CampaignId = msg.CampaignId
+		action.OperatorCode = msg.OperatorCode
+		action.Publisher = sessions.GetFromSession("publisher", c)
 		action.Tid = msg.Tid
 		if err != nil {
 			m.Errors.Inc()
@@ -60,18 +62,19 @@ func qrTechHandler(c *gin.Context) {
 		} else {
 			m.CampaignAccess.Inc()
 			m.Success.Inc()
+			funnel(c, m.FunnelLanding, msg.CampaignId, msg.OperatorCode)
 
 			logCtx.WithFields(log.Fields{}).Info("serve ok")
 		}
 
-		if errAction := notifierService.ActionNotify(action); errAction != nil {
+		if errAction := notifierService.ActionNotify(c.Request.Context(), action); errAction != nil {
 			logCtx.WithFields(log.Fields{
 				"error":  errAction.Error(),
 				"action": fmt.Sprintf("%#v", action),
 			}).Error("notify user action")
 		}
 
-		if errAccessCampaign := notifierService.AccessCampaignNotify(msg); errAccessCampaign != nil {
+		if errAccessCampaign := notifierService.AccessCampaignNotify(c.Request.Context(), msg); errAccessCampaign != nil {
 			logCtx.WithFields(log.Fields{
 				"error": errAccessCampaign.Error(),
 				"msg":   fmt.Sprintf("%#v", msg),
@@ -83,7 +86,7 @@ func qrTechHandler(c *gin.Context) {
 			log.WithFields(log.Fields{
 				"tid": msg.Tid,
 			}).Debug("found pixel in get params")
-			if err := notifierService.PixelBufferNotify(rec.Record{
+			if err := notifierService.PixelBufferNotify(c.Request.Context(), rec.Record{
 				SentAt:     time.Now().UTC(),
 				CampaignId: msg.CampaignId,
 				Tid:        msg.Tid,
@@ -103,6 +106,7 @@ func qrTechHandler(c *gin.Context) {
 	if !ok {
 		m.Errors.Inc()
 		m.PageNotFoundError.Inc()
+		anomaly.Count("", anomaly.NotFound)
 		err = fmt.Errorf("page not found: %s", campaignLink)
 
 		log.WithFields(log.Fields{
@@ -144,13 +148,15 @@ func qrTechHandler(c *gin.Context) {
 		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
 		return
 	}
+	setRequestInfo(c, msg.Tid, msg.CampaignId, msg.OperatorCode)
 
 	if campaign.AutoClickEnabled {
 		logCtx.WithFields(log.Fields{
 			"telco": telco,
 		}).Debug("autoclick enabled")
+		funnel(c, m.FunnelAutoclick, msg.CampaignId, msg.OperatorCode)
 		var service xmp_api_structs.Service
-		service, err = mid_client.GetServiceByCode(campaign.ServiceCode)
+		service, err = getServiceByCode(c, campaign.ServiceCode)
 		if err != nil {
 			err = fmt.Errorf("mid_client.GetServiceById: %s", err.Error())
 			logCtx.WithFields(log.Fields{
@@ -212,7 +218,7 @@ func qrTechHandler(c *gin.Context) {
 		}
 
 		var resp *http.Response
-		resp, err = httpClient.Do(req)
+		resp, err = httpDo(c, upstreamQRTech, "autoclick", &httpClient, req)
 		if err != nil {
 			err = fmt.Errorf("Cann't make request: %s", err.Error())
 			http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
@@ -320,7 +326,7 @@ func qrTechHandler(c *gin.Context) {
 		Timeout: time.Duration(cnf.Service.LandingPages.QRTech.Timeout) * time.Second,
 	}
 	var resp *http.Response
-	resp, err = httpClient.Do(req)
+	resp, err = httpDo(c, upstreamQRTech, "wap", &httpClient, req)
 	if err != nil {
 		err = fmt.Errorf("Cann't make request: %s", err.Error())
 		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
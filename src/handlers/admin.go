@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-dispatcherd/src/anomaly"
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/sessions"
+)
+
+// admin api, basic auth, on the main server or on the separate listener
+var admin *gin.RouterGroup
+
+func AddAdminHandlers() {
+	if !cnf.Admin.Enabled {
+		return
+	}
+	engine := e
+	if cnf.Admin.Listen != "" {
+		engine = gin.New()
+		engine.Use(gin.Recovery())
+	}
+	admin = engine.Group("/admin", gin.BasicAuth(gin.Accounts{cnf.Admin.User: cnf.Admin.Pass}))
+	admin.GET("/funnel", funnelReport)
+	admin.GET("/capture", captureRules)
+	admin.POST("/capture", addCaptureRule)
+	admin.DELETE("/capture/:id", removeCaptureRule)
+	admin.GET("/capture/timeline", captureTimeline)
+	admin.GET("/anomalies", anomalies)
+	addDebugHandlers(admin)
+
+	if cnf.Admin.Listen != "" {
+		go func() {
+			if err := engine.Run(cnf.Admin.Listen); err != nil {
+				log.WithFields(log.Fields{
+					"listen": cnf.Admin.Listen,
+					"error":  err.Error(),
+				}).Error("admin listener")
+			}
+		}()
+	}
+	log.WithFields(log.Fields{"listen": cnf.Admin.Listen}).Debug("admin handlers init")
+}
+
+// rolling conversion ratios, ?campaign_id= to get one campaign
+func funnelReport(c *gin.Context) {
+	c.JSON(200, m.FunnelSnapshot(c.Query("campaign_id")))
+}
+
+// last anomaly check per campaign and metric, ?all=1 to get not anomalous too
+func anomalies(c *gin.Context) {
+	c.JSON(200, anomaly.States(c.Query("all") == ""))
+}
+
+func funnel(c *gin.Context, stage, campaignId string, operatorCode int64) {
+	m.Funnel(stage, campaignId, operatorCode, sessions.GetFromSession("publisher", c))
+	if stage == m.FunnelLanding {
+		anomaly.Count(campaignId, anomaly.Landing)
+	}
+}
@@ -3,11 +3,14 @@ package handlers
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/linkit360/go-dispatcherd/src/anomaly"
 	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/postback"
 	"github.com/linkit360/go-dispatcherd/src/rbmq"
 	"github.com/linkit360/go-dispatcherd/src/sessions"
 	mid_client "github.com/linkit360/go-mid/rpcclient"
@@ -41,7 +44,7 @@ func initiateSubscription(c *gin.Context) {
 				"error": err.Error(),
 			}).Error("subscribe")
 		}
-		if errAction := notifierService.ActionNotify(action); errAction != nil {
+		if errAction := notifierService.ActionNotify(c.Request.Context(), action); errAction != nil {
 			logCtx.WithFields(log.Fields{
 				"error":  errAction.Error(),
 				"action": fmt.Sprintf("%#v", action),
@@ -57,6 +60,7 @@ func initiateSubscription(c *gin.Context) {
 	campaign, ok := campaignByLink[campaignLink]
 	if !ok {
 		m.PageNotFoundError.Inc()
+		anomaly.Count("", anomaly.NotFound)
 		err = fmt.Errorf("page not found: %s", campaignLink)
 
 		log.WithFields(log.Fields{
@@ -67,6 +71,7 @@ func initiateSubscription(c *gin.Context) {
 		return
 	}
 	msg.CampaignId = campaign.Id
+	setRequestInfo(c, msg.Tid, msg.CampaignId, msg.OperatorCode)
 	msg.ServiceCode = campaign.ServiceCode
 	msg.CampaignHash = campaign.Hash
 	if msg.IP == "" {
@@ -136,8 +141,7 @@ func initiateSubscription(c *gin.Context) {
 			Channel:      c.DefaultQuery("channel", ""),
 		}
 
-		if err := notifierService.Notify(
-			cnf.Service.LandingPages.Mobilink.Queues.Responses, qEvent, r); err != nil {
+		if err := notifierService.Notify(c.Request.Context(), qEvent, r); err != nil {
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
@@ -161,17 +165,19 @@ func initiateSubscription(c *gin.Context) {
 func startNewSubscription(c *gin.Context, msg structs.AccessCampaignNotify) error {
 
 	if cnf.Service.Rejected.CampaignRedirectEnabled {
-		campaignRedirect, err := redirect(msg)
+		campaignRedirect, err := redirect(c, msg)
 		if err != nil {
 			return err
 		}
 		if campaignRedirect.Id == "" {
+			funnel(c, m.FunnelRejected, msg.CampaignId, msg.OperatorCode)
 			msg.Error = "rejected"
 			log.WithFields(log.Fields{
 				"url": cnf.Service.ErrorRedirectUrl,
 			}).Debug("rejected")
 		} else if campaignRedirect.Id != msg.CampaignId {
 			m.Redirected.Inc()
+			funnel(c, m.FunnelRedirected, msg.CampaignId, msg.OperatorCode)
 
 			log.WithFields(log.Fields{
 				"tid": msg.Tid,
@@ -184,7 +190,13 @@ func startNewSubscription(c *gin.Context, msg structs.AccessCampaignNotify) erro
 	}
 
 	if cnf.Service.Rejected.TrafficRedirectEnabled {
-		err := mid_client.SetMsisdnServiceCache(msg.ServiceCode, msg.Msisdn)
+		begin := time.Now()
+		err := allow(c, upstreamMid, "SetMsisdnServiceCache")
+		if err == nil {
+			err = mid_client.SetMsisdnServiceCache(msg.ServiceCode, msg.Msisdn)
+		}
+		observe(c, upstreamMid, "SetMsisdnServiceCache", begin, err,
+			gin.H{"service_code": msg.ServiceCode, "msisdn": msg.Msisdn}, nil)
 		if err != nil {
 			err = fmt.Errorf("mid_client.SetMsisdnServiceCache: %s", err.Error())
 			log.WithFields(log.Fields{
@@ -195,6 +207,7 @@ func startNewSubscription(c *gin.Context, msg structs.AccessCampaignNotify) erro
 	}
 
 	m.Agree.Inc()
+	anomaly.Count(msg.CampaignId, anomaly.Agree)
 	logCtx := log.WithFields(log.Fields{
 		"tid": msg.Tid,
 	})
@@ -220,13 +233,7 @@ func startNewSubscription(c *gin.Context, msg structs.AccessCampaignNotify) erro
 		Channel:            c.DefaultQuery("channel", ""),
 	}
 
-	var moQueue string
-	if cnf.Service.LandingPages.Mobilink.Enabled {
-		moQueue = cnf.Service.LandingPages.Mobilink.Queues.MO
-	} else {
-		log.Fatal("not implemented for this telco")
-	}
-	if err := notifierService.NewSubscriptionNotify(moQueue, r); err != nil {
+	if err := notifierService.NewSubscriptionNotify(c.Request.Context(), r); err != nil {
 		m.NotifyNewSubscriptionError.Inc()
 
 		err = fmt.Errorf("notifierService.NewSubscriptionNotify: %s", err.Error())
@@ -234,8 +241,26 @@ func startNewSubscription(c *gin.Context, msg structs.AccessCampaignNotify) erro
 		return err
 	}
 	m.AgreeSuccess.Inc()
+	m.Funnel(m.FunnelNotified, r.CampaignId, r.OperatorCode, r.Publisher)
+	anomaly.Count(r.CampaignId, anomaly.Notified)
+	if err := postback.Send(postback.Conversion{
+		Tid:          r.Tid,
+		Publisher:    r.Publisher,
+		Pixel:        r.Pixel,
+		CampaignId:   r.CampaignId,
+		OperatorCode: r.OperatorCode,
+	}); err != nil {
+		logCtx.WithField("error", err.Error()).Error("send postback")
+	}
 	if cnf.Service.Rejected.CampaignRedirectEnabled {
-		if err := mid_client.SetMsisdnCampaignCache(msg.CampaignId, msg.Msisdn); err != nil {
+		begin := time.Now()
+		err := allow(c, upstreamMid, "SetMsisdnCampaignCache")
+		if err == nil {
+			err = mid_client.SetMsisdnCampaignCache(msg.CampaignId, msg.Msisdn)
+		}
+		observe(c, upstreamMid, "SetMsisdnCampaignCache", begin, err,
+			gin.H{"campaign_id": msg.CampaignId, "msisdn": msg.Msisdn}, nil)
+		if err != nil {
 			err = fmt.Errorf("mid_client.SetMsisdnCampaignCache: %s", err.Error())
 			logCtx.Error(err.Error())
 		}
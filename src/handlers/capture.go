@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/linkit360/go-dispatcherd/src/capture"
+)
+
+// debug capture: rules are managed in the admin api,
+// the trail of the request is kept in the request context
+
+func startCapture(c *gin.Context, tid, msisdn, requestId string) *capture.Trail {
+	trail := capture.NewTrail(tid, msisdn)
+	if trail == nil {
+		return nil
+	}
+	c.Request = c.Request.WithContext(capture.NewContext(c.Request.Context(), trail))
+	trail.Add(capture.KindRequest, c.Request.Method+" "+c.Request.URL.Path, 0, nil, gin.H{
+		"request_id": requestId,
+		"url":        c.Request.URL.String(),
+		"headers":    c.Request.Header,
+		"ip":         c.ClientIP(),
+	})
+	return trail
+}
+
+func finishCapture(c *gin.Context, trail *capture.Trail, took time.Duration) {
+	if trail == nil {
+		return
+	}
+	var err error
+	if len(c.Errors) > 0 {
+		err = c.Errors.Last()
+	}
+	trail.Add(capture.KindResponse, strconv.Itoa(c.Writer.Status()), took, err, gin.H{
+		"status":  c.Writer.Status(),
+		"headers": c.Writer.Header(),
+		"bytes":   c.Writer.Size(),
+	})
+	trail.Finish()
+}
+
+type captureRuleParams struct {
+	Msisdn     string `json:"msisdn"`
+	Tid        string `json:"tid"`
+	CampaignId string `json:"campaign_id"`
+	TTLMinutes int    `json:"ttl_minutes"`
+}
+
+func addCaptureRule(c *gin.Context) {
+	var params captureRuleParams
+	if err := c.BindJSON(&params); err != nil {
+		return
+	}
+	rule, err := capture.AddRule(capture.Rule{
+		Msisdn:     params.Msisdn,
+		Tid:        params.Tid,
+		CampaignId: params.CampaignId,
+	}, time.Duration(params.TTLMinutes)*time.Minute)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, rule)
+}
+
+func captureRules(c *gin.Context) {
+	c.JSON(200, capture.Rules())
+}
+
+func removeCaptureRule(c *gin.Context) {
+	if !capture.RemoveRule(c.Param("id")) {
+		c.JSON(404, gin.H{"error": "no such rule"})
+		return
+	}
+	c.JSON(200, gin.H{"removed": c.Param("id")})
+}
+
+func captureTimeline(c *gin.Context) {
+	c.JSON(200, capture.Timeline(capture.Filter{
+		Tid:        c.Query("tid"),
+		Msisdn:     c.Query("msisdn"),
+		CampaignId: c.Query("campaign_id"),
+		RuleId:     c.Query("rule_id"),
+	}))
+}
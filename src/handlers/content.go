@@ -3,24 +3,35 @@ package handlers
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
 	content_client "github.com/linkit360/go-contentd/rpcclient"
 	content_service "github.com/linkit360/go-contentd/server/src/service"
+	"github.com/linkit360/go-dispatcherd/src/anomaly"
+	"github.com/linkit360/go-dispatcherd/src/guard"
+	"github.com/linkit360/go-dispatcherd/src/links"
 	m "github.com/linkit360/go-dispatcherd/src/metrics"
 	"github.com/linkit360/go-dispatcherd/src/rbmq"
 	"github.com/linkit360/go-dispatcherd/src/sessions"
+	"github.com/linkit360/go-dispatcherd/src/store"
 	"github.com/linkit360/go-dispatcherd/src/utils"
+	"github.com/linkit360/go-dispatcherd/src/variants"
 	"github.com/linkit360/go-utils/rec"
 	"github.com/linkit360/go-utils/structs"
 )
 
 func AddContentHandlers() {
-	e.GET("/u/:uniqueurl", AccessHandler, UniqueUrlGet)
-	e.Group("/content/:campaign_hash").GET("", AccessHandler, ContentGet)
+	e.GET(downloadRoute("/u/:uniqueurl"), AccessHandler, DownloadHandler, UniqueUrlGet)
+	e.GET(downloadRoute("/d/:token"), AccessHandler, DownloadHandler, SignedUrlGet)
+	e.GET(downloadRoute("/content/:campaign_hash"), AccessHandler, DownloadHandler, ContentGet)
 }
 
 // gets the random content and sends it as a file
@@ -39,6 +50,9 @@ func ContentGet(c *gin.Context) {
 		Tid:    msg.Tid,
 	}
 	contentProperties := &structs.ContentSentProperties{}
+	var delivery utils.Delivery
+	// the content page: the file is sent by the unique url
+	var view bool
 	defer func() {
 		if err != nil {
 			m.Errors.Inc()
@@ -49,10 +63,15 @@ func ContentGet(c *gin.Context) {
 			}).Error("cann't process")
 		}
 
-		if err := notifierService.ActionNotify(action); err != nil {
+		if err := notifierService.ActionNotify(c.Request.Context(), action); err != nil {
 			logCtx.WithField("error", err.Error()).Error("notify user action")
 		}
-		if err = notifierService.ContentSentNotify(*contentProperties); err != nil {
+		if view {
+			return
+		}
+		sent := contentSent(*contentProperties, delivery)
+		recordHistory(sent)
+		if err = notifierService.ContentSentNotify(c.Request.Context(), sent); err != nil {
 			logCtx.WithFields(log.Fields{
 				"error": err.Error(),
 				"data":  fmt.Sprintf("%#v", contentProperties),
@@ -76,6 +95,7 @@ func ContentGet(c *gin.Context) {
 		return
 	}
 	msg.CampaignId = campaign.Id
+	setRequestInfo(c, msg.Tid, msg.CampaignId, msg.OperatorCode)
 	msg.ServiceCode = campaign.ServiceCode
 	msg.CampaignHash = campaign.Hash
 	action.CampaignId = campaign.Id
@@ -95,7 +115,7 @@ func ContentGet(c *gin.Context) {
 				Msisdn:     msg.Msisdn,
 				CampaignId: campaign.Id,
 			}
-			if err := notifierService.ActionNotify(subAction); err != nil {
+			if err := notifierService.ActionNotify(c.Request.Context(), subAction); err != nil {
 				logCtx.WithField("error", err.Error()).Error("notify user action")
 			}
 		}
@@ -114,19 +134,51 @@ func ContentGet(c *gin.Context) {
 		log.Error("content send: opcode/country code: not implemented for this telco")
 	}
 
-	contentProperties, err = content_client.Get(content_service.GetContentParams{
+	params := content_service.GetContentParams{
 		Msisdn:       msg.Msisdn,
 		Tid:          msg.Tid,
 		CampaignId:   campaign.Id,
 		ServiceCode:  campaign.ServiceCode,
 		OperatorCode: operatorCode,
 		CountryCode:  countryCode,
-	})
+	}
+
+	// the page links to the unique url of the content, the file is got there
+	if page := contentPage(campaign.Id); page != nil {
+		props, contentUrl, errUrl := newUniqueUrl(c, rec.Record{
+			Msisdn:       msg.Msisdn,
+			Tid:          msg.Tid,
+			ServiceCode:  campaign.ServiceCode,
+			CampaignId:   campaign.Id,
+			OperatorCode: operatorCode,
+			CountryCode:  countryCode,
+		})
+		if errUrl == nil {
+			view = true
+			action.Action = "content_view"
+			if err = renderContentPage(c, page, newContentPageData(contentUrl, props.ContentName, campaign.Id)); err != nil {
+				logCtx.WithField("error", err.Error()).Error("content page")
+			}
+			return
+		}
+		logCtx.WithField("error", errUrl.Error()).Error("no content page, send content")
+	}
+
+	begin := time.Now()
+	if err = allow(c, upstreamContentd, "Get"); err == nil {
+		contentProperties, err = content_client.Get(params)
+	}
+	observe(c, upstreamContentd, "Get", begin, err, params, contentProperties)
 	if err != nil {
 		m.ContentDeliveryErrors.Inc()
 
 		err = fmt.Errorf("content.Get: %s", err.Error())
-		logCtx.Fatal("contentd fatal: trying to free all resources")
+		logCtx.WithField("error", err.Error()).Error("contentd unavailable")
+		contentProperties = &structs.ContentSentProperties{Tid: msg.Tid, CampaignId: campaign.Id}
+		var ok bool
+		if delivery, ok = serveFallbackContent(c, campaign.Id, logCtx); ok {
+			return
+		}
 		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
 		return
 	}
@@ -149,13 +201,12 @@ func ContentGet(c *gin.Context) {
 		"contentId": contentProperties.ContentId,
 		"path":      contentProperties.ContentPath,
 	}).Debug("contentd response")
+	// the operator the link was issued for, the random content has none
+	if contentProperties.OperatorCode == 0 {
+		contentProperties.OperatorCode, contentProperties.CountryCode = resolveOperator()
+	}
 
-	err = utils.ServeAttachment(
-		cnf.Server.Path+"uploaded_content/"+contentProperties.ContentPath,
-		contentProperties.ContentName,
-		c,
-		logCtx,
-	)
+	delivery, err = serveContent(c, contentProperties.ContentPath, contentProperties.ContentName, logCtx)
 	if err != nil {
 		m.ContentDeliveryErrors.Inc()
 		err = fmt.Errorf("serveContentFile: %s", err.Error())
@@ -165,6 +216,7 @@ func ContentGet(c *gin.Context) {
 	logCtx.WithFields(log.Fields{}).Debug("served file ok")
 	m.ContentGetSuccess.Inc()
 	m.Success.Inc()
+	funnel(c, m.FunnelContent, msg.CampaignId, msg.OperatorCode)
 }
 
 // unique link generated before (in mt, in dispatcher...)
@@ -172,10 +224,132 @@ func ContentGet(c *gin.Context) {
 // if unique link was == "get" then we get
 // unique content and send it, without unique link
 func UniqueUrlGet(c *gin.Context) {
+	if !guardRequest(c) {
+		return
+	}
+	uniqueUrl := c.Params.ByName("uniqueurl")
+	if uniqueUrl == "get" && links.DisableRandomGet() {
+		m.PageNotFoundError.Inc()
+		anomaly.Count("", anomaly.NotFound)
+		http.Redirect(c.Writer, c.Request, cnf.Service.NotFoundRedirectUrl, 303)
+		return
+	}
+	// the unique url is readable in the signed link payload:
+	// opened directly it would skip the expiry and the signature
+	if uniqueUrl != "get" && !links.AcceptUnsigned(time.Now()) {
+		m.SignedLinkInvalid.Inc()
+		guard.Invalid(c.ClientIP())
+		err := fmt.Errorf("unsigned link: signed links enabled")
+		c.Error(err)
+		log.WithFields(log.Fields{
+			"url":   uniqueUrl,
+			"error": err.Error(),
+		}).Info("unique url rejected")
+		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
+		return
+	}
+	if uniqueUrl != "get" && links.Enabled() {
+		m.SignedLinkUnsigned.Inc()
+	}
+	contentByUniqueUrl(c, uniqueUrl, nil)
+}
 
+// signed link: checked here, contentd is asked only for the valid links
+func SignedUrlGet(c *gin.Context) {
+	if !guardRequest(c) {
+		return
+	}
+	sessions.SetSession(c)
+	tid := sessions.GetTid(c)
+	logCtx := log.WithFields(log.Fields{
+		"tid": tid,
+	})
+
+	link, err := links.Verify(c.Params.ByName("token"), time.Now())
+	if err == links.ErrExpired {
+		m.SignedLinkExpired.Inc()
+		operatorCode, _ := resolveOperator()
+		setRequestInfo(c, tid, link.CampaignId, operatorCode)
+		logCtx.WithFields(log.Fields{
+			"campaign_id": link.CampaignId,
+			"content_id":  link.ContentId,
+			"expired":     link.Expires,
+		}).Info("signed link expired")
+		serveExpiredLink(c, logCtx)
+		return
+	}
+	if err == nil && !links.MsisdnMatches(link, sessions.GetFromSession("msisdn", c)) {
+		err = fmt.Errorf("link issued for another msisdn")
+	}
+	if err != nil {
+		m.SignedLinkInvalid.Inc()
+		guard.Invalid(c.ClientIP())
+		c.Error(err)
+		logCtx.WithField("error", err.Error()).Error("signed link")
+		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
+		return
+	}
+	operatorCode, _ := resolveOperator()
+	setRequestInfo(c, tid, link.CampaignId, operatorCode)
+	contentByUniqueUrl(c, link.UniqueUrl, &link)
+}
+
+// guardRequest is false when the ip is banned or too fast, the response is sent
+func guardRequest(c *gin.Context) bool {
+	err := guard.Allow(c.ClientIP())
+	if err == nil {
+		return true
+	}
+	sessions.SetSession(c)
+	action := rbmq.UserActionsNotify{
+		Action: "download_rate_limited",
+		Tid:    sessions.GetTid(c),
+		Msisdn: sessions.GetFromSession("msisdn", c),
+		Error:  err.Error(),
+	}
+	status := http.StatusTooManyRequests
+	if err == guard.ErrBanned {
+		m.DownloadBanned.Inc()
+		action.Action = "download_banned"
+		status = http.StatusForbidden
+	} else {
+		m.DownloadRateLimited.Inc()
+		c.Header("Retry-After", "60")
+	}
+	log.WithFields(log.Fields{
+		"tid":   action.Tid,
+		"ip":    c.ClientIP(),
+		"error": err.Error(),
+	}).Info("link request rejected")
+	if err := notifierService.ActionNotify(c.Request.Context(), action); err != nil {
+		log.WithField("error", err.Error()).Error("notify user action")
+	}
+	c.AbortWithStatus(status)
+	return false
+}
+
+const expiredLinkPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>Link expired</title></head>
+<body><p>This download link has expired.</p></body></html>
+`
+
+func serveExpiredLink(c *gin.Context, logCtx *log.Entry) {
+	page := []byte(expiredLinkPage)
+	if name := links.ExpiredPage(); name != "" {
+		custom, err := ioutil.ReadFile(cnf.Server.Path + name)
+		if err != nil {
+			logCtx.WithField("error", err.Error()).Error("cannot read expired link page")
+		} else {
+			page = custom
+		}
+	}
+	c.Data(http.StatusGone, "text/html; charset=utf-8", page)
+}
+
+// link is set for the signed links: the content must be the signed one
+func contentByUniqueUrl(c *gin.Context, uniqueUrl string, link *links.Link) {
 	sessions.SetSession(c)
 	tid := sessions.GetTid(c)
-	uniqueUrl := c.Params.ByName("uniqueurl")
 
 	logCtx := log.WithFields(log.Fields{
 		"tid": tid,
@@ -184,13 +358,22 @@ func UniqueUrlGet(c *gin.Context) {
 	logCtx.Debug("receive content by unique link")
 
 	contentProperties := &structs.ContentSentProperties{}
+	var delivery utils.Delivery
 	action := rbmq.UserActionsNotify{
 		Action: "content_get",
 		Tid:    tid,
 	}
 
 	var err error
+	// the content page and its preview: the file is not sent,
+	// the tid is kept for the download
+	var view, preview bool
+	// the file is not sent: the user action only
+	var quotaExceeded bool
 	defer func() {
+		if preview {
+			return
+		}
 		if err != nil {
 			m.ContentDeliveryErrors.Inc()
 			m.Errors.Inc()
@@ -200,10 +383,15 @@ func UniqueUrlGet(c *gin.Context) {
 		action.Tid = tid
 		action.CampaignId = contentProperties.CampaignId
 
-		if err := notifierService.ActionNotify(action); err != nil {
+		if err := notifierService.ActionNotify(c.Request.Context(), action); err != nil {
 			logCtx.WithField("error", err.Error()).Error("notify user action")
 		}
-		if err = notifierService.ContentSentNotify(*contentProperties); err != nil {
+		if view || quotaExceeded {
+			return
+		}
+		sent := contentSent(*contentProperties, delivery)
+		recordHistory(sent)
+		if err = notifierService.ContentSentNotify(c.Request.Context(), sent); err != nil {
 			logCtx.WithFields(log.Fields{
 				"error": err.Error(),
 			}).Error("notify content sent error")
@@ -211,17 +399,25 @@ func UniqueUrlGet(c *gin.Context) {
 		sessions.RemoveTid(c)
 	}()
 
+	begin := time.Now()
 	if uniqueUrl == "get" {
 		m.RandomContentGet.Inc()
-		contentProperties, err = content_client.Get(content_service.GetContentParams{
+		params := content_service.GetContentParams{
 			Msisdn:      sessions.GetFromSession("msisdn", c),
 			Tid:         tid,
 			ServiceCode: cnf.Service.ContentServiceCodeDefault,
 			CampaignId:  cnf.Service.ContentCampaignIdDefault,
-		})
+		}
+		if err = allow(c, upstreamContentd, "Get"); err == nil {
+			contentProperties, err = content_client.Get(params)
+		}
+		observe(c, upstreamContentd, "Get", begin, err, params, contentProperties)
 	} else {
 		m.UniqueUrlGet.Inc()
-		contentProperties, err = content_client.GetByUniqueUrl(uniqueUrl)
+		if err = allow(c, upstreamContentd, "GetByUniqueUrl"); err == nil {
+			contentProperties, err = content_client.GetByUniqueUrl(uniqueUrl)
+		}
+		observe(c, upstreamContentd, "GetByUniqueUrl", begin, err, uniqueUrl, contentProperties)
 	}
 	if err != nil {
 		m.ContentDeliveryErrors.Inc()
@@ -229,8 +425,12 @@ func UniqueUrlGet(c *gin.Context) {
 		err = fmt.Errorf("content.GetByUniqueUrl: %s", err.Error())
 		logCtx.WithField("error", err.Error()).Error("cannot get path by url")
 		c.Error(err)
+		contentProperties = &structs.ContentSentProperties{Tid: tid, CampaignId: cnf.Service.ContentCampaignIdDefault}
+		var ok bool
+		if delivery, ok = serveFallbackContent(c, cnf.Service.ContentCampaignIdDefault, logCtx); ok {
+			return
+		}
 		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
-		logCtx.Fatal("contentd fatal: trying to free all resources")
 		return
 	}
 	if contentProperties.Error != "" || contentProperties.ContentId == "" {
@@ -242,6 +442,15 @@ func UniqueUrlGet(c *gin.Context) {
 		err = fmt.Errorf("content.GetByUniqueUrl: %s", contentProperties.Error)
 		logCtx.WithField("error", contentProperties.Error).Error("error while attemplting to get content")
 		err = errors.New(contentProperties.Error)
+		if uniqueUrl != "get" {
+			guard.Invalid(c.ClientIP())
+		}
+		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
+		return
+	}
+	if link != nil && contentProperties.ContentId != link.ContentId {
+		err = fmt.Errorf("signed content %s, unique url content %s", link.ContentId, contentProperties.ContentId)
+		logCtx.WithField("error", err.Error()).Error("signed link")
 		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
 		return
 	}
@@ -250,18 +459,56 @@ func UniqueUrlGet(c *gin.Context) {
 		"contentId": contentProperties.ContentId,
 		"path":      contentProperties.ContentPath,
 	}).Debug("contentd response")
+	// the operator the link was issued for, the random content has none
+	if contentProperties.OperatorCode == 0 {
+		contentProperties.OperatorCode, contentProperties.CountryCode = resolveOperator()
+	}
 
 	action.CampaignId = contentProperties.CampaignId
 	action.Msisdn = contentProperties.Msisdn
 	action.Tid = contentProperties.Tid
 	action.Error = contentProperties.Error
 
-	err = utils.ServeAttachment(
-		cnf.Server.Path+"uploaded_content/"+contentProperties.ContentPath,
-		contentProperties.ContentName,
-		c,
-		logCtx,
-	)
+	// random content differs on every request: no page for it
+	if uniqueUrl != "get" {
+		if _, ok := c.GetQuery("preview"); ok {
+			preview = true
+			if errPreview := servePreview(c, contentProperties.ContentPath, logCtx); errPreview != nil {
+				logCtx.WithField("error", errPreview.Error()).Debug("no preview")
+			}
+			return
+		}
+		if page := contentPage(contentProperties.CampaignId); page != nil && c.Query("download") == "" {
+			view = true
+			action.Action = "content_view"
+			data := newContentPageData(c.Request.URL.Path, contentProperties.ContentName, contentProperties.CampaignId)
+			if err = renderContentPage(c, page, data); err != nil {
+				logCtx.WithField("error", err.Error()).Error("content page")
+			}
+			return
+		}
+	}
+
+	if uniqueUrl != "get" {
+		count, errQuota := guard.Download(uniqueUrl, c.ClientIP())
+		if errQuota != nil {
+			m.DownloadQuotaExceeded.Inc()
+			logCtx.WithFields(log.Fields{
+				"downloads": count,
+				"contentId": contentProperties.ContentId,
+			}).Info("download quota exceeded")
+			action.Action = "download_quota_exceeded"
+			action.Error = errQuota.Error()
+			quotaExceeded = true
+			http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
+			return
+		}
+	}
+
+	delivery, err = serveContent(c, contentProperties.ContentPath, contentProperties.ContentName, logCtx)
+	if uniqueUrl != "get" {
+		guard.Downloaded(uniqueUrl, c.ClientIP(), delivery.Bytes, delivery.Size)
+	}
 	if err != nil {
 		m.ContentDeliveryErrors.Inc()
 		err := fmt.Errorf("serveContentFile: %s", err.Error())
@@ -273,15 +520,101 @@ func UniqueUrlGet(c *gin.Context) {
 	logCtx.WithFields(log.Fields{}).Debug("served file ok")
 
 	m.ContentGetSuccess.Inc()
+	funnel(c, m.FunnelContent, contentProperties.CampaignId, contentProperties.OperatorCode)
+}
+
+// serveContent sends the content from the store or redirects to it
+func serveContent(c *gin.Context, path, name string, logCtx *log.Entry) (utils.Delivery, error) {
+	variant := variants.Select(c.Request, path)
+	if variants.Enabled() {
+		c.Header("Vary", "User-Agent, "+variants.AcceptCH)
+	}
+	// resized images are in the local cache
+	if variant.Local {
+		content, err := store.OpenFile(variant.Path)
+		if err != nil {
+			return utils.Delivery{}, fmt.Errorf("store.OpenFile: %s", err.Error())
+		}
+		defer content.Close()
+		d, err := utils.ServeAttachment(content, name, c, logCtx)
+		d.Variant = variant.Name
+		return d, err
+	}
+	path = variant.Path
+	if store.Redirect() {
+		url, err := store.PresignedURL(path, utils.ContentDisposition(name+filepath.Ext(path)))
+		if err != nil {
+			return utils.Delivery{}, fmt.Errorf("store.PresignedURL: %s", err.Error())
+		}
+		logCtx.WithField("path", path).Debug("redirect to store")
+		http.Redirect(c.Writer, c.Request, url, 302)
+		return utils.Delivery{Status: 302, Variant: variant.Name}, nil
+	}
+	content, err := store.Open(c.Request.Context(), path)
+	if err != nil {
+		return utils.Delivery{}, fmt.Errorf("store.Open: %s", err.Error())
+	}
+	defer content.Close()
+	d, err := utils.ServeAttachment(content, name, c, logCtx)
+	d.Variant = variant.Name
+	return d, err
+}
+
+func contentSent(props structs.ContentSentProperties, d utils.Delivery) rbmq.ContentSent {
+	return rbmq.ContentSent{
+		ContentSentProperties: props,
+		HttpStatus:            d.Status,
+		Partial:               d.Partial(),
+		BytesSent:             d.Bytes,
+		FileSize:              d.Size,
+		Range:                 d.Range,
+		Variant:               d.Variant,
+	}
 }
 
 // create unique url
-func createUniqueUrl(r rec.Record) (contentUrl string, err error) {
+func createUniqueUrl(c *gin.Context, r rec.Record) (contentUrl string, err error) {
+	_, contentUrl, err = newUniqueUrl(c, r)
+	return
+}
+
+// contentLink is the unique url for the msisdn and the sms text of the service with it
+// the unique url creation is inside contentd service
+func contentLink(c *gin.Context, r rec.Record) (contentProperties *structs.ContentSentProperties, contentUrl, smsText string, err error) {
+	service, err := getServiceByCode(c, r.ServiceCode)
+	if err != nil {
+		m.UnknownService.Inc()
+		err = fmt.Errorf("mid_client.GetServiceByCode: %s", err.Error())
+		log.WithFields(log.Fields{
+			"tid":       r.Tid,
+			"serviceId": r.ServiceCode,
+			"error":     err.Error(),
+		}).Error("cannot get service by code")
+		return
+	}
+	if contentProperties, contentUrl, err = newUniqueUrl(c, r); err != nil {
+		return
+	}
+	if strings.Contains(service.SMSOnContent, "%s") {
+		smsText = fmt.Sprintf(service.SMSOnContent, contentUrl)
+	} else {
+		smsText = strings.TrimSpace(service.SMSOnContent + " " + contentUrl)
+	}
+	return
+}
+
+// newUniqueUrl returns the content of the unique url too
+func newUniqueUrl(c *gin.Context, r rec.Record) (contentProperties *structs.ContentSentProperties, contentUrl string, err error) {
 	logCtx := log.WithFields(log.Fields{
 		"tid": r.Tid,
 	})
 
-	contentProperties, err := content_client.GetUniqueUrl(content_service.GetContentParams{
+	if err = allow(c, upstreamContentd, "GetUniqueUrl"); err != nil {
+		err = fmt.Errorf("content_client.GetUniqueUrl: %s", err.Error())
+		logCtx.WithField("error", err.Error()).Error("cannot get unique content url")
+		return
+	}
+	params := content_service.GetContentParams{
 		Msisdn:         r.Msisdn,
 		Tid:            r.Tid,
 		ServiceCode:    r.ServiceCode,
@@ -289,25 +622,51 @@ func createUniqueUrl(r rec.Record) (contentUrl string, err error) {
 		OperatorCode:   r.OperatorCode,
 		CountryCode:    r.CountryCode,
 		SubscriptionId: r.SubscriptionId,
-	})
+	}
+	begin := time.Now()
+	contentProperties, err = content_client.GetUniqueUrl(params)
+	observe(c, upstreamContentd, "GetUniqueUrl", begin, err, params, contentProperties)
 
-	if contentProperties.Error != "" {
-		err = fmt.Errorf("contentProperties.Error: %s", contentProperties.Error)
+	if err != nil {
+		err = fmt.Errorf("content_client.GetUniqueUrl: %s", err.Error())
 		logCtx.WithFields(log.Fields{
 			"serviceId": r.ServiceCode,
 			"error":     err.Error(),
-		}).Error("contentd internal error")
+		}).Error("cannot get unique content url")
 		return
 	}
-	if err != nil {
-		err = fmt.Errorf("content_client.GetUniqueUrl: %s", err.Error())
+	if contentProperties.Error != "" {
+		err = fmt.Errorf("contentProperties.Error: %s", contentProperties.Error)
 		logCtx.WithFields(log.Fields{
 			"serviceId": r.ServiceCode,
 			"error":     err.Error(),
-		}).Error("cannot get unique content url")
+		}).Error("contentd internal error")
 		return
 	}
 
-	contentUrl = cnf.Server.Url + contentProperties.UniqueUrl
+	if contentUrl, err = contentUrlOf(contentProperties, r); err != nil {
+		logCtx.WithField("error", err.Error()).Error("cannot sign content url")
+	}
 	return
 }
+
+// contentUrlOf is the link sent to the user: the unique url,
+// the signed link when the signed links are on
+func contentUrlOf(contentProperties *structs.ContentSentProperties, r rec.Record) (string, error) {
+	uniqueUrl := path.Base(contentProperties.UniqueUrl)
+	if !links.Enabled() {
+		return cnf.Server.Url + "/u/" + uniqueUrl, nil
+	}
+	token, err := links.Sign(links.Link{
+		ContentId:  contentProperties.ContentId,
+		CampaignId: r.CampaignId,
+		Msisdn:     r.Msisdn,
+		Expires:    time.Now().Add(links.TTL()),
+		UniqueUrl:  uniqueUrl,
+	})
+	if err != nil {
+		// the unsigned unique url is rejected while the signed links are on
+		return "", fmt.Errorf("links.Sign: %s", err.Error())
+	}
+	return cnf.Server.Url + "/d/" + token, nil
+}
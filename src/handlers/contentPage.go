@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-dispatcherd/src/store"
+	"github.com/linkit360/go-dispatcherd/src/timing"
+	"github.com/linkit360/go-dispatcherd/src/variants"
+)
+
+// content page: title, preview, service name and unsubscribe text,
+// the file is sent only on the download button click (?download=1)
+// the preview is the thumbnail near the content file (?preview=1)
+
+type contentPageData struct {
+	Title       string
+	CampaignId  string
+	ServiceName string
+	Unsubscribe string
+	PreviewUrl  string
+	DownloadUrl string
+}
+
+// campaign id: parsed page, updated with the campaigns
+var contentPages = make(map[string]*template.Template)
+
+func loadContentPages(campaignIds []string) {
+	if !cnf.Service.ContentPage.Enabled {
+		return
+	}
+	pages := make(map[string]*template.Template)
+	for _, id := range campaignIds {
+		file := cnf.Server.Path + "campaign/" + id + "/" + cnf.Service.ContentPage.Template
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		page, err := template.ParseFiles(file)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":  file,
+				"error": err.Error(),
+			}).Error("cannot parse content page")
+			continue
+		}
+		pages[id] = page
+	}
+	contentPages = pages
+	log.WithField("campaigns", len(pages)).Debug("content pages loaded")
+}
+
+// contentPage is nil when the content is sent at once
+func contentPage(campaignId string) *template.Template {
+	if !cnf.Service.ContentPage.Enabled {
+		return nil
+	}
+	return contentPages[campaignId]
+}
+
+func newContentPageData(url, name, campaignId string) contentPageData {
+	texts := cnf.Service.ContentPage.Campaigns[campaignId]
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	return contentPageData{
+		Title:       name,
+		CampaignId:  campaignId,
+		ServiceName: texts.ServiceName,
+		Unsubscribe: texts.Unsubscribe,
+		PreviewUrl:  url + sep + "preview=1",
+		DownloadUrl: url + sep + "download=1",
+	}
+}
+
+func renderContentPage(c *gin.Context, page *template.Template, data contentPageData) error {
+	defer requestTimings(c).Since(timing.Render, time.Now())
+	c.Header("Cache-Control", "private, no-cache, max-age=0")
+	if variants.Enabled() {
+		// the download request brings the screen size
+		c.Header("Accept-CH", variants.AcceptCH)
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := page.Execute(c.Writer, data); err != nil {
+		return fmt.Errorf("page.Execute: %s", err.Error())
+	}
+	return nil
+}
+
+func previewPath(contentPath string) string {
+	return strings.TrimSuffix(contentPath, filepath.Ext(contentPath)) + cnf.Service.ContentPage.PreviewSuffix
+}
+
+// servePreview sends the thumbnail inline, 404 when there is none
+func servePreview(c *gin.Context, contentPath string, logCtx *log.Entry) error {
+	p := previewPath(contentPath)
+	if store.Redirect() {
+		url, err := store.PresignedURL(p, "")
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			return fmt.Errorf("store.PresignedURL: %s", err.Error())
+		}
+		http.Redirect(c.Writer, c.Request, url, 302)
+		return nil
+	}
+	preview, err := store.Open(c.Request.Context(), p)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return fmt.Errorf("store.Open: %s", err.Error())
+	}
+	defer preview.Close()
+	logCtx.WithField("path", p).Debug("serve preview")
+	c.Header("Cache-Control", "private, max-age=3600")
+	http.ServeContent(c.Writer, c.Request, filepath.Base(p), preview.ModTime(), preview)
+	return nil
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	rpprof "runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-dispatcherd/src/capture"
+)
+
+// runtime diagnostics in the admin api: pprof, goroutines, gc and the config
+var started = time.Now()
+
+const maxCPUProfileSec = 300
+
+func addDebugHandlers(g *gin.RouterGroup) {
+	d := g.Group("/debug")
+	d.GET("/pprof/", gin.WrapF(pprof.Index))
+	d.GET("/pprof/:name", pprofProfile)
+	d.GET("/goroutines", goroutines)
+	d.GET("/gc", gcStats)
+	d.GET("/config", configDump)
+	d.POST("/cpu", startCPUProfile)
+	d.GET("/cpu", downloadCPUProfile)
+}
+
+// pprof.Index serves the profiles by the /debug/pprof/ prefix only
+func pprofProfile(c *gin.Context) {
+	switch name := c.Param("name"); name {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		if rpprof.Lookup(name) == nil {
+			c.JSON(404, gin.H{"error": "unknown profile: " + name})
+			return
+		}
+		pprof.Handler(name).ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// full stacks by default, ?debug=1 to group the same stacks
+func goroutines(c *gin.Context) {
+	level, err := strconv.Atoi(c.DefaultQuery("debug", "2"))
+	if err != nil {
+		level = 2
+	}
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("X-Goroutines", strconv.Itoa(runtime.NumGoroutine()))
+	rpprof.Lookup("goroutine").WriteTo(c.Writer, level)
+}
+
+func gcStats(c *gin.Context) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	var lastPauses []string
+	for i := 0; i < len(gc.Pause) && i < 10; i++ {
+		lastPauses = append(lastPauses, gc.Pause[i].String())
+	}
+	c.JSON(200, gin.H{
+		"go_version":     runtime.Version(),
+		"uptime":         time.Since(started).String(),
+		"num_cpu":        runtime.NumCPU(),
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"goroutines":     runtime.NumGoroutine(),
+		"heap_alloc":     mem.HeapAlloc,
+		"heap_sys":       mem.HeapSys,
+		"heap_objects":   mem.HeapObjects,
+		"heap_released":  mem.HeapReleased,
+		"total_alloc":    mem.TotalAlloc,
+		"mallocs":        mem.Mallocs,
+		"frees":          mem.Frees,
+		"sys":            mem.Sys,
+		"next_gc":        mem.NextGC,
+		"num_gc":         gc.NumGC,
+		"last_gc":        gc.LastGC,
+		"pause_total":    gc.PauseTotal.String(),
+		"last_pauses":    lastPauses,
+		"gc_cpu_percent": mem.GCCPUFraction * 100,
+	})
+}
+
+// the running config by the yaml names, secrets masked
+func configDump(c *gin.Context) {
+	c.JSON(200, capture.MaskConfig(cnf))
+}
+
+// on-demand cpu profile: POST starts the capture in background,
+// GET downloads the last one when it's done
+var cpuProfile struct {
+	sync.Mutex
+	running  bool
+	started  time.Time
+	duration time.Duration
+	data     []byte
+}
+
+func startCPUProfile(c *gin.Context) {
+	seconds, err := strconv.Atoi(c.DefaultQuery("seconds", "30"))
+	if err != nil || seconds <= 0 || seconds > maxCPUProfileSec {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("seconds must be 1..%d", maxCPUProfileSec)})
+		return
+	}
+
+	cpuProfile.Lock()
+	defer cpuProfile.Unlock()
+	if cpuProfile.running {
+		c.JSON(409, gin.H{"error": "cpu profile is running", "started": cpuProfile.started})
+		return
+	}
+	buf := &bytes.Buffer{}
+	if err := rpprof.StartCPUProfile(buf); err != nil {
+		err = fmt.Errorf("pprof.StartCPUProfile: %s", err.Error())
+		log.WithField("error", err.Error()).Error("cpu profile")
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	cpuProfile.running = true
+	cpuProfile.started = time.Now()
+	cpuProfile.duration = time.Duration(seconds) * time.Second
+	cpuProfile.data = nil
+
+	time.AfterFunc(cpuProfile.duration, func() {
+		rpprof.StopCPUProfile()
+		cpuProfile.Lock()
+		cpuProfile.running = false
+		cpuProfile.data = buf.Bytes()
+		cpuProfile.Unlock()
+		log.WithField("bytes", buf.Len()).Info("cpu profile done")
+	})
+	log.WithField("seconds", seconds).Info("cpu profile started")
+	c.JSON(202, gin.H{"started": cpuProfile.started, "seconds": seconds})
+}
+
+func downloadCPUProfile(c *gin.Context) {
+	cpuProfile.Lock()
+	defer cpuProfile.Unlock()
+	if cpuProfile.running {
+		c.JSON(202, gin.H{
+			"running": true,
+			"ready":   cpuProfile.started.Add(cpuProfile.duration),
+		})
+		return
+	}
+	if cpuProfile.data == nil {
+		c.JSON(404, gin.H{"error": "no cpu profile, POST to start"})
+		return
+	}
+	name := fmt.Sprintf("%s_cpu_%s.pprof", cnf.AppName, cpuProfile.started.Format("20060102_150405"))
+	c.Header("Content-Disposition", "attachment; filename="+name)
+	c.Data(200, "application/octet-stream", cpuProfile.data)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/rbmq"
+	"github.com/linkit360/go-dispatcherd/src/sessions"
+	"github.com/linkit360/go-dispatcherd/src/throttle"
+)
+
+// the download routes are throttled, all the other routes are landings
+var downloadRoutes = map[string]bool{}
+
+// downloadRoute marks the full path of the route as the download one
+func downloadRoute(path string) string {
+	downloadRoutes[path] = true
+	return path
+}
+
+func isDownloadRoute(c *gin.Context) bool {
+	return downloadRoutes[c.FullPath()]
+}
+
+// DownloadHandler takes the download slot of the ip for the request
+// and sends the response within the bandwidth limits
+func DownloadHandler(c *gin.Context) {
+	if !throttle.Enabled() {
+		c.Next()
+		return
+	}
+	slot, err := throttle.Acquire(c.Request.Context(), c.ClientIP())
+	if err != nil {
+		downloadRejected(c, err)
+		return
+	}
+	defer slot.Release()
+	w := &throttledWriter{
+		ResponseWriter: c.Writer,
+		c:              c,
+		slot:           slot,
+		bytes:          m.DownloadBytes.WithLabelValues(c.FullPath()),
+	}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+}
+
+func downloadRejected(c *gin.Context, err error) {
+	m.DownloadsRejected.Inc()
+	sessions.SetSession(c)
+	action := rbmq.UserActionsNotify{
+		Action: "download_busy",
+		Tid:    sessions.GetTid(c),
+		Msisdn: sessions.GetFromSession("msisdn", c),
+		Error:  err.Error(),
+	}
+	log.WithFields(log.Fields{
+		"tid":   action.Tid,
+		"ip":    c.ClientIP(),
+		"path":  c.Request.URL.Path,
+		"error": err.Error(),
+	}).Info("download rejected")
+	if err := notifierService.ActionNotify(c.Request.Context(), action); err != nil {
+		log.WithField("error", err.Error()).Error("notify user action")
+	}
+	c.Header("Retry-After", strconv.Itoa(throttle.RetryAfter()))
+	c.AbortWithStatus(http.StatusServiceUnavailable)
+}
+
+// the body is written in chunks, each one waits for the bandwidth
+const throttleChunk = 32 * 1024
+
+type throttledWriter struct {
+	gin.ResponseWriter
+	c     *gin.Context
+	slot  *throttle.Slot
+	bytes prometheus.Counter
+}
+
+func (w *throttledWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		if err := w.slot.Wait(w.c.Request.Context(), len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		w.bytes.Add(float64(n))
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
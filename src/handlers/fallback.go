@@ -0,0 +1,86 @@
+package handlers
+
+// degraded mode when an upstream is down or its circuit breaker is open:
+// the last known service data is used instead of mid,
+// content is served from the campaign fallback file instead of contentd
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/store"
+	"github.com/linkit360/go-dispatcherd/src/utils"
+	mid_client "github.com/linkit360/go-mid/rpcclient"
+	xmp_api_structs "github.com/linkit360/xmp-api/src/structs"
+)
+
+var serviceCache = struct {
+	sync.RWMutex
+	byCode map[string]xmp_api_structs.Service
+}{byCode: make(map[string]xmp_api_structs.Service)}
+
+// getServiceByCode falls back to the last service got from mid
+func getServiceByCode(c *gin.Context, code string) (service xmp_api_structs.Service, err error) {
+	begin := time.Now()
+	if err = allow(c, upstreamMid, "GetServiceByCode"); err == nil {
+		service, err = mid_client.GetServiceByCode(code)
+	}
+	observe(c, upstreamMid, "GetServiceByCode", begin, err, code, service)
+	if err == nil {
+		serviceCache.Lock()
+		serviceCache.byCode[code] = service
+		serviceCache.Unlock()
+		return
+	}
+
+	serviceCache.RLock()
+	cached, ok := serviceCache.byCode[code]
+	serviceCache.RUnlock()
+	if !ok {
+		return
+	}
+	m.ServiceCacheFallback.Inc()
+	log.WithFields(log.Fields{
+		"service_code": code,
+		"error":        err.Error(),
+	}).Warn("use cached service")
+	return cached, nil
+}
+
+// serveFallbackContent sends the campaign fallback file,
+// false if there is no fallback for the campaign or it cannot be sent
+func serveFallbackContent(c *gin.Context, campaignId string, logCtx *log.Entry) (utils.Delivery, bool) {
+	path, ok := cnf.Service.FallbackContent[campaignId]
+	if !ok {
+		return utils.Delivery{}, false
+	}
+	name := filepath.Base(path)
+	name = name[:len(name)-len(filepath.Ext(name))]
+	var content store.Content
+	var err error
+	if filepath.IsAbs(path) {
+		content, err = store.OpenFile(path)
+	} else {
+		content, err = store.Open(c.Request.Context(), path)
+	}
+	var delivery utils.Delivery
+	if err == nil {
+		delivery, err = utils.ServeAttachment(content, name, c, logCtx)
+		content.Close()
+	}
+	if err != nil {
+		logCtx.WithFields(log.Fields{
+			"campaign_id": campaignId,
+			"error":       err.Error(),
+		}).Error("cannot serve fallback content")
+		return delivery, false
+	}
+	m.ContentFallback.Inc()
+	logCtx.WithField("campaign_id", campaignId).Warn("served fallback content")
+	return delivery, true
+}
@@ -5,16 +5,19 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/linkit360/go-dispatcherd/src/sessions"
+	"github.com/linkit360/go-dispatcherd/src/timing"
 	"github.com/linkit360/go-utils/structs"
 )
 
 // gather information from headers, etc
 func gatherInfo(c *gin.Context) (msg structs.AccessCampaignNotify) {
+	defer requestTimings(c).Since(timing.Gather, time.Now())
 	sessions.SetSession(c)
 	tid := sessions.GetTid(c)
 	logCtx := log.WithFields(log.Fields{
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-dispatcherd/src/history"
+	"github.com/linkit360/go-dispatcherd/src/links"
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/rbmq"
+	"github.com/linkit360/go-dispatcherd/src/sessions"
+	"github.com/linkit360/go-utils/rec"
+	"github.com/linkit360/go-utils/structs"
+)
+
+func TestMain(t *testing.M) {
+	m.Init("dispatcherd_test")
+	gin.SetMode(gin.TestMode)
+	os.Exit(t.Run())
+}
+
+// testNotifier publishes by the routing table like the rbmq one, the other events panic
+type testNotifier struct {
+	rbmq.Notifier
+	router *rbmq.Router
+	sent   []rec.Record
+}
+
+func (n *testNotifier) Notify(ctx context.Context, eventName string, r rec.Record) error {
+	if len(n.router.Match(eventName, r.OperatorCode, r.CampaignId)) == 0 {
+		return fmt.Errorf("no route: event %s", eventName)
+	}
+	n.sent = append(n.sent, r)
+	return nil
+}
+
+func testEngine() *gin.Engine {
+	engine := gin.New()
+	sessions.Init(sessions.SessionsConfig{Secret: "test", Path: "/", Key: "test"}, engine)
+	e = engine
+	return engine
+}
+
+func post(engine *gin.Engine, path string, form url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func TestHistoryPin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handlers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, history.Init(history.HistoryConfig{
+		Enabled:        true,
+		Path:           filepath.Join(dir, "history"),
+		PinLength:      4,
+		PinTTLMin:      10,
+		PinAttempts:    3,
+		PinIntervalSec: 60,
+		LinkTTLMin:     60,
+		PinSMS:         "Your PIN: %s",
+	}))
+	cnf.Service.OperatorCode = 41001
+	engine := testEngine()
+	AddHistoryHandlers()
+
+	notifier := &testNotifier{router: rbmq.NewRouter([]rbmq.Route{
+		{Event: rbmq.EventSendSMS, Queues: []string{"send_sms"}},
+	})}
+	notifierService = notifier
+	w := post(engine, "/my/pin?service=s1", url.Values{"msisdn": {"+7 900 123-45-67"}})
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "PIN from SMS")
+	if assert.Len(t, notifier.sent, 1) {
+		assert.Equal(t, "79001234567", notifier.sent[0].Msisdn)
+		assert.Equal(t, "s1", notifier.sent[0].ServiceCode)
+		assert.Regexp(t, `^Your PIN: \d{4}$`, notifier.sent[0].SMSText)
+	}
+
+	notifierService = &testNotifier{router: rbmq.NewRouter(nil)}
+	w = post(engine, "/my/pin", url.Values{"msisdn": {"79007654321"}})
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "Cannot send PIN", "no send_sms route")
+
+	w = post(engine, "/my/pin", url.Values{"msisdn": {"123"}})
+	assert.Contains(t, w.Body.String(), "Wrong phone number")
+}
+
+func TestContentUrl(t *testing.T) {
+	cnf.Server.Url = "http://dl.example.com"
+	props := &structs.ContentSentProperties{ContentId: "42", UniqueUrl: "a1b2c3"}
+	r := rec.Record{CampaignId: "7", Msisdn: "79001234567"}
+
+	assert.NoError(t, links.Init(links.LinksConfig{}))
+	contentUrl, err := contentUrlOf(props, r)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://dl.example.com/u/a1b2c3", contentUrl, "unique url")
+
+	assert.NoError(t, links.Init(links.LinksConfig{
+		Enabled:  true,
+		Keys:     []links.Key{{Id: "k1", Secret: "0123456789abcdef"}},
+		TTLHours: 72,
+	}))
+	defer links.Init(links.LinksConfig{})
+	contentUrl, err = contentUrlOf(props, r)
+	assert.NoError(t, err)
+	if assert.True(t, strings.HasPrefix(contentUrl, "http://dl.example.com/d/"), "signed link") {
+		link, err := links.Verify(strings.TrimPrefix(contentUrl, "http://dl.example.com/d/"), time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, "a1b2c3", link.UniqueUrl)
+		assert.Equal(t, "42", link.ContentId)
+	}
+}
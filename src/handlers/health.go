@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/linkit360/go-dispatcherd/src/breaker"
+)
+
+// readiness for the load balancer: not ready while a critical circuit breaker is open,
+// the states of all the breakers are in the body
+func AddHealthHandlers() {
+	e.GET("/ready", ready)
+}
+
+func ready(c *gin.Context) {
+	status := 200
+	if !breaker.Ready() {
+		status = 503
+	}
+	c.JSON(status, gin.H{
+		"ready":    status == 200,
+		"breakers": breaker.States(),
+	})
+}
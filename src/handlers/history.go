@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-dispatcherd/src/guard"
+	"github.com/linkit360/go-dispatcherd/src/history"
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/rbmq"
+	"github.com/linkit360/go-dispatcherd/src/sessions"
+	"github.com/linkit360/go-dispatcherd/src/timing"
+	"github.com/linkit360/go-utils/rec"
+	"github.com/linkit360/go-utils/structs"
+)
+
+// "my content": /my?service=<service code>
+
+const historySessionKey = "history_msisdn"
+
+var historyPage = template.Must(template.New("history").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>My content</title></head>
+<body>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+{{if .Login}}
+<form method="post" action="/my/{{if .PinSent}}login{{else}}pin{{end}}?service={{.ServiceCode}}">
+<p><input type="tel" name="msisdn" value="{{.Msisdn}}" placeholder="Phone number"></p>
+{{if .PinSent}}<p><input type="tel" name="pin" placeholder="PIN from SMS" autocomplete="one-time-code"></p>{{end}}
+<p><button type="submit">{{if .PinSent}}Log in{{else}}Send PIN{{end}}</button></p>
+</form>
+{{else}}
+<h4>My content</h4>
+{{range .Items}}<p><a href="{{.DownloadUrl}}">{{.Title}}</a> <small>{{.SentAt}}</small></p>
+{{else}}<p>No content yet</p>{{end}}
+{{end}}
+</body></html>
+`))
+
+type historyPageData struct {
+	Login       bool
+	PinSent     bool
+	Msisdn      string
+	ServiceCode string
+	Error       string
+	Items       []historyItem
+}
+
+type historyItem struct {
+	Title       string
+	SentAt      string
+	DownloadUrl string
+}
+
+func AddHistoryHandlers() {
+	if !history.Enabled() {
+		return
+	}
+	if name := history.Template(); name != "" {
+		page, err := template.ParseFiles(cnf.Server.Path + name)
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("cannot parse content history page")
+		}
+		historyPage = page
+	}
+	e.GET("/my", AccessHandler, HistoryGet)
+	e.POST("/my/pin", AccessHandler, HistoryPin)
+	e.POST("/my/login", AccessHandler, HistoryLogin)
+	e.GET(downloadRoute("/my/d/:token"), AccessHandler, DownloadHandler, HistoryDownload)
+}
+
+// subscriberMsisdn is the msisdn logged in by the pin or the session one when it is trusted
+func subscriberMsisdn(c *gin.Context) string {
+	if msisdn := sessions.GetFromSession(historySessionKey, c); msisdn != "" {
+		return msisdn
+	}
+	if history.SessionMsisdn() {
+		return sessions.GetFromSession("msisdn", c)
+	}
+	return ""
+}
+
+func HistoryGet(c *gin.Context) {
+	sessions.SetSession(c)
+	data := historyPageData{ServiceCode: c.Query("service")}
+	msisdn := subscriberMsisdn(c)
+	if msisdn == "" {
+		data.Login = true
+		renderHistoryPage(c, data)
+		return
+	}
+	for _, entry := range history.List(msisdn, data.ServiceCode, time.Now()) {
+		data.Items = append(data.Items, historyItem{
+			Title:       entry.ContentName,
+			SentAt:      entry.SentAt.Format("2006-01-02"),
+			DownloadUrl: "/my/d/" + history.NewLink(msisdn, entry.ContentId),
+		})
+	}
+	m.HistoryViews.Inc()
+	action := rbmq.UserActionsNotify{
+		Action: "content_history",
+		Tid:    sessions.GetTid(c),
+		Msisdn: msisdn,
+	}
+	if err := notifierService.ActionNotify(c.Request.Context(), action); err != nil {
+		log.WithField("error", err.Error()).Error("notify user action")
+	}
+	renderHistoryPage(c, data)
+}
+
+// HistoryPin sends the login pin by sms
+func HistoryPin(c *gin.Context) {
+	if !guardRequest(c) {
+		return
+	}
+	sessions.SetSession(c)
+	data := historyPageData{
+		Login:       true,
+		ServiceCode: c.Query("service"),
+		Msisdn:      normalizeMsisdn(c.PostForm("msisdn")),
+	}
+	if data.Msisdn == "" {
+		data.Error = "Wrong phone number"
+		renderHistoryPage(c, data)
+		return
+	}
+	logCtx := log.WithFields(log.Fields{
+		"tid":    sessions.GetTid(c),
+		"msisdn": data.Msisdn,
+	})
+	pin, err := history.NewPin(data.Msisdn)
+	if err == history.ErrPinTooSoon {
+		// the pin sent before is still valid
+		data.PinSent = true
+		renderHistoryPage(c, data)
+		return
+	}
+	if err == nil {
+		err = notifierService.Notify(c.Request.Context(), rbmq.EventSendSMS, rec.Record{
+			Msisdn:       data.Msisdn,
+			Tid:          sessions.GetTid(c),
+			ServiceCode:  data.ServiceCode,
+			OperatorCode: cnf.Service.OperatorCode,
+			SMSText:      fmt.Sprintf(history.PinSMS(), pin),
+		})
+	}
+	if err != nil {
+		m.Errors.Inc()
+		logCtx.WithField("error", err.Error()).Error("cannot send history pin")
+		data.Error = "Cannot send PIN, try later"
+		renderHistoryPage(c, data)
+		return
+	}
+	m.HistoryPinSent.Inc()
+	logCtx.Info("history pin sent")
+	data.PinSent = true
+	renderHistoryPage(c, data)
+}
+
+func HistoryLogin(c *gin.Context) {
+	if !guardRequest(c) {
+		return
+	}
+	sessions.SetSession(c)
+	service := c.Query("service")
+	msisdn := normalizeMsisdn(c.PostForm("msisdn"))
+	err := history.CheckPin(msisdn, strings.TrimSpace(c.PostForm("pin")))
+	if err != nil {
+		m.HistoryPinWrong.Inc()
+		guard.Invalid(c.ClientIP())
+		log.WithFields(log.Fields{
+			"tid":    sessions.GetTid(c),
+			"msisdn": msisdn,
+			"error":  err.Error(),
+		}).Info("history login")
+		renderHistoryPage(c, historyPageData{
+			Login:       true,
+			PinSent:     err == history.ErrPinWrong,
+			Msisdn:      msisdn,
+			ServiceCode: service,
+			Error:       "Wrong PIN",
+		})
+		return
+	}
+	sessions.Set(historySessionKey, msisdn, c)
+	sessions.Save(c)
+	http.Redirect(c.Writer, c.Request, "/my?service="+url.QueryEscape(service), 303)
+}
+
+// HistoryDownload sends the content again by the fresh link
+func HistoryDownload(c *gin.Context) {
+	if !guardRequest(c) {
+		return
+	}
+	sessions.SetSession(c)
+	tid := sessions.GetTid(c)
+	logCtx := log.WithFields(log.Fields{
+		"tid": tid,
+	})
+	entry, msisdn, ok := history.Link(c.Params.ByName("token"))
+	if !ok {
+		m.PageNotFoundError.Inc()
+		guard.Invalid(c.ClientIP())
+		http.Redirect(c.Writer, c.Request, "/my", 303)
+		return
+	}
+	operatorCode := entry.OperatorCode
+	if operatorCode == 0 {
+		operatorCode, _ = resolveOperator()
+	}
+	props := structs.ContentSentProperties{
+		Msisdn:       msisdn,
+		Tid:          tid,
+		ContentPath:  entry.ContentPath,
+		ContentName:  entry.ContentName,
+		CampaignId:   entry.CampaignId,
+		ContentId:    entry.ContentId,
+		ServiceCode:  entry.ServiceCode,
+		OperatorCode: operatorCode,
+	}
+	action := rbmq.UserActionsNotify{
+		Action:     "content_redownload",
+		Tid:        tid,
+		Msisdn:     msisdn,
+		CampaignId: entry.CampaignId,
+	}
+	setRequestInfo(c, tid, entry.CampaignId, operatorCode)
+
+	// the link is fresh on every page view, the quota is of the item
+	quotaKey := "my|" + msisdn + "|" + entry.ContentId
+	if count, err := guard.Download(quotaKey, c.ClientIP()); err != nil {
+		m.DownloadQuotaExceeded.Inc()
+		logCtx.WithFields(log.Fields{
+			"downloads": count,
+			"contentId": entry.ContentId,
+		}).Info("download quota exceeded")
+		action.Action = "download_quota_exceeded"
+		action.Error = err.Error()
+		if err := notifierService.ActionNotify(c.Request.Context(), action); err != nil {
+			logCtx.WithField("error", err.Error()).Error("notify user action")
+		}
+		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
+		return
+	}
+
+	delivery, err := serveContent(c, entry.ContentPath, entry.ContentName, logCtx)
+	guard.Downloaded(quotaKey, c.ClientIP(), delivery.Bytes, delivery.Size)
+	if err != nil {
+		m.ContentDeliveryErrors.Inc()
+		err = fmt.Errorf("serveContent: %s", err.Error())
+		logCtx.WithField("error", err.Error()).Error("history download")
+		c.Error(err)
+		action.Error = err.Error()
+		props.Error = err.Error()
+		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 303)
+	} else {
+		m.HistoryDownloads.Inc()
+	}
+	if err := notifierService.ActionNotify(c.Request.Context(), action); err != nil {
+		logCtx.WithField("error", err.Error()).Error("notify user action")
+	}
+	if err := notifierService.ContentSentNotify(c.Request.Context(), contentSent(props, delivery)); err != nil {
+		logCtx.WithField("error", err.Error()).Error("notify content sent error")
+	}
+}
+
+// recordHistory adds the delivered content to the history of the msisdn
+func recordHistory(sent rbmq.ContentSent) {
+	if sent.Msisdn == "" || sent.ContentId == "" || sent.Error != "" ||
+		sent.HttpStatus == 0 || sent.HttpStatus >= 400 {
+		return
+	}
+	history.Add(sent.Msisdn, history.Entry{
+		ContentId:    sent.ContentId,
+		ContentName:  sent.ContentName,
+		ContentPath:  sent.ContentPath,
+		ServiceCode:  sent.ServiceCode,
+		CampaignId:   sent.CampaignId,
+		OperatorCode: sent.OperatorCode,
+		SentAt:       time.Now().UTC(),
+	})
+}
+
+func renderHistoryPage(c *gin.Context, data historyPageData) {
+	defer requestTimings(c).Since(timing.Render, time.Now())
+	c.Header("Cache-Control", "private, no-store")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := historyPage.Execute(c.Writer, data); err != nil {
+		log.WithField("error", err.Error()).Error("history page")
+	}
+}
+
+// normalizeMsisdn keeps the digits, empty when it is not a phone number
+func normalizeMsisdn(msisdn string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, msisdn)
+	if len(digits) < 8 || len(digits) > 15 {
+		return ""
+	}
+	return digits
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/rbmq"
+	mid "github.com/linkit360/go-mid/service"
+	"github.com/linkit360/go-utils/rec"
+)
+
+// content link api: the unique content url and the sms text with it
+// for the mt and sms teams, they send the sms themselves
+//
+//	POST /api/v1/content_url {"msisdn": "...", "service_code": "...", "campaign_id": "..."}
+
+type contentUrlParams struct {
+	Msisdn      string `json:"msisdn"`
+	ServiceCode string `json:"service_code"`
+	CampaignId  string `json:"campaign_id"`
+	// the tid of the client flow, new one when empty
+	Tid string `json:"tid"`
+}
+
+func AddLinkApiHandlers() {
+	if !cnf.LinkApi.Enabled {
+		return
+	}
+	api := e.Group("/api/v1", gin.BasicAuth(gin.Accounts(cnf.LinkApi.Accounts)))
+	api.POST("/content_url", issueContentUrl)
+}
+
+func issueContentUrl(c *gin.Context) {
+	var params contentUrlParams
+	if err := c.BindJSON(&params); err != nil {
+		return
+	}
+	msisdn := normalizeMsisdn(params.Msisdn)
+	if msisdn == "" || params.ServiceCode == "" || params.CampaignId == "" {
+		m.ContentLinkErrors.Inc()
+		c.JSON(400, gin.H{"error": "msisdn, service_code and campaign_id are required"})
+		return
+	}
+	campaign, ok := campaignById(params.CampaignId)
+	if !ok {
+		m.ContentLinkErrors.Inc()
+		c.JSON(400, gin.H{"error": "unknown campaign"})
+		return
+	}
+	if campaign.ServiceCode != params.ServiceCode {
+		m.ContentLinkErrors.Inc()
+		c.JSON(400, gin.H{"error": "campaign is not of the service"})
+		return
+	}
+	tid := params.Tid
+	if tid == "" {
+		tid = rec.GenerateTID(msisdn)
+	}
+	client := c.GetString(gin.AuthUserKey)
+	logCtx := log.WithFields(log.Fields{
+		"tid":         tid,
+		"client":      client,
+		"campaign_id": params.CampaignId,
+	})
+
+	operatorCode, countryCode := resolveOperator()
+	props, contentUrl, smsText, err := contentLink(c, rec.Record{
+		Msisdn:       msisdn,
+		Tid:          tid,
+		ServiceCode:  params.ServiceCode,
+		CampaignId:   params.CampaignId,
+		OperatorCode: operatorCode,
+		CountryCode:  countryCode,
+	})
+	if err != nil {
+		m.ContentLinkErrors.Inc()
+		c.JSON(502, gin.H{"error": err.Error()})
+		return
+	}
+	m.ContentLinksIssued.Inc()
+	logCtx.WithField("content_id", props.ContentId).Info("content link issued")
+
+	issued := rbmq.ContentLinkIssued{
+		ContentSentProperties: *props,
+		Url:                   contentUrl,
+		SMSText:               smsText,
+		Client:                client,
+	}
+	issued.Msisdn = msisdn
+	issued.Tid = tid
+	issued.CampaignId = params.CampaignId
+	issued.ServiceCode = params.ServiceCode
+	issued.OperatorCode = operatorCode
+	if err := notifierService.ContentLinkIssuedNotify(c.Request.Context(), issued); err != nil {
+		logCtx.WithField("error", err.Error()).Error("notify content link issued")
+	}
+	c.JSON(200, gin.H{
+		"tid":          tid,
+		"url":          contentUrl,
+		"sms_text":     smsText,
+		"content_id":   props.ContentId,
+		"content_name": props.ContentName,
+	})
+}
+
+func campaignById(id string) (mid.Campaign, bool) {
+	for _, campaign := range campaignByHash {
+		if campaign.Id == id {
+			return campaign, true
+		}
+	}
+	return mid.Campaign{}, false
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/linkit360/go-dispatcherd/src/rbmq"
+)
+
+// event payload schemas by route and content type of every queue with non-default encoding
+func AddSchemaHandlers() {
+	e.GET("/schema", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"events":        rbmq.Schemas(),
+			"content_types": contentTypes(),
+		})
+	})
+	e.GET("/schema/:event", func(c *gin.Context) {
+		schema, ok := rbmq.Schema(c.Params.ByName("event"))
+		if !ok {
+			c.JSON(404, gin.H{"error": "unknown event"})
+			return
+		}
+		c.JSON(200, schema)
+	})
+}
+
+func contentTypes() map[string]string {
+	res := map[string]string{"default": rbmq.ContentTypeJSON}
+	enc, _ := rbmq.NewEncodings(cnf.Notifier.Encodings)
+	for queue, codec := range enc {
+		res[queue] = codec.ContentType()
+	}
+	return res
+}
@@ -8,8 +8,11 @@ import (
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/linkit360/go-dispatcherd/src/anomaly"
 	m "github.com/linkit360/go-dispatcherd/src/metrics"
 	"github.com/linkit360/go-dispatcherd/src/rbmq"
+	"github.com/linkit360/go-dispatcherd/src/sessions"
+	"github.com/linkit360/go-dispatcherd/src/timing"
 	mid_client "github.com/linkit360/go-mid/rpcclient"
 	"github.com/linkit360/go-utils/rec"
 )
@@ -42,6 +45,7 @@ func ServeStatic(c *gin.Context) {
 	campaign, ok := campaignByLink[campaignLink]
 	if !ok {
 		m.PageNotFoundError.Inc()
+		anomaly.Count("", anomaly.NotFound)
 		err := fmt.Errorf("page not found: %s", campaignLink)
 
 		log.WithFields(log.Fields{
@@ -56,6 +60,7 @@ func ServeStatic(c *gin.Context) {
 	filePath = cnf.Server.Path + "campaign/" + campaign.Id + filePath
 	log.WithField("path", filePath).Debug("serve file")
 
+	defer requestTimings(c).Since(timing.Render, time.Now())
 	c.File(filePath)
 }
 
@@ -74,6 +79,8 @@ func serveCampaigns(c *gin.Context) {
 	defer func() {
 		action.Msisdn = msg.Msisdn
 		action.CampaignId = msg.CampaignId
+		action.OperatorCode = msg.OperatorCode
+		action.Publisher = sessions.GetFromSession("publisher", c)
 		action.Tid = msg.Tid
 		if err != nil {
 			action.Error = err.Error()
@@ -83,13 +90,13 @@ func serveCampaigns(c *gin.Context) {
 				"error": err.Error(),
 			}).Error("serve campaign")
 		}
-		if errAction := notifierService.ActionNotify(action); errAction != nil {
+		if errAction := notifierService.ActionNotify(c.Request.Context(), action); errAction != nil {
 			logCtx.WithFields(log.Fields{
 				"error":  errAction.Error(),
 				"action": fmt.Sprintf("%#v", action),
 			}).Error("notify user action")
 		}
-		if errAccessCampaign := notifierService.AccessCampaignNotify(msg); errAccessCampaign != nil {
+		if errAccessCampaign := notifierService.AccessCampaignNotify(c.Request.Context(), msg); errAccessCampaign != nil {
 			logCtx.WithFields(log.Fields{
 				"error": errAccessCampaign.Error(),
 				"msg":   fmt.Sprintf("%#v", msg),
@@ -104,6 +111,7 @@ func serveCampaigns(c *gin.Context) {
 	campaign, ok := campaignByLink[campaignLink]
 	if !ok {
 		m.PageNotFoundError.Inc()
+		anomaly.Count("", anomaly.NotFound)
 		err = fmt.Errorf("page not found: %s", campaignLink)
 
 		logCtx.WithFields(log.Fields{
@@ -113,6 +121,7 @@ func serveCampaigns(c *gin.Context) {
 		return
 	}
 	msg.CampaignId = campaign.Id
+	setRequestInfo(c, msg.Tid, msg.CampaignId, msg.OperatorCode)
 	msg.ServiceCode = campaign.ServiceCode
 	msg.CampaignHash = campaign.Hash
 	if msg.IP == "" {
@@ -127,7 +136,14 @@ func serveCampaigns(c *gin.Context) {
 
 	if cnf.Service.Rejected.TrafficRedirectEnabled {
 		// check if rejected: if rejected, then campaignCode differs from campaign.id
-		isRejected, err := mid_client.IsMsisdnRejectedByService(msg.ServiceCode, msg.Msisdn)
+		var isRejected bool
+		begin := time.Now()
+		err := allow(c, upstreamMid, "IsMsisdnRejectedByService")
+		if err == nil {
+			isRejected, err = mid_client.IsMsisdnRejectedByService(msg.ServiceCode, msg.Msisdn)
+		}
+		observe(c, upstreamMid, "IsMsisdnRejectedByService", begin, err,
+			gin.H{"service_code": msg.ServiceCode, "msisdn": msg.Msisdn}, isRejected)
 		if err != nil {
 			err = fmt.Errorf("mid_client.IsMsisdnRejectedByService: %s", err.Error())
 			logCtx.WithFields(log.Fields{
@@ -135,6 +151,7 @@ func serveCampaigns(c *gin.Context) {
 			}).Error("rejected check failed")
 		} else {
 			if isRejected {
+				funnel(c, m.FunnelRejected, msg.CampaignId, msg.OperatorCode)
 				trafficRedirect(msg, c)
 				return
 			}
@@ -152,7 +169,7 @@ func serveCampaigns(c *gin.Context) {
 	if cnf.Service.SendRestorePixelEnabled {
 		val, ok := c.GetQuery("aff_sub")
 		if ok && len(val) >= 5 {
-			if err := notifierService.PixelBufferNotify(rec.Record{
+			if err := notifierService.PixelBufferNotify(c.Request.Context(), rec.Record{
 				SentAt:      time.Now().UTC(),
 				CampaignId:  msg.CampaignId,
 				ServiceCode: msg.ServiceCode,
@@ -176,6 +193,7 @@ func serveCampaigns(c *gin.Context) {
 
 	m.CampaignAccess.Inc()
 	m.Success.Inc()
+	funnel(c, m.FunnelLanding, msg.CampaignId, msg.OperatorCode)
 
 	// finish. Here is autoclick goes
 	if !cnf.Service.OnClickNewSubscription {
@@ -203,13 +221,14 @@ func serveCampaigns(c *gin.Context) {
 		actionAutoClick.Msisdn = msg.Msisdn
 		actionAutoClick.CampaignId = msg.CampaignId
 
-		if err := notifierService.ActionNotify(actionAutoClick); err != nil {
+		if err := notifierService.ActionNotify(c.Request.Context(), actionAutoClick); err != nil {
 			logCtx.WithFields(log.Fields{
 				"error": err.Error(),
 			}).Error("notify user action")
 		}
 	}()
 
+	funnel(c, m.FunnelAutoclick, msg.CampaignId, msg.OperatorCode)
 	if err = startNewSubscription(c, msg); err == nil {
 		logCtx.WithFields(log.Fields{
 			"msisdn":      msg.Msisdn,
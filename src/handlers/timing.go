@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/linkit360/go-dispatcherd/src/timing"
+)
+
+// Server-Timing: the response is kept in the buffer until the handler is done,
+// then the header with all the steps is set and the body is written
+
+type timingWriter struct {
+	gin.ResponseWriter
+	timings   *timing.Timings
+	begin     time.Time
+	buf       bytes.Buffer
+	max       int
+	streaming bool
+}
+
+func startTiming(c *gin.Context, begin time.Time) *timingWriter {
+	if !cnf.Server.Timing.Enabled {
+		return nil
+	}
+	w := &timingWriter{
+		ResponseWriter: c.Writer,
+		timings:        timing.New(),
+		begin:          begin,
+		max:            cnf.Server.Timing.MaxBufferKB * 1024,
+	}
+	c.Writer = w
+	c.Request = c.Request.WithContext(timing.NewContext(c.Request.Context(), w.timings))
+	return w
+}
+
+// finishTiming writes the buffered response, must be called before
+// the response size is used
+func finishTiming(c *gin.Context, w *timingWriter) {
+	if w == nil {
+		return
+	}
+	w.flush()
+	c.Writer = w.ResponseWriter
+}
+
+// requestTimings is nil when Server-Timing is off
+func requestTimings(c *gin.Context) *timing.Timings {
+	return timing.FromContext(requestContext(c))
+}
+
+func upstreamTiming(upstream string) string {
+	switch upstream {
+	case upstreamMid:
+		return timing.Mid
+	case upstreamContentd:
+		return timing.Contentd
+	case upstreamPartners:
+		return timing.Partners
+	}
+	return timing.Operator
+}
+
+func (w *timingWriter) Write(data []byte) (int, error) {
+	if w.streaming {
+		return w.ResponseWriter.Write(data)
+	}
+	if w.buf.Len()+len(data) > w.max {
+		w.flush()
+		return w.ResponseWriter.Write(data)
+	}
+	return w.buf.Write(data)
+}
+
+func (w *timingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *timingWriter) WriteHeaderNow() {
+	if w.streaming {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *timingWriter) Written() bool {
+	return w.streaming || w.buf.Len() > 0 || w.ResponseWriter.Written()
+}
+
+func (w *timingWriter) Flush() {
+	w.flush()
+	w.ResponseWriter.Flush()
+}
+
+func (w *timingWriter) flush() {
+	if w.streaming {
+		return
+	}
+	w.streaming = true
+	if !w.ResponseWriter.Written() {
+		w.Header().Set("Server-Timing", w.timings.Header(time.Since(w.begin)))
+	}
+	w.ResponseWriter.WriteHeaderNow()
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
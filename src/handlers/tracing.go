@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/linkit360/go-dispatcherd/src/capture"
+	"github.com/linkit360/go-dispatcherd/src/tracing"
+)
+
+// the request span is started in AccessHandler and kept in the request context,
+// spans of the outbound calls are its children
+//
+// tid, campaign id and operator are known only after the campaign is found:
+// setRequestInfo adds them to the request span, to the spans started later
+// and keeps them for the access log
+
+const (
+	traceAttributesKey = "trace_attributes"
+	campaignIdKey      = "campaign_id"
+	operatorCodeKey    = "operator_code"
+)
+
+func startRequestSpan(c *gin.Context) trace.Span {
+	ctx := tracing.Propagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	route := c.FullPath()
+	if route == "" {
+		route = "not_found"
+	}
+	ctx, span := tracing.Tracer().Start(ctx, c.Request.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", c.Request.Method),
+			attribute.String("http.route", route),
+			attribute.String("http.target", c.Request.URL.Path),
+		),
+	)
+	c.Request = c.Request.WithContext(ctx)
+	return span
+}
+
+func endRequestSpan(c *gin.Context, span trace.Span) {
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, c.Errors.String())
+	}
+	span.End()
+}
+
+func setRequestInfo(c *gin.Context, tid, campaignId string, operatorCode int64) {
+	attrs := tracing.Attributes(tid, campaignId, operatorCode)
+	c.Set(traceAttributesKey, attrs)
+	c.Set(campaignIdKey, campaignId)
+	c.Set(operatorCodeKey, operatorCode)
+	capture.FromContext(c.Request.Context()).SetCampaign(campaignId)
+	trace.SpanFromContext(c.Request.Context()).SetAttributes(attrs...)
+}
+
+func traceAttributes(c *gin.Context) []attribute.KeyValue {
+	if c == nil {
+		return nil
+	}
+	if v, ok := c.Get(traceAttributesKey); ok {
+		return v.([]attribute.KeyValue)
+	}
+	return nil
+}
+
+// calls made outside of a request (campaigns update) have no parent span
+func requestContext(c *gin.Context) context.Context {
+	if c == nil || c.Request == nil {
+		return context.Background()
+	}
+	return c.Request.Context()
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/linkit360/go-dispatcherd/src/breaker"
+	"github.com/linkit360/go-dispatcherd/src/capture"
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/tracing"
+)
+
+// every call handlers make to mid, contentd, partners
+// and to the operator http apis is observed and traced:
+//
+//	begin := time.Now()
+//	service, err := mid_client.GetServiceByCode(code)
+//	observe(c, upstreamMid, "GetServiceByCode", begin, err, code, service)
+//
+// request and response are kept in the debug capture of the request
+// rpc clients take no context, so the trace context is not propagated to them
+//
+// mid, contentd and partners calls are made only when their circuit breaker allows:
+//
+//	if err = allow(c, upstreamMid, "GetMsisdnCampaignCache"); err == nil {
+//		campaign.Id, err = mid_client.GetMsisdnCampaignCache(campaignId, msisdn)
+//	}
+//	observe(c, upstreamMid, "GetMsisdnCampaignCache", begin, err)
+
+const (
+	upstreamMid      = "mid"
+	upstreamContentd = "contentd"
+	upstreamPartners = "partners"
+	upstreamBeeline  = "beeline"
+	upstreamQRTech   = "qrtech"
+)
+
+func allow(c *gin.Context, upstream, call string) error {
+	if err := breaker.Get(upstream).Allow(); err != nil {
+		m.BreakerRejected.WithLabelValues(upstream, call).Inc()
+		return err
+	}
+	return nil
+}
+
+// calls rejected by the breaker are counted in allow
+func observe(c *gin.Context, upstream, call string, begin time.Time, err error, reqResp ...interface{}) {
+	if err == breaker.ErrOpen {
+		return
+	}
+	took := time.Since(begin)
+	m.ObserveUpstream(upstream, call, took, err)
+	requestTimings(c).Add(upstreamTiming(upstream), took)
+	breaker.Get(upstream).Record(err)
+	if trail := capture.FromContext(requestContext(c)); trail != nil && len(reqResp) == 2 {
+		trail.Add(capture.KindUpstream, upstream+"."+call, took, err, gin.H{
+			"request":  reqResp[0],
+			"response": reqResp[1],
+		})
+	}
+
+	_, span := startUpstreamSpan(c, upstream, call, trace.WithTimestamp(begin))
+	endUpstreamSpan(span, err)
+}
+
+// operator http apis: transport errors and 5xx responses are counted as errors,
+// trace context is sent in the request headers
+func httpDo(c *gin.Context, upstream, call string, client *http.Client, req *http.Request) (*http.Response, error) {
+	begin := time.Now()
+	ctx, span := startUpstreamSpan(c, upstream, call)
+	tracing.Propagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	trail := capture.FromContext(ctx)
+	var captured gin.H
+	if trail != nil {
+		captured = gin.H{"request": gin.H{
+			"method":  req.Method,
+			"url":     req.URL.String(),
+			"headers": req.Header,
+			"body":    captureBody(&req.Body),
+		}}
+	}
+
+	resp, err := client.Do(req)
+	callErr := err
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			callErr = fmt.Errorf("status: %s", resp.Status)
+		}
+	}
+	took := time.Since(begin)
+	m.ObserveUpstream(upstream, call, took, callErr)
+	requestTimings(c).Add(upstreamTiming(upstream), took)
+	endUpstreamSpan(span, callErr)
+	if trail != nil {
+		if err == nil {
+			captured["response"] = gin.H{
+				"status":  resp.StatusCode,
+				"headers": resp.Header,
+				"body":    captureBody(&resp.Body),
+			}
+		}
+		trail.Add(capture.KindUpstream, upstream+"."+call, took, callErr, captured)
+	}
+	return resp, err
+}
+
+// captureBody reads the body for the capture and puts it back
+func captureBody(body *io.ReadCloser) string {
+	if *body == nil || *body == http.NoBody {
+		return ""
+	}
+	data, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return "read error: " + err.Error()
+	}
+	if max := capture.MaxBodyBytes(); max > 0 && len(data) > max {
+		return string(data[:max]) + "..."
+	}
+	return string(data)
+}
+
+func startUpstreamSpan(c *gin.Context, upstream, call string, opts ...trace.SpanStartOption) (ctx context.Context, span trace.Span) {
+	attrs := append([]attribute.KeyValue{
+		tracing.AttrUpstream.String(upstream),
+		tracing.AttrCall.String(call),
+	}, traceAttributes(c)...)
+	opts = append(opts, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return tracing.Tracer().Start(requestContext(c), upstream+"."+call, opts...)
+}
+
+func endUpstreamSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -12,11 +14,14 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	content_client "github.com/linkit360/go-contentd/rpcclient"
-	content_service "github.com/linkit360/go-contentd/server/src/service"
+	"github.com/linkit360/go-dispatcherd/src/accesslog"
+	"github.com/linkit360/go-dispatcherd/src/anomaly"
 	"github.com/linkit360/go-dispatcherd/src/config"
 	m "github.com/linkit360/go-dispatcherd/src/metrics"
 	"github.com/linkit360/go-dispatcherd/src/rbmq"
 	"github.com/linkit360/go-dispatcherd/src/sessions"
+	"github.com/linkit360/go-dispatcherd/src/throttle"
+	"github.com/linkit360/go-dispatcherd/src/timing"
 	mid_client "github.com/linkit360/go-mid/rpcclient"
 	mid "github.com/linkit360/go-mid/service"
 	redirect_client "github.com/linkit360/go-partners/rpcclient"
@@ -36,8 +41,6 @@ var campaignByLink map[string]*mid.Campaign
 var campaignByHash map[string]mid.Campaign
 
 func Init(conf config.AppConfig, engine *gin.Engine) {
-	log.SetLevel(log.DebugLevel)
-
 	cnf = conf
 	e = engine
 
@@ -60,17 +63,67 @@ func SaveState() {
 	beelineSaveState()
 }
 
+// CloseNotifier waits for the queued events to be published and closes the event archive
+func CloseNotifier() {
+	if notifierService == nil {
+		return
+	}
+	if err := notifierService.Close(); err != nil {
+		log.WithField("error", err.Error()).Error("close notifier")
+	}
+}
+
 func AccessHandler(c *gin.Context) {
 	m.Access.Inc()
-	sessions.SetSession(c)
+	tw := startTiming(c, time.Now())
+	span := startRequestSpan(c)
+	defer endRequestSpan(c, span)
+	sessionBegin := time.Now()
+	msisdn, _, _ := sessions.SetSession(c)
+	requestTimings(c).Since(timing.Session, sessionBegin)
+	requestId := c.Request.Header.Get("X-Request-Id")
+	if requestId == "" {
+		requestId = newRequestId()
+	}
+	c.Header("X-Request-Id", requestId)
+	trail := startCapture(c, sessions.GetTid(c), msisdn, requestId)
+	setRequestInfo(c, sessions.GetTid(c), "", 0)
+	if !isDownloadRoute(c) {
+		defer throttle.Landing()()
+	}
 
 	begin := time.Now()
 	c.Next()
 
 	responseTime := time.Since(begin)
+	c.Header("X-Response-Time", responseTime.String())
+	finishTiming(c, tw)
+	finishCapture(c, trail, responseTime)
 	tid := sessions.GetTid(c)
-
-	if len(c.Errors) > 0 {
+	m.ObserveRequest(c.FullPath(), c.Request.Method, c.Writer.Status(), responseTime)
+	anomaly.Count(c.GetString(campaignIdKey), anomaly.Requests)
+	if c.Writer.Status() >= 500 {
+		anomaly.Count(c.GetString(campaignIdKey), anomaly.Errors)
+	}
+
+	if accesslog.Enabled() {
+		accesslog.Write(accesslog.Entry{
+			Time:         begin,
+			Tid:          tid,
+			RequestId:    requestId,
+			Method:       c.Request.Method,
+			Route:        c.FullPath(),
+			Path:         c.Request.URL.Path,
+			CampaignId:   c.GetString(campaignIdKey),
+			OperatorCode: c.GetInt64(operatorCodeKey),
+			Status:       c.Writer.Status(),
+			Latency:      responseTime,
+			Bytes:        c.Writer.Size(),
+			IP:           c.ClientIP(),
+			UserAgent:    c.Request.UserAgent(),
+			Error:        c.Errors.String(),
+		})
+	} else if len(c.Errors) > 0 {
 		log.WithFields(log.Fields{
 			"tid":    tid,
 			"method": c.Request.Method,
@@ -88,7 +141,12 @@ func AccessHandler(c *gin.Context) {
 			"since":  responseTime,
 		}).Info("access")
 	}
-	c.Header("X-Response-Time", responseTime.String())
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 // update campaign list
@@ -96,7 +154,15 @@ func AccessHandler(c *gin.Context) {
 // and from mid service it goes to dispatcher
 func UpdateCampaigns() error {
 	log.WithFields(log.Fields{}).Debug("get all campaigns")
+	if err := allow(nil, upstreamMid, "GetAllCampaigns"); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("cannot update campaigns, keep loaded")
+		return err
+	}
+	begin := time.Now()
 	campaigns, err := mid_client.GetAllCampaigns()
+	observe(nil, upstreamMid, "GetAllCampaigns", begin, err)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
@@ -112,11 +178,15 @@ func UpdateCampaigns() error {
 	}
 	campaignByLink = make(map[string]*mid.Campaign, len(campaigns))
 	campaignByHash = make(map[string]mid.Campaign, len(campaigns))
+	campaignIds := make([]string, 0, len(campaigns))
 	for _, campaign := range campaigns {
 		camp := campaign
 		campaignByLink[campaign.Link] = &camp
 		campaignByHash[campaign.Hash] = campaign
+		campaignIds = append(campaignIds, campaign.Id)
 	}
+	m.SetFunnelCampaigns(campaignIds)
+	loadContentPages(campaignIds)
 
 	path := cnf.Server.Path + "campaign/*/*.html"
 	log.Debugf("update templates path: %s", path)
@@ -140,6 +210,15 @@ type EventNotify struct {
 	EventData redirect_service.DestinationHit `json:"event_data,omitempty"`
 }
 
+// resolveOperator is the operator and the country of the msisdn of a content request:
+// the one of the enabled landing, the service defaults without it
+func resolveOperator() (operatorCode, countryCode int64) {
+	if cnf.Service.LandingPages.Mobilink.Enabled {
+		return cnf.Service.LandingPages.Mobilink.OperatorCode, cnf.Service.LandingPages.Mobilink.CountryCode
+	}
+	return cnf.Service.OperatorCode, cnf.Service.CountryCode
+}
+
 // traffic redirect
 func trafficRedirect(r structs.AccessCampaignNotify, c *gin.Context) {
 	if r.CountryCode == 0 {
@@ -154,13 +233,24 @@ func trafficRedirect(r structs.AccessCampaignNotify, c *gin.Context) {
 		Msisdn: r.Msisdn,
 	}
 	defer func() {
-		notifierService.RedirectNotify(hit)
+		notifierService.RedirectNotify(c.Request.Context(), hit)
 	}()
 
-	dst, err := redirect_client.GetDestination(redirect_service.GetDestinationParams{
+	if err := allow(c, upstreamPartners, "GetDestination"); err != nil {
+		log.WithFields(log.Fields{
+			"tid":   r.Tid,
+			"error": err.Error(),
+		}).Error("cann't get redirect url from tr")
+		http.Redirect(c.Writer, c.Request, cnf.Service.ErrorRedirectUrl, 302)
+		return
+	}
+	params := redirect_service.GetDestinationParams{
 		CountryCode:  r.CountryCode,
 		OperatorCode: r.OperatorCode,
-	})
+	}
+	begin := time.Now()
+	dst, err := redirect_client.GetDestination(params)
+	observe(c, upstreamPartners, "GetDestination", begin, err, params, dst)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"tid":   r.Tid,
@@ -170,7 +260,18 @@ func trafficRedirect(r structs.AccessCampaignNotify, c *gin.Context) {
 		return
 	}
 
-	mid_client.IncRedirectStatCount(dst.DestinationId)
+	begin = time.Now()
+	errStat := allow(c, upstreamMid, "IncRedirectStatCount")
+	if errStat == nil {
+		errStat = mid_client.IncRedirectStatCount(dst.DestinationId)
+	}
+	observe(c, upstreamMid, "IncRedirectStatCount", begin, errStat, dst.DestinationId, nil)
+	if errStat != nil {
+		log.WithFields(log.Fields{
+			"tid":   r.Tid,
+			"error": errStat.Error(),
+		}).Error("cann't inc redirect stat count")
+	}
 
 	hit.DestinationId = dst.DestinationId
 	hit.PartnerId = dst.PartnerId
@@ -179,6 +280,7 @@ func trafficRedirect(r structs.AccessCampaignNotify, c *gin.Context) {
 	hit.CountryCode = dst.CountryCode
 	hit.OperatorCode = dst.OperatorCode
 	m.TrafficRedirectSuccess.Inc()
+	funnel(c, m.FunnelRedirected, r.CampaignId, r.OperatorCode)
 	log.WithFields(log.Fields{
 		"tid": r.Tid,
 		"url": dst.Destination,
@@ -187,7 +289,7 @@ func trafficRedirect(r structs.AccessCampaignNotify, c *gin.Context) {
 }
 
 // redirect inside dispatcher to another campaign if he/she already was here
-func redirect(msg structs.AccessCampaignNotify) (campaign mid.Campaign, err error) {
+func redirect(c *gin.Context, msg structs.AccessCampaignNotify) (campaign mid.Campaign, err error) {
 	if !cnf.Service.Rejected.CampaignRedirectEnabled {
 		log.WithFields(log.Fields{
 			"tid": msg.Tid,
@@ -197,7 +299,12 @@ func redirect(msg structs.AccessCampaignNotify) (campaign mid.Campaign, err erro
 	}
 
 	// if nextCampaignCode == msg.CampaignCode then it's not rejected msisdn
-	campaign.Id, err = mid_client.GetMsisdnCampaignCache(msg.CampaignId, msg.Msisdn)
+	begin := time.Now()
+	if err = allow(c, upstreamMid, "GetMsisdnCampaignCache"); err == nil {
+		campaign.Id, err = mid_client.GetMsisdnCampaignCache(msg.CampaignId, msg.Msisdn)
+	}
+	observe(c, upstreamMid, "GetMsisdnCampaignCache", begin, err,
+		gin.H{"campaign_id": msg.CampaignId, "msisdn": msg.Msisdn}, campaign.Id)
 	if err != nil {
 		err = fmt.Errorf("mid_client.GetMsisdnCampaignCache: %s", err.Error())
 		log.WithFields(log.Fields{
@@ -225,7 +332,11 @@ func redirect(msg structs.AccessCampaignNotify) (campaign mid.Campaign, err erro
 		return
 	}
 
-	campaign, err = mid_client.GetCampaignByUUID(campaign.Id)
+	begin = time.Now()
+	if err = allow(c, upstreamMid, "GetCampaignByUUID"); err == nil {
+		campaign, err = mid_client.GetCampaignByUUID(campaign.Id)
+	}
+	observe(c, upstreamMid, "GetCampaignByUUID", begin, err, campaign.Id, campaign)
 	if err != nil {
 		err = fmt.Errorf("mid_client.GetCampaignById: %s", err.Error())
 
@@ -245,53 +356,6 @@ func redirect(msg structs.AccessCampaignNotify) (campaign mid.Campaign, err erro
 	return
 }
 
-// generate unique url for user
-// the unique url creation is inside contentd service
-func generateUniqueUrl(r structs.AccessCampaignNotify) (url string, err error) {
-	logCtx := log.WithFields(log.Fields{
-		"tid": r.Tid,
-	})
-	service, err := mid_client.GetServiceByCode(r.ServiceCode)
-	if err != nil {
-		m.UnknownService.Inc()
-
-		err = fmt.Errorf("mid_client.GetServiceById: %s", err.Error())
-		logCtx.WithFields(log.Fields{
-			"serviceId": r.ServiceCode,
-			"error":     err.Error(),
-		}).Error("cannot get service by id")
-		return
-	}
-	contentProperties, err := content_client.GetUniqueUrl(content_service.GetContentParams{
-		Msisdn:       r.Msisdn,
-		Tid:          r.Tid,
-		ServiceCode:  r.ServiceCode,
-		CampaignId:   r.CampaignId,
-		OperatorCode: r.OperatorCode,
-		CountryCode:  r.CountryCode,
-	})
-
-	if contentProperties.Error != "" {
-		m.ContentDeliveryErrors.Inc()
-		err = fmt.Errorf("content_client.GetUniqueUrl: %s", contentProperties.Error)
-		logCtx.WithFields(log.Fields{
-			"serviceId": r.ServiceCode,
-			"error":     err.Error(),
-		}).Error("contentd internal error")
-		return
-	}
-	if err != nil {
-		err = fmt.Errorf("content_client.GetUniqueUrl: %s", err.Error())
-		logCtx.WithFields(log.Fields{
-			"serviceId": r.ServiceCode,
-			"error":     err.Error(),
-		}).Error("cannot get unique content url")
-		return
-	}
-	url = fmt.Sprintf(service.SMSOnContent, cnf.Server.Url+"/u/"+contentProperties.UniqueUrl)
-	return
-}
-
 func generateCode(c *gin.Context) {
 	msg := gatherInfo(c)
 	logCtx := log.WithFields(log.Fields{
@@ -315,13 +379,13 @@ func generateCode(c *gin.Context) {
 				"error": err.Error(),
 			}).Error("code generate")
 		}
-		if errAction := notifierService.ActionNotify(action); errAction != nil {
+		if errAction := notifierService.ActionNotify(c.Request.Context(), action); errAction != nil {
 			logCtx.WithFields(log.Fields{
 				"error":  errAction.Error(),
 				"action": fmt.Sprintf("%#v", action),
 			}).Error("notify user action")
 		}
-		if errAccessCampaign := notifierService.AccessCampaignNotify(msg); errAccessCampaign != nil {
+		if errAccessCampaign := notifierService.AccessCampaignNotify(c.Request.Context(), msg); errAccessCampaign != nil {
 			logCtx.WithFields(log.Fields{
 				"error": errAccessCampaign.Error(),
 				"msg":   fmt.Sprintf("%#v", msg),
@@ -336,6 +400,7 @@ func generateCode(c *gin.Context) {
 	campaign, ok := campaignByLink[campaignLink]
 	if !ok {
 		m.PageNotFoundError.Inc()
+		anomaly.Count("", anomaly.NotFound)
 		err = fmt.Errorf("page not found: %s", campaignLink)
 
 		log.WithFields(log.Fields{
@@ -349,6 +414,7 @@ func generateCode(c *gin.Context) {
 	msg.CampaignHash = campaign.Hash
 	msg.CountryCode = cnf.Service.LandingPages.Mobilink.CountryCode
 	msg.OperatorCode = cnf.Service.LandingPages.Mobilink.OperatorCode
+	setRequestInfo(c, msg.Tid, msg.CampaignId, msg.OperatorCode)
 	if msg.IP == "" {
 		m.IPNotFoundError.Inc()
 	}
@@ -394,7 +460,7 @@ func generateCode(c *gin.Context) {
 	//}
 	//
 	//mobilinkCodeCache.SetDefault(msg.Msisdn, r)
-	//notifierService.Notify("send_sms", cnf.Service.LandingPages.Mobilink.Queues.SMS, r)
+	//notifierService.Notify(c.Request.Context(), "send_sms", r)
 	c.JSON(200, gin.H{"message": "Sent"})
 }
 
@@ -424,7 +490,7 @@ func verifyCode(c *gin.Context) {
 				"error": err.Error(),
 			}).Error("code verify")
 		}
-		if errAction := notifierService.ActionNotify(action); errAction != nil {
+		if errAction := notifierService.ActionNotify(c.Request.Context(), action); errAction != nil {
 			logCtx.WithFields(log.Fields{
 				"error":  errAction.Error(),
 				"action": fmt.Sprintf("%#v", action),
@@ -465,7 +531,7 @@ func verifyCode(c *gin.Context) {
 		return
 	}
 
-	if err = notifierService.NewSubscriptionNotify(cnf.Service.LandingPages.Mobilink.Queues.MO, r); err != nil {
+	if err = notifierService.NewSubscriptionNotify(c.Request.Context(), r); err != nil {
 		m.NotifyNewSubscriptionError.Inc()
 
 		err = fmt.Errorf("notifierService.NewSubscriptionNotify: %s", err.Error())
@@ -475,14 +541,14 @@ func verifyCode(c *gin.Context) {
 		return
 	}
 
-	contentUrl, err := createUniqueUrl(r)
+	contentUrl, err := createUniqueUrl(c, r)
 	if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 	// XXX: check content url
 	r.SMSText = fmt.Sprintf("%s", contentUrl)
-	//if err = notifierService.Notify(cnf.Service.LandingPages.Mobilink.Queues.SMS, "content", r); err != nil {
+	//if err = notifierService.Notify(c.Request.Context(), "content", r); err != nil {
 	//	logCtx.WithField("error", err.Error()).Error("send content")
 	//	return
 	//}
@@ -0,0 +1,292 @@
+package history
+
+// content sent to the subscribers: "my content" page
+//
+// the entries are the content_sent events of the dispatcher (contentd content
+// delivered to a known msisdn), newest first, written at once to the file of the msisdn
+// in path: the nodes sharing the directory (nfs) show the same history
+// not backfilled: the content sent before the history was enabled is not shown,
+// contentd has no api listing the content sent to a msisdn
+// the pins and the download links live minutes in the memory of the node that made them
+// every item is downloaded again by a fresh random link living link_ttl_min
+// the subscriber is known by the session msisdn or logs in by the msisdn and the sms pin
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+type HistoryConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	MaxItems int  `default:"50" yaml:"max_items"`
+	KeepDays int  `default:"90" yaml:"keep_days"`
+	// directory of the history files, a shared one for all the nodes
+	Path string `yaml:"path"`
+	// fresh download links of the items
+	LinkTTLMin int `default:"60" yaml:"link_ttl_min"`
+	// the session msisdn may come from ?msisdn=, trust it on the header enriched networks only
+	SessionMsisdn bool `yaml:"session_msisdn"`
+	PinLength     int  `default:"4" yaml:"pin_length"`
+	PinTTLMin     int  `default:"10" yaml:"pin_ttl_min"`
+	PinAttempts   int  `default:"3" yaml:"pin_attempts"`
+	// one pin a minute per msisdn
+	PinIntervalSec int    `default:"60" yaml:"pin_interval_sec"`
+	PinSMS         string `default:"Your PIN: %s" yaml:"pin_sms"`
+	// page template relative to server.path, built-in page when empty
+	Template string `yaml:"template"`
+}
+
+type Entry struct {
+	ContentId    string    `json:"content_id"`
+	ContentName  string    `json:"content_name"`
+	ContentPath  string    `json:"content_path"`
+	ServiceCode  string    `json:"service_code"`
+	CampaignId   string    `json:"campaign_id"`
+	OperatorCode int64     `json:"operator_code,omitempty"` // the redownloads are routed by it
+	SentAt       time.Time `json:"sent_at"`
+}
+
+var (
+	ErrPinTooSoon  = errors.New("pin already sent, try later")
+	ErrPinExpired  = errors.New("pin expired or not requested")
+	ErrPinWrong    = errors.New("wrong pin")
+	ErrPinAttempts = errors.New("too many wrong pins")
+)
+
+type link struct {
+	Msisdn    string
+	ContentId string
+}
+
+type pin struct {
+	Pin      string
+	Attempts int
+}
+
+var (
+	conf    HistoryConfig
+	mu      sync.Mutex
+	links   *cache.Cache
+	pins    *cache.Cache
+	pinSent *cache.Cache
+)
+
+func Init(historyConf HistoryConfig) error {
+	conf = historyConf
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.Path == "" {
+		return fmt.Errorf("content history path required")
+	}
+	if err := os.MkdirAll(conf.Path, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll: %s", err.Error())
+	}
+	links = cache.New(time.Duration(conf.LinkTTLMin)*time.Minute, time.Minute)
+	pins = cache.New(time.Duration(conf.PinTTLMin)*time.Minute, time.Minute)
+	pinSent = cache.New(time.Duration(conf.PinIntervalSec)*time.Second, time.Minute)
+	log.WithFields(log.Fields{
+		"path":      conf.Path,
+		"max_items": conf.MaxItems,
+	}).Info("content history init")
+	return nil
+}
+
+func Enabled() bool {
+	return conf.Enabled
+}
+
+func SessionMsisdn() bool {
+	return conf.SessionMsisdn
+}
+
+func Template() string {
+	return conf.Template
+}
+
+func PinSMS() string {
+	return conf.PinSMS
+}
+
+// Add records the content sent, the content sent again moves to the top,
+// the expired entries are dropped
+func Add(msisdn string, e Entry) {
+	if !conf.Enabled || msisdn == "" || e.ContentId == "" {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	since := time.Now().AddDate(0, 0, -conf.KeepDays)
+	list := []Entry{e}
+	for _, old := range read(msisdn) {
+		if old.ContentId != e.ContentId && old.SentAt.After(since) && len(list) < conf.MaxItems {
+			list = append(list, old)
+		}
+	}
+	if err := write(msisdn, list); err != nil {
+		log.WithFields(log.Fields{
+			"msisdn": msisdn,
+			"error":  err.Error(),
+		}).Error("content history add")
+	}
+}
+
+// List returns the content of the service sent to the msisdn, newest first,
+// all the services when the service code is empty
+func List(msisdn, serviceCode string, now time.Time) []Entry {
+	if !conf.Enabled {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	since := now.AddDate(0, 0, -conf.KeepDays)
+	res := []Entry{}
+	for _, e := range read(msisdn) {
+		if e.SentAt.Before(since) {
+			break
+		}
+		if serviceCode == "" || e.ServiceCode == serviceCode {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func Find(msisdn, contentId string) (Entry, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range read(msisdn) {
+		if e.ContentId == contentId {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// NewLink returns the token of the fresh download link of the item
+func NewLink(msisdn, contentId string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	links.SetDefault(token, link{Msisdn: msisdn, ContentId: contentId})
+	return token
+}
+
+// Link returns the item of the download link
+func Link(token string) (Entry, string, bool) {
+	if !conf.Enabled {
+		return Entry{}, "", false
+	}
+	v, ok := links.Get(token)
+	if !ok {
+		return Entry{}, "", false
+	}
+	l := v.(link)
+	e, ok := Find(l.Msisdn, l.ContentId)
+	return e, l.Msisdn, ok
+}
+
+// NewPin returns the pin to send to the msisdn
+func NewPin(msisdn string) (string, error) {
+	if err := pinSent.Add(msisdn, true, cache.DefaultExpiration); err != nil {
+		return "", ErrPinTooSoon
+	}
+	max := big.NewInt(1)
+	for i := 0; i < conf.PinLength; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", fmt.Errorf("rand.Int: %s", err.Error())
+	}
+	code := fmt.Sprintf("%0*d", conf.PinLength, n)
+	pins.SetDefault(msisdn, &pin{Pin: code})
+	return code, nil
+}
+
+// CheckPin removes the pin when it is right or is tried too many times
+func CheckPin(msisdn, code string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	v, ok := pins.Get(msisdn)
+	if !ok {
+		return ErrPinExpired
+	}
+	p := v.(*pin)
+	if p.Pin == code {
+		pins.Delete(msisdn)
+		return nil
+	}
+	p.Attempts++
+	if p.Attempts >= conf.PinAttempts {
+		pins.Delete(msisdn)
+		return ErrPinAttempts
+	}
+	return ErrPinWrong
+}
+
+// the file is named by the msisdn hash: the msisdn of a content_sent event is not checked
+func file(msisdn string) string {
+	hash := sha1.Sum([]byte(msisdn))
+	return filepath.Join(conf.Path, hex.EncodeToString(hash[:])+".json")
+}
+
+// read is called under the lock
+func read(msisdn string) []Entry {
+	data, err := ioutil.ReadFile(file(msisdn))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"msisdn": msisdn,
+				"error":  err.Error(),
+			}).Error("content history read")
+		}
+		return nil
+	}
+	var list []Entry
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.WithFields(log.Fields{
+			"msisdn": msisdn,
+			"error":  err.Error(),
+		}).Error("content history read")
+		return nil
+	}
+	return list
+}
+
+// write replaces the file at once: the other nodes never read a part of it
+func write(msisdn string, list []Entry) error {
+	data, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+	tmp, err := ioutil.TempFile(conf.Path, "history-*.tmp")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("tmp.Write: %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("tmp.Close: %s", err.Error())
+	}
+	if err := os.Rename(tmp.Name(), file(msisdn)); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	return nil
+}
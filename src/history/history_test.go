@@ -0,0 +1,93 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testConf(dir string) HistoryConfig {
+	return HistoryConfig{
+		Enabled:        true,
+		MaxItems:       3,
+		KeepDays:       30,
+		Path:           filepath.Join(dir, "history"),
+		LinkTTLMin:     60,
+		PinLength:      4,
+		PinTTLMin:      10,
+		PinAttempts:    2,
+		PinIntervalSec: 60,
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, Init(testConf(dir)))
+
+	now := time.Now().UTC()
+	Add("79001234567", Entry{ContentId: "1", ServiceCode: "a", SentAt: now.AddDate(0, 0, -40)})
+	Add("79001234567", Entry{ContentId: "2", ServiceCode: "a", SentAt: now.Add(-2 * time.Hour)})
+	Add("79001234567", Entry{ContentId: "3", ServiceCode: "b", SentAt: now.Add(-time.Hour)})
+	Add("79001234567", Entry{ContentId: "2", ServiceCode: "a", SentAt: now})
+	Add("79007654321", Entry{ContentId: "9", ServiceCode: "a", SentAt: now})
+
+	ids := func(entries []Entry) []string {
+		res := []string{}
+		for _, e := range entries {
+			res = append(res, e.ContentId)
+		}
+		return res
+	}
+	assert.Equal(t, []string{"2", "3"}, ids(List("79001234567", "", now)), "newest first, old dropped")
+	assert.Equal(t, []string{"2"}, ids(List("79001234567", "a", now)))
+	assert.Equal(t, []string{}, ids(List("79000000000", "", now)))
+
+	Add("79001234567", Entry{ContentId: "4", SentAt: now})
+	Add("79001234567", Entry{ContentId: "5", SentAt: now})
+	assert.Equal(t, []string{"5", "4", "2"}, ids(List("79001234567", "", now)), "max items")
+
+	token := NewLink("79001234567", "4")
+	e, msisdn, ok := Link(token)
+	assert.True(t, ok)
+	assert.Equal(t, "4", e.ContentId)
+	assert.Equal(t, "79001234567", msisdn)
+	_, _, ok = Link("unknown")
+	assert.False(t, ok)
+
+	// another node sharing the path
+	assert.NoError(t, Init(testConf(dir)))
+	assert.Equal(t, []string{"5", "4", "2"}, ids(List("79001234567", "", now)))
+}
+
+func TestPin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, Init(testConf(dir)))
+
+	pin, err := NewPin("79001234567")
+	assert.NoError(t, err)
+	assert.Len(t, pin, 4)
+	_, err = NewPin("79001234567")
+	assert.Equal(t, ErrPinTooSoon, err)
+
+	wrong := "0000"
+	if pin == wrong {
+		wrong = "1111"
+	}
+	assert.Equal(t, ErrPinWrong, CheckPin("79001234567", wrong))
+	assert.NoError(t, CheckPin("79001234567", pin))
+	assert.Equal(t, ErrPinExpired, CheckPin("79001234567", pin), "used")
+
+	pin, err = NewPin("79007654321")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrPinWrong, CheckPin("79007654321", pin+"1"))
+	assert.Equal(t, ErrPinAttempts, CheckPin("79007654321", pin+"1"))
+	assert.Equal(t, ErrPinExpired, CheckPin("79007654321", pin))
+}
@@ -0,0 +1,219 @@
+package links
+
+// signed expiring download links: /d/<token>
+//
+// token is base64url(payload) "." base64url(hmac-sha256(payload)[:16]),
+// payload: key id, content id, campaign id, msisdn hmac, expiry, contentd unique url
+// the payload is readable, so /u/<unique url> is rejected while the signed links are on
+//
+// the first key signs, the others only verify: to rotate add the new key first
+// and remove the old one when the links signed with it are expired
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type LinksConfig struct {
+	Enabled  bool  `yaml:"enabled"`
+	Keys     []Key `yaml:"keys"`
+	TTLHours int   `default:"72" yaml:"ttl_hours"`
+	// reject the link opened by another msisdn (when the msisdn is known)
+	BindMsisdn bool `yaml:"bind_msisdn"`
+	// /u/get gives random content to anyone
+	DisableRandomGet bool `yaml:"disable_random_get"`
+	// html file shown for the expired links, relative to server.path
+	ExpiredPage string `yaml:"expired_page"`
+	// the unsigned /u/ links sent before the signed links were enabled
+	// are accepted until this time, RFC3339; empty - rejected at once
+	UnsignedUntil string `yaml:"unsigned_until"`
+}
+
+type Key struct {
+	Id     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+type Link struct {
+	KeyId      string
+	ContentId  string
+	CampaignId string
+	MsisdnHash string
+	Expires    time.Time
+	UniqueUrl  string
+	// to sign only: the link keeps its hmac by the signing key
+	Msisdn string
+}
+
+var (
+	ErrMalformed  = errors.New("malformed link")
+	ErrUnknownKey = errors.New("unknown link key")
+	ErrSignature  = errors.New("wrong link signature")
+	ErrExpired    = errors.New("link expired")
+)
+
+const (
+	macSize = 16
+	fields  = 6
+)
+
+var (
+	conf          LinksConfig
+	keys          map[string][]byte
+	unsignedUntil time.Time
+)
+
+func Init(linksConf LinksConfig) error {
+	conf = linksConf
+	if !conf.Enabled {
+		return nil
+	}
+	if len(conf.Keys) == 0 {
+		return fmt.Errorf("no link signing keys")
+	}
+	unsignedUntil = time.Time{}
+	if conf.UnsignedUntil != "" {
+		var err error
+		if unsignedUntil, err = time.Parse(time.RFC3339, conf.UnsignedUntil); err != nil {
+			return fmt.Errorf("unsigned_until: %s", err.Error())
+		}
+	}
+	keys = make(map[string][]byte, len(conf.Keys))
+	for _, k := range conf.Keys {
+		if k.Id == "" || strings.Contains(k.Id, "|") || len(k.Secret) < 16 {
+			return fmt.Errorf("link key %s: id required, secret 16 chars at least", k.Id)
+		}
+		keys[k.Id] = []byte(k.Secret)
+	}
+	log.WithFields(log.Fields{
+		"active": conf.Keys[0].Id,
+		"keys":   len(keys),
+	}).Info("signed links init")
+	return nil
+}
+
+func Enabled() bool {
+	return conf.Enabled
+}
+
+// AcceptUnsigned is true when the unsigned /u/ links are served:
+// the signed links are off or it is the grace period of the links sent before them
+func AcceptUnsigned(now time.Time) bool {
+	return !conf.Enabled || now.Before(unsignedUntil)
+}
+
+func TTL() time.Duration {
+	return time.Duration(conf.TTLHours) * time.Hour
+}
+
+// msisdnHash keeps the msisdn out of the link, keyed so it cannot be
+// brute forced over the msisdn space
+func msisdnHash(key []byte, msisdn string) string {
+	if msisdn == "" {
+		return ""
+	}
+	return hex.EncodeToString(mac(key, "msisdn|"+msisdn)[:8])
+}
+
+// Sign makes the token with the active key, the key id and expiry are set
+func Sign(l Link) (string, error) {
+	if !conf.Enabled {
+		return "", fmt.Errorf("signed links disabled")
+	}
+	for _, f := range []string{l.ContentId, l.CampaignId, l.UniqueUrl} {
+		if strings.Contains(f, "|") {
+			return "", fmt.Errorf("link field contains separator: %s", f)
+		}
+	}
+	l.KeyId = conf.Keys[0].Id
+	l.MsisdnHash = msisdnHash(keys[l.KeyId], l.Msisdn)
+	payload := strings.Join([]string{
+		l.KeyId,
+		l.ContentId,
+		l.CampaignId,
+		l.MsisdnHash,
+		strconv.FormatInt(l.Expires.Unix(), 36),
+		l.UniqueUrl,
+	}, "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac(keys[l.KeyId], payload)), nil
+}
+
+// Verify checks the token, the link is returned with ErrExpired
+// to show the campaign of the expired link
+func Verify(token string, now time.Time) (l Link, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return l, ErrMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return l, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return l, ErrMalformed
+	}
+	values := strings.Split(string(payload), "|")
+	if len(values) != fields {
+		return l, ErrMalformed
+	}
+	key, ok := keys[values[0]]
+	if !ok {
+		return l, ErrUnknownKey
+	}
+	if !hmac.Equal(signature, mac(key, string(payload))) {
+		return l, ErrSignature
+	}
+	expires, err := strconv.ParseInt(values[4], 36, 64)
+	if err != nil {
+		return l, ErrMalformed
+	}
+	l = Link{
+		KeyId:      values[0],
+		ContentId:  values[1],
+		CampaignId: values[2],
+		MsisdnHash: values[3],
+		Expires:    time.Unix(expires, 0),
+		UniqueUrl:  values[5],
+	}
+	if now.After(l.Expires) {
+		return l, ErrExpired
+	}
+	return l, nil
+}
+
+// MsisdnMatches is false when the link was issued for another msisdn
+func MsisdnMatches(l Link, msisdn string) bool {
+	if !conf.BindMsisdn || msisdn == "" || l.MsisdnHash == "" {
+		return true
+	}
+	key, ok := keys[l.KeyId]
+	if !ok {
+		return false
+	}
+	return hmac.Equal([]byte(l.MsisdnHash), []byte(msisdnHash(key, msisdn)))
+}
+
+func DisableRandomGet() bool {
+	return conf.DisableRandomGet
+}
+
+func ExpiredPage() string {
+	return conf.ExpiredPage
+}
+
+func mac(key []byte, payload string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)[:macSize]
+}
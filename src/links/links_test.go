@@ -0,0 +1,138 @@
+package links
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testInit(t *testing.T, keys ...Key) {
+	err := Init(LinksConfig{
+		Enabled:    true,
+		Keys:       keys,
+		TTLHours:   72,
+		BindMsisdn: true,
+	})
+	assert.NoError(t, err)
+}
+
+var (
+	oldKey = Key{Id: "k1", Secret: "0123456789abcdef-old"}
+	newKey = Key{Id: "k2", Secret: "0123456789abcdef-new"}
+)
+
+func TestSignVerify(t *testing.T) {
+	testInit(t, oldKey)
+	now := time.Unix(1500000000, 0)
+	link := Link{
+		ContentId:  "42",
+		CampaignId: "7",
+		Msisdn:     "79001234567",
+		Expires:    now.Add(time.Hour),
+		UniqueUrl:  "a1b2c3",
+	}
+	token, err := Sign(link)
+	assert.NoError(t, err)
+
+	got, err := Verify(token, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", got.KeyId)
+	assert.Equal(t, "42", got.ContentId)
+	assert.Equal(t, "7", got.CampaignId)
+	assert.Equal(t, "a1b2c3", got.UniqueUrl)
+	assert.True(t, got.Expires.Equal(link.Expires))
+
+	got, err = Verify(token, now.Add(2*time.Hour))
+	assert.Equal(t, ErrExpired, err)
+	assert.Equal(t, "7", got.CampaignId, "expired link is returned")
+
+	assert.True(t, MsisdnMatches(got, "79001234567"))
+	assert.True(t, MsisdnMatches(got, ""), "unknown msisdn")
+	assert.False(t, MsisdnMatches(got, "79007654321"))
+
+	_, err = Sign(Link{ContentId: "4|2"})
+	assert.Error(t, err)
+}
+
+func TestVerifyRejects(t *testing.T) {
+	testInit(t, oldKey)
+	now := time.Unix(1500000000, 0)
+	token, _ := Sign(Link{ContentId: "42", Expires: now.Add(time.Hour), UniqueUrl: "a1b2c3"})
+	parts := strings.Split(token, ".")
+
+	for name, tc := range map[string]struct {
+		token string
+		err   error
+	}{
+		"no signature":   {parts[0], ErrMalformed},
+		"bad base64":     {"!!." + parts[1], ErrMalformed},
+		"other payload":  {strings.Split(mustSign(t, "43", now), ".")[0] + "." + parts[1], ErrSignature},
+		"cut signature":  {parts[0] + "." + parts[1][:10], ErrSignature},
+		"empty":          {"", ErrMalformed},
+		"unknown key id": {signWith(Key{Id: "k9", Secret: "0123456789abcdef-k9"}, now), ErrUnknownKey},
+	} {
+		_, err := Verify(tc.token, now)
+		assert.Equal(t, tc.err, err, name)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	testInit(t, oldKey)
+	oldToken, err := Sign(Link{ContentId: "42", Expires: now.Add(time.Hour), Msisdn: "79001234567"})
+	assert.NoError(t, err)
+
+	// the new key signs, the old links are still valid
+	testInit(t, newKey, oldKey)
+	newToken, err := Sign(Link{ContentId: "42", Expires: now.Add(time.Hour), Msisdn: "79001234567"})
+	assert.NoError(t, err)
+	oldLink, err := Verify(oldToken, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", oldLink.KeyId)
+	l, err := Verify(newToken, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", l.KeyId)
+	assert.NotEqual(t, oldLink.MsisdnHash, l.MsisdnHash, "keyed by the signing key")
+	assert.True(t, MsisdnMatches(oldLink, "79001234567"))
+	assert.False(t, MsisdnMatches(oldLink, "79007654321"))
+
+	// the old key removed
+	testInit(t, newKey)
+	_, err = Verify(oldToken, now)
+	assert.Equal(t, ErrUnknownKey, err)
+
+	assert.Error(t, Init(LinksConfig{Enabled: true, Keys: []Key{{Id: "short", Secret: "secret"}}}))
+	assert.Error(t, Init(LinksConfig{Enabled: true}))
+}
+
+func TestAcceptUnsigned(t *testing.T) {
+	now := time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, Init(LinksConfig{}))
+	assert.True(t, AcceptUnsigned(now), "signed links off")
+
+	testInit(t, oldKey)
+	assert.False(t, AcceptUnsigned(now), "no grace period")
+
+	assert.NoError(t, Init(LinksConfig{Enabled: true, Keys: []Key{oldKey}, UnsignedUntil: "2017-05-04T10:00:00Z"}))
+	assert.True(t, AcceptUnsigned(now), "grace period")
+	assert.False(t, AcceptUnsigned(now.Add(72*time.Hour)), "grace period is over")
+
+	assert.Error(t, Init(LinksConfig{Enabled: true, Keys: []Key{oldKey}, UnsignedUntil: "04.05.2017"}))
+}
+
+func mustSign(t *testing.T, contentId string, now time.Time) string {
+	token, err := Sign(Link{ContentId: contentId, Expires: now.Add(time.Hour), UniqueUrl: "a1b2c3"})
+	assert.NoError(t, err)
+	return token
+}
+
+// signWith signs with the key unknown to the verifier
+func signWith(key Key, now time.Time) string {
+	saved, savedKeys := conf, keys
+	defer func() { conf, keys = saved, savedKeys }()
+	Init(LinksConfig{Enabled: true, Keys: []Key{key}})
+	token, _ := Sign(Link{ContentId: "42", Expires: now.Add(time.Hour)})
+	return token
+}
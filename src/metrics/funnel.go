@@ -0,0 +1,208 @@
+package metrics
+
+// conversion funnel per campaign, operator and publisher
+// counters go to prometheus, rolling window counts are kept for /admin/funnel
+// campaign label values are limited to the loaded campaigns,
+// publisher label values to the first MaxPublishers seen
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	FunnelLanding    = "landing_served"
+	FunnelAutoclick  = "autoclick_attempted"
+	FunnelNotified   = "subscription_notified"
+	FunnelContent    = "content_fetched"
+	FunnelRedirected = "redirected"
+	FunnelRejected   = "rejected"
+)
+
+var FunnelStages = []string{
+	FunnelLanding,
+	FunnelAutoclick,
+	FunnelNotified,
+	FunnelContent,
+	FunnelRedirected,
+	FunnelRejected,
+}
+
+type FunnelConfig struct {
+	WindowMinutes int `default:"60" yaml:"window_minutes"`
+	MaxPublishers int `default:"100" yaml:"max_publishers"`
+}
+
+type FunnelKey struct {
+	CampaignId   string `json:"campaign_id"`
+	OperatorCode string `json:"operator_code"`
+	Publisher    string `json:"publisher"`
+}
+
+type funnelBucket struct {
+	minute int64
+	counts map[FunnelKey]map[string]int64
+}
+
+type funnel struct {
+	conf       FunnelConfig
+	mu         sync.Mutex
+	campaigns  map[string]struct{}
+	publishers map[string]struct{}
+	buckets    []funnelBucket
+}
+
+var fn *funnel
+
+var funnelTotal = NewCounterVec("funnel_total",
+	"conversion funnel stages by campaign, operator and publisher",
+	"stage", "campaign_id", "operator_code", "publisher")
+
+func InitFunnel(conf FunnelConfig) {
+	if conf.WindowMinutes <= 0 {
+		conf.WindowMinutes = 60
+	}
+	fn = &funnel{
+		conf:       conf,
+		campaigns:  make(map[string]struct{}),
+		publishers: make(map[string]struct{}),
+		buckets:    make([]funnelBucket, conf.WindowMinutes),
+	}
+}
+
+// SetFunnelCampaigns limits campaign label values to the loaded campaigns
+func SetFunnelCampaigns(ids []string) {
+	if fn == nil {
+		return
+	}
+	campaigns := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		campaigns[id] = struct{}{}
+	}
+	fn.mu.Lock()
+	fn.campaigns = campaigns
+	fn.mu.Unlock()
+}
+
+func Funnel(stage, campaignId string, operatorCode int64, publisher string) {
+	if fn == nil {
+		return
+	}
+	now := time.Now().Unix() / 60
+
+	fn.mu.Lock()
+	key := FunnelKey{
+		CampaignId:   fn.campaignLabel(campaignId),
+		OperatorCode: strconv.FormatInt(operatorCode, 10),
+		Publisher:    fn.publisherLabel(publisher),
+	}
+	b := &fn.buckets[now%int64(len(fn.buckets))]
+	if b.minute != now {
+		b.minute = now
+		b.counts = make(map[FunnelKey]map[string]int64)
+	}
+	stages, ok := b.counts[key]
+	if !ok {
+		stages = make(map[string]int64, len(FunnelStages))
+		b.counts[key] = stages
+	}
+	stages[stage]++
+	fn.mu.Unlock()
+
+	funnelTotal.WithLabelValues(stage, key.CampaignId, key.OperatorCode, key.Publisher).Inc()
+}
+
+func (f *funnel) campaignLabel(campaignId string) string {
+	if _, ok := f.campaigns[campaignId]; ok {
+		return campaignId
+	}
+	return "unknown"
+}
+
+func (f *funnel) publisherLabel(publisher string) string {
+	if publisher == "" {
+		return "none"
+	}
+	if _, ok := f.publishers[publisher]; ok {
+		return publisher
+	}
+	if len(f.publishers) >= f.conf.MaxPublishers {
+		return "other"
+	}
+	f.publishers[publisher] = struct{}{}
+	return publisher
+}
+
+type FunnelRow struct {
+	FunnelKey
+	Counts map[string]int64   `json:"counts"`
+	Ratios map[string]float64 `json:"ratios"`
+}
+
+type FunnelReport struct {
+	WindowMinutes int         `json:"window_minutes"`
+	Total         FunnelRow   `json:"total"`
+	Rows          []FunnelRow `json:"rows"`
+}
+
+// FunnelSnapshot sums the rolling window,
+// campaignId filters the rows when not empty
+func FunnelSnapshot(campaignId string) (report FunnelReport) {
+	report.Total.Counts = make(map[string]int64)
+	report.Rows = []FunnelRow{}
+	if fn == nil {
+		return
+	}
+	now := time.Now().Unix() / 60
+	sums := make(map[FunnelKey]map[string]int64)
+
+	fn.mu.Lock()
+	report.WindowMinutes = len(fn.buckets)
+	for _, b := range fn.buckets {
+		if b.counts == nil || now-b.minute >= int64(len(fn.buckets)) {
+			continue
+		}
+		for key, stages := range b.counts {
+			if campaignId != "" && key.CampaignId != campaignId {
+				continue
+			}
+			sum, ok := sums[key]
+			if !ok {
+				sum = make(map[string]int64, len(stages))
+				sums[key] = sum
+			}
+			for stage, count := range stages {
+				sum[stage] += count
+				report.Total.Counts[stage] += count
+			}
+		}
+	}
+	fn.mu.Unlock()
+
+	for key, counts := range sums {
+		report.Rows = append(report.Rows, FunnelRow{
+			FunnelKey: key,
+			Counts:    counts,
+			Ratios:    funnelRatios(counts),
+		})
+	}
+	report.Total.Ratios = funnelRatios(report.Total.Counts)
+	return
+}
+
+func funnelRatios(counts map[string]int64) map[string]float64 {
+	ratio := func(a, b string) float64 {
+		if counts[b] == 0 {
+			return 0
+		}
+		return float64(counts[a]) / float64(counts[b])
+	}
+	return map[string]float64{
+		"autoclick_per_landing":  ratio(FunnelAutoclick, FunnelLanding),
+		"notified_per_landing":   ratio(FunnelNotified, FunnelLanding),
+		"content_per_notified":   ratio(FunnelContent, FunnelNotified),
+		"redirected_per_landing": ratio(FunnelRedirected, FunnelLanding),
+		"rejected_per_landing":   ratio(FunnelRejected, FunnelLanding),
+	}
+}
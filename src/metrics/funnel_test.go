@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFunnel(t *testing.T) {
+	Init("dispatcherd_test")
+	InitFunnel(FunnelConfig{WindowMinutes: 60, MaxPublishers: 1})
+	SetFunnelCampaigns([]string{"290"})
+
+	Funnel(FunnelLanding, "290", 41001, "mobusi")
+	Funnel(FunnelLanding, "290", 41001, "mobusi")
+	Funnel(FunnelNotified, "290", 41001, "mobusi")
+	Funnel(FunnelLanding, "290", 41001, "another")
+	Funnel(FunnelLanding, "not-loaded", 41001, "")
+
+	report := FunnelSnapshot("")
+	assert.Equal(t, int64(4), report.Total.Counts[FunnelLanding], "total landings")
+	assert.Len(t, report.Rows, 3, "bounded label values")
+	for _, row := range report.Rows {
+		switch row.Publisher {
+		case "mobusi":
+			assert.Equal(t, 0.5, row.Ratios["notified_per_landing"], "ratio")
+		case "other":
+			assert.Equal(t, "290", row.CampaignId, "publishers over the limit")
+		case "none":
+			assert.Equal(t, "unknown", row.CampaignId, "campaign not loaded")
+		default:
+			t.Errorf("unexpected row: %#v", row)
+		}
+	}
+	assert.Len(t, FunnelSnapshot("unknown").Rows, 1, "campaign filter")
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+)
+
+// latency of the handled requests and of the calls to upstream services
+// (mid, contentd, partners rpc, operator http apis)
+var (
+	RequestDuration = NewHistogramVec("request_duration_seconds",
+		"request latency by route template, method and status class",
+		nil, "route", "method", "status")
+	UpstreamDuration = NewHistogramVec("upstream_duration_seconds",
+		"latency of rpc and http calls to upstream services",
+		nil, "upstream", "call")
+	UpstreamErrors = NewCounterVec("upstream_errors_total",
+		"failed rpc and http calls to upstream services",
+		"upstream", "call")
+)
+
+func ObserveRequest(route, method string, status int, took time.Duration) {
+	if route == "" {
+		route = "not_found"
+	}
+	RequestDuration.WithLabelValues(route, method, statusClass(status)).Observe(took.Seconds())
+}
+
+func ObserveUpstream(upstream, call string, took time.Duration, err error) {
+	UpstreamDuration.WithLabelValues(upstream, call).Observe(took.Seconds())
+	if err != nil {
+		UpstreamErrors.WithLabelValues(upstream, call).Inc()
+	}
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -1,102 +1,83 @@
 package metrics
 
-import (
-	"time"
+var (
+	Success  = NewOverallGauge("success", "success overall")
+	Errors   = NewOverallGauge("errors", "errors overall")
+	Incoming = NewGauge("incoming", "overall")
+	Access   = NewGauge("access", "requests passed the access handler")
 
-	m "github.com/linkit360/go-utils/metrics"
-)
+	Agree                  = NewGauge("agreed", "pressed the button 'agree'")
+	Redirected             = NewGauge("redirected", "redirected due to rejected")
+	AgreeSuccess           = NewGauge("agree_success", "pressed the button 'agree' and successfully processed")
+	CampaignAccess         = NewGauge("campaign_access", "campaign access success")
+	ContentGetSuccess      = NewGauge("content_get", "pressed the button 'get content' and successfully processed")
+	RandomContentGet       = NewGauge("random_content_get", "get random content from the url /u/get")
+	UniqueUrlGet           = NewGauge("unique_url_get", "get the uniq url from the sms")
+	TrafficRedirectSuccess = NewGauge("traffic_redirect_success", "traffic redirect success")
 
-var (
-	Incoming               m.Gauge
-	Errors                 m.Gauge
-	Success                m.Gauge
-	Access                 m.Gauge
-	Agree                  m.Gauge
-	AgreeSuccess           m.Gauge
-	Redirected             m.Gauge
-	Rejected               m.Gauge
-	CampaignAccess         m.Gauge
-	RandomContentGet       m.Gauge
-	UniqueUrlGet           m.Gauge
-	ContentGetSuccess      m.Gauge
-	TrafficRedirectSuccess m.Gauge
-
-	PageNotFoundError          m.Gauge
-	CampaignHashWrong          m.Gauge
-	CampaignLinkWrong          m.Gauge
-	UnknownService             m.Gauge
-	ContentDeliveryErrors      m.Gauge
-	IPNotFoundError            m.Gauge
-	MsisdnNotFoundError        m.Gauge
-	NotSupported               m.Gauge
-	OperatorNameError          m.Gauge
-	NotifyNewSubscriptionError m.Gauge
-	NotifyError                m.Gauge
-)
+	PageNotFoundError     = NewGauge("error404", "404 requests")
+	Rejected              = NewGauge("truly_rejected", "no more campaigns for msisdn - rejected")
+	CampaignHashWrong     = NewGauge("campaign_hash_wrong", "campaign hash wrong")
+	CampaignLinkWrong     = NewGauge("campaign_link_wrong", "campaign link wrong")
+	UnknownService        = NewGauge("unknown_service", "unknown service")
+	ContentDeliveryErrors = NewGauge("serve_errors", "content delivery errors")
 
-func newGaugeCommon(name, help string) m.Gauge {
-	return m.NewGauge("", appName, name, ""+help)
-}
-func newGaugeGatherErrors(name, help string) m.Gauge {
-	return m.NewGauge("", appName, name, ""+help)
-}
+	IPNotFoundError            = NewGauge("ip_not_found", "ip not found")
+	MsisdnNotFoundError        = NewGauge("msisdn_not_found", "msisdn not found")
+	NotSupported               = NewGauge("not_supported", " operator is not supported")
+	OperatorNameError          = NewGauge("operator_name", "cannot determine operator name by code")
+	NotifyNewSubscriptionError = NewGauge("notify_new_subscription_error", "cannot notify new subscription")
+	NotifyError                = NewGauge("notify_error", "cannot notify")
+	AccessLogErrors            = NewGauge("access_log_errors", "cannot write the access log")
+	ArchiveErrors              = NewGauge("archive_errors", "cannot write event to the local archive")
+	AccessAggregated           = NewGauge("access_aggregated", "raw access events not sent: counted in access summary")
+
+	PostbackSent             = NewGauge("postback_sent", "publisher postback sent")
+	PostbackErrors           = NewGauge("postback_errors", "publisher postback failed after retries")
+	PostbackDuplicate        = NewGauge("postback_duplicate", "publisher postback skipped: pixel already sent")
+	PostbackUnknownPublisher = NewGauge("postback_unknown_publisher", "no postback configured for publisher")
+
+	BreakerState         = NewGaugeVec("breaker_state", "circuit breaker state: 0 - closed, 1 - half open, 2 - open", "upstream")
+	BreakerRejected      = NewCounterVec("breaker_rejected_total", "calls not made: circuit breaker open", "upstream", "call")
+	ContentFallback      = NewGauge("content_fallback", "campaign fallback content served: contentd unavailable")
+	ServiceCacheFallback = NewGauge("service_cache_fallback", "cached service used: mid unavailable")
+
+	AnomalyAlerts        = NewGauge("anomaly_alerts", "conversion anomaly alerts, including resolved")
+	AnomalyWebhookErrors = NewGauge("anomaly_webhook_errors", "cannot send anomaly alert to the webhook")
+
+	StoreCacheHits    = NewGauge("store_cache_hits", "content served from the local disk cache")
+	StoreCacheMisses  = NewGauge("store_cache_misses", "content not in the local disk cache")
+	StoreCacheEvicted = NewGauge("store_cache_evicted", "content removed from the local disk cache")
+
+	SignedLinkExpired  = NewGauge("signed_link_expired", "expired signed download link opened")
+	SignedLinkInvalid  = NewGauge("signed_link_invalid", "signed download link rejected: malformed, wrong signature or msisdn")
+	SignedLinkUnsigned = NewGauge("signed_link_unsigned", "unsigned link sent before the signed links accepted: grace period")
+
+	DownloadQuotaExceeded = NewGauge("download_quota_exceeded", "unique url downloaded more than allowed")
+	DownloadRateLimited   = NewGauge("download_rate_limited", "link request rejected: too many requests of the ip")
+	DownloadBanned        = NewGauge("download_banned", "link request rejected: the ip is banned")
+	DownloadBans          = NewGauge("download_bans", "ip banned after invalid links")
+
+	ContentVariants      = NewGauge("content_variants", "content sent as a rendition or a resized image")
+	ImageResizeErrors    = NewGauge("image_resize_errors", "image not resized, original sent")
+	ImageResizeOversized = NewGauge("image_resize_oversized", "image over max_megapixels not resized, original sent")
+
+	HistoryViews     = NewGauge("history_views", "my content page opened")
+	HistoryDownloads = NewGauge("history_downloads", "content downloaded again from my content page")
+	HistoryPinSent   = NewGauge("history_pin_sent", "my content login pin sent")
+	HistoryPinWrong  = NewGauge("history_pin_wrong", "my content login with a wrong or expired pin")
+
+	DownloadsActive   = NewGaugeVec("downloads_active", "content downloads sent now and waiting for a slot", "state")
+	DownloadBytes     = NewCounterVec("download_bytes_total", "content bytes sent by the download routes", "route")
+	DownloadsRejected = NewGauge("downloads_rejected", "download rejected with 503: too many downloads")
+
+	ContentLinksIssued = NewGauge("content_links_issued", "content url and sms text issued by the link api")
+	ContentLinkErrors  = NewGauge("content_link_errors", "link api request rejected or failed")
+)
 
 var appName string
 
 func Init(name string) {
 	appName = name
-
-	Success = m.NewGauge("", "", "success", "success overall")
-	Errors = m.NewGauge("", "", "errors", "errors overall")
-	Incoming = newGaugeCommon("incoming", "overall")
-	Agree = newGaugeCommon("agreed", "pressed the button 'agree'")
-	Redirected = newGaugeCommon("redirected", "redirected due to rejected")
-	AgreeSuccess = newGaugeCommon("agree_success", "pressed the button 'agree' and successfully processed")
-	CampaignAccess = newGaugeCommon("campaign_access", "campaign access success")
-	ContentGetSuccess = newGaugeCommon("content_get", "pressed the button 'get content' and successfully processed")
-	RandomContentGet = newGaugeCommon("random_content_get", "get random content from the url /u/get")
-	UniqueUrlGet = newGaugeCommon("unique_url_get", "get the uniq url from the sms")
-	TrafficRedirectSuccess = newGaugeCommon("traffic_redirect_success", "traffic redirect success")
-
-	PageNotFoundError = newGaugeCommon("error404", "404 requests")
-	Rejected = newGaugeCommon("truly_rejected", "no more campaigns for msisdn - rejected")
-	CampaignHashWrong = newGaugeCommon("campaign_hash_wrong", "campaign hash wrong")
-	CampaignLinkWrong = newGaugeCommon("campaign_link_wrong", "campaign link wrong")
-	UnknownService = newGaugeCommon("unknown_service", "unknown service")
-	ContentDeliveryErrors = newGaugeCommon("serve_errors", "content delivery errors")
-
-	IPNotFoundError = newGaugeGatherErrors("ip_not_found", "ip not found")
-	MsisdnNotFoundError = newGaugeGatherErrors("msisdn_not_found", "msisdn not found")
-	NotSupported = newGaugeGatherErrors("not_supported", " operator is not supported")
-	OperatorNameError = newGaugeGatherErrors("operator_name", "cannot determine operator name by code")
-	NotifyNewSubscriptionError = newGaugeCommon("notify_new_subscription_error", "cannot notify new subscription")
-	NotifyError = newGaugeCommon("notify_error", "cannot notify")
-	go func() {
-		for range time.Tick(time.Minute) {
-			Success.Update()
-			Errors.Update()
-			Incoming.Update()
-			Agree.Update()
-			Redirected.Update()
-			AgreeSuccess.Update()
-			CampaignAccess.Update()
-			ContentGetSuccess.Update()
-			RandomContentGet.Update()
-			UniqueUrlGet.Update()
-			TrafficRedirectSuccess.Update()
-
-			PageNotFoundError.Update()
-			Rejected.Update()
-			CampaignHashWrong.Update()
-			CampaignLinkWrong.Update()
-			UnknownService.Update()
-			ContentDeliveryErrors.Update()
-			IPNotFoundError.Update()
-			MsisdnNotFoundError.Update()
-			NotSupported.Update()
-			OperatorNameError.Update()
-			NotifyNewSubscriptionError.Update()
-			NotifyError.Update()
-		}
-	}()
+	startRegistry(name)
 }
@@ -0,0 +1,220 @@
+package metrics
+
+// metrics register themselves when declared:
+//
+//	var Agree = NewGauge("agreed", "pressed the button 'agree'")
+//
+// Init creates the registered metrics under the app name
+// and runs the minute rollup of every gauge, metrics declared later
+// are created on registration. /metrics/registry lists everything registered
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+
+	m "github.com/linkit360/go-utils/metrics"
+)
+
+const (
+	KindCounter   = "counter"
+	KindGauge     = "gauge"
+	KindHistogram = "histogram"
+)
+
+type Desc struct {
+	Name   string   `json:"name"`
+	Help   string   `json:"help"`
+	Kind   string   `json:"kind"`
+	Labels []string `json:"labels,omitempty"`
+	// overall metrics are not prefixed with the app name
+	Overall bool `json:"-"`
+}
+
+type metric interface {
+	desc() Desc
+	create(appName string)
+	rollup()
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics []metric
+	appName string
+	started bool
+}{}
+
+func register(mt metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.metrics = append(registry.metrics, mt)
+	if registry.started {
+		mt.create(registry.appName)
+	}
+}
+
+func startRegistry(name string) {
+	registry.Lock()
+	if registry.started {
+		registry.Unlock()
+		return
+	}
+	registry.appName = name
+	registry.started = true
+	for _, mt := range registry.metrics {
+		mt.create(name)
+	}
+	registry.Unlock()
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			rollup()
+		}
+	}()
+}
+
+func rollup() {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, mt := range registry.metrics {
+		mt.rollup()
+	}
+}
+
+// Registered lists the registered metrics with the full names
+func Registered() []Desc {
+	registry.Lock()
+	defer registry.Unlock()
+	res := make([]Desc, 0, len(registry.metrics))
+	for _, mt := range registry.metrics {
+		d := mt.desc()
+		d.Name = fullName(d, registry.appName)
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// AddHandler serves the prometheus exposition on /metrics
+// and the list of registered metrics on /metrics/registry
+func AddHandler(e *gin.Engine) {
+	m.AddHandler(e)
+	e.GET("/metrics/registry", func(c *gin.Context) {
+		c.JSON(200, Registered())
+	})
+}
+
+func fullName(d Desc, appName string) string {
+	if d.Overall || appName == "" {
+		return d.Name
+	}
+	return appName + "_" + d.Name
+}
+
+func subsystem(d Desc, appName string) string {
+	if d.Overall {
+		return ""
+	}
+	return appName
+}
+
+// Gauge counts events and is set to the minute count on rollup
+type Gauge struct {
+	m.Gauge
+	d Desc
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{d: Desc{Name: name, Help: help, Kind: KindGauge}}
+	register(g)
+	return g
+}
+
+// NewOverallGauge is not prefixed with the app name
+func NewOverallGauge(name, help string) *Gauge {
+	g := &Gauge{d: Desc{Name: name, Help: help, Kind: KindGauge, Overall: true}}
+	register(g)
+	return g
+}
+
+func (g *Gauge) desc() Desc { return g.d }
+func (g *Gauge) create(appName string) {
+	g.Gauge = m.NewGauge("", subsystem(g.d, appName), g.d.Name, g.d.Help)
+}
+func (g *Gauge) rollup() { g.Update() }
+
+type CounterVec struct {
+	*prometheus.CounterVec
+	d Desc
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{d: Desc{Name: name, Help: help, Kind: KindCounter, Labels: labels}}
+	register(cv)
+	return cv
+}
+
+func (cv *CounterVec) desc() Desc { return cv.d }
+func (cv *CounterVec) create(appName string) {
+	cv.CounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: subsystem(cv.d, appName),
+		Name:      cv.d.Name,
+		Help:      cv.d.Help,
+	}, cv.d.Labels)
+	prometheus.MustRegister(cv.CounterVec)
+}
+func (cv *CounterVec) rollup() {}
+
+type GaugeVec struct {
+	*prometheus.GaugeVec
+	d Desc
+}
+
+// NewGaugeVec is set directly, it has no minute rollup
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	gv := &GaugeVec{d: Desc{Name: name, Help: help, Kind: KindGauge, Labels: labels}}
+	register(gv)
+	return gv
+}
+
+func (gv *GaugeVec) desc() Desc { return gv.d }
+func (gv *GaugeVec) create(appName string) {
+	gv.GaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: subsystem(gv.d, appName),
+		Name:      gv.d.Name,
+		Help:      gv.d.Help,
+	}, gv.d.Labels)
+	prometheus.MustRegister(gv.GaugeVec)
+}
+func (gv *GaugeVec) rollup() {}
+
+type HistogramVec struct {
+	*prometheus.HistogramVec
+	d       Desc
+	buckets []float64
+}
+
+// NewHistogramVec uses the prometheus default buckets when buckets is nil
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = prometheus.DefBuckets
+	}
+	hv := &HistogramVec{d: Desc{Name: name, Help: help, Kind: KindHistogram, Labels: labels}, buckets: buckets}
+	register(hv)
+	return hv
+}
+
+func (hv *HistogramVec) desc() Desc { return hv.d }
+func (hv *HistogramVec) create(appName string) {
+	hv.HistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: subsystem(hv.d, appName),
+		Name:      hv.d.Name,
+		Help:      hv.d.Help,
+		Buckets:   hv.buckets,
+	}, hv.d.Labels)
+	prometheus.MustRegister(hv.HistogramVec)
+}
+func (hv *HistogramVec) rollup() {}
@@ -0,0 +1,22 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	Init("dispatcherd_test")
+	late := NewCounterVec("registry_test_total", "registered after init", "label")
+	late.WithLabelValues("value").Inc()
+
+	byName := make(map[string]Desc)
+	for _, d := range Registered() {
+		byName[d.Name] = d
+	}
+	assert.Equal(t, KindGauge, byName["success"].Kind, "overall gauge keeps its name")
+	assert.Equal(t, KindGauge, byName["dispatcherd_test_agreed"].Kind, "app gauge")
+	assert.Equal(t, KindHistogram, byName["dispatcherd_test_request_duration_seconds"].Kind, "histogram")
+	assert.Equal(t, []string{"label"}, byName["dispatcherd_test_registry_test_total"].Labels, "late registration")
+}
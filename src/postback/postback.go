@@ -0,0 +1,394 @@
+package postback
+
+// server-to-server postbacks to publishers on conversion
+// publisher is taken from the aff_pr session value, click id is the pixel (aff_sub)
+// url template macros: {click_id}, {tid}, {campaign_id}, {operator_code}, {payout}
+// the postbacks not delivered yet are saved to pending_path on exit and queued again on start
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+type PostbackConfig struct {
+	Enabled     bool                       `yaml:"enabled"`
+	Workers     int                        `yaml:"workers" default:"4"`
+	QueueSize   int                        `yaml:"queue_size" default:"1000"`
+	Timeout     int                        `yaml:"timeout" default:"10"`
+	Retries     int                        `yaml:"retries" default:"3"`
+	BackoffSec  int                        `yaml:"backoff_sec" default:"5"`
+	DedupHours  int                        `yaml:"dedup_hours" default:"72"`
+	DedupPath   string                     `yaml:"dedup_path"`
+	PendingPath string                     `yaml:"pending_path"`
+	LogPath     string                     `yaml:"log_path"`
+	Publishers  map[string]PublisherConfig `yaml:"publishers"`
+}
+
+type PublisherConfig struct {
+	Url    string `yaml:"url"`
+	Payout string `yaml:"payout"`
+}
+
+type Conversion struct {
+	Tid          string
+	Publisher    string
+	Pixel        string
+	CampaignId   string
+	OperatorCode int64
+}
+
+// one line in the delivery log
+type Delivery struct {
+	Tid       string    `json:"tid"`
+	Publisher string    `json:"publisher"`
+	Pixel     string    `json:"pixel"`
+	Url       string    `json:"url"`
+	Attempt   int       `json:"attempt"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+type postback struct {
+	Conversion
+	Url string
+	// the attempts made
+	Attempt int
+}
+
+var conf PostbackConfig
+var queue chan postback
+var sent *cache.Cache
+var httpClient http.Client
+var deliveryLog *os.File
+var deliveryLogMutex sync.Mutex
+
+// queued or retried postbacks by publisher and pixel
+var pending map[string]postback
+var pendingMutex sync.Mutex
+
+func Init(postbackConf PostbackConfig) {
+	conf = postbackConf
+	if !conf.Enabled {
+		return
+	}
+	httpClient = http.Client{
+		Timeout: time.Duration(conf.Timeout) * time.Second,
+	}
+	loadState()
+
+	if conf.LogPath != "" {
+		var err error
+		deliveryLog, err = os.OpenFile(conf.LogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+				"path":  conf.LogPath,
+			}).Error("cannot open postback delivery log")
+		}
+	}
+
+	pending = make(map[string]postback)
+	queue = make(chan postback, conf.QueueSize)
+	for i := 0; i < conf.Workers; i++ {
+		go func() {
+			for pb := range queue {
+				deliver(pb)
+			}
+		}()
+	}
+	loadPending()
+	log.WithFields(log.Fields{
+		"publishers": len(conf.Publishers),
+	}).Info("postback init")
+}
+
+// Send queues the postback for the conversion publisher
+// the pixel posted back or being posted back is not queued again,
+// the one given up after the retries is
+func Send(cv Conversion) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if cv.Publisher == "" || cv.Pixel == "" {
+		return nil
+	}
+	publisher, ok := conf.Publishers[cv.Publisher]
+	if !ok {
+		m.PostbackUnknownPublisher.Inc()
+		return fmt.Errorf("unknown publisher: %s", cv.Publisher)
+	}
+
+	pb := postback{
+		Conversion: cv,
+		Url:        expand(publisher, cv),
+	}
+	if _, ok := sent.Get(pendingKey(pb)); ok || !setPending(pb) {
+		m.PostbackDuplicate.Inc()
+		log.WithFields(log.Fields{
+			"tid":       cv.Tid,
+			"publisher": cv.Publisher,
+			"pixel":     cv.Pixel,
+		}).Debug("postback already sent")
+		return nil
+	}
+	select {
+	case queue <- pb:
+	default:
+		setDone(pb)
+		m.PostbackErrors.Inc()
+		return fmt.Errorf("postback queue is full: %d", len(queue))
+	}
+	return nil
+}
+
+func pendingKey(pb postback) string {
+	return pb.Publisher + "-" + pb.Pixel
+}
+
+// setPending is false when the postback is pending already
+func setPending(pb postback) bool {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	if _, ok := pending[pendingKey(pb)]; ok {
+		return false
+	}
+	pending[pendingKey(pb)] = pb
+	return true
+}
+
+// setRetry keeps the attempts made for the pending postbacks saved on exit
+func setRetry(pb postback) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	pending[pendingKey(pb)] = pb
+}
+
+func setDone(pb postback) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	delete(pending, pendingKey(pb))
+}
+
+func expand(publisher PublisherConfig, cv Conversion) string {
+	r := strings.NewReplacer(
+		"{click_id}", url.QueryEscape(cv.Pixel),
+		"{tid}", url.QueryEscape(cv.Tid),
+		"{campaign_id}", url.QueryEscape(cv.CampaignId),
+		"{operator_code}", strconv.FormatInt(cv.OperatorCode, 10),
+		"{payout}", url.QueryEscape(publisher.Payout),
+	)
+	return r.Replace(publisher.Url)
+}
+
+// deliver makes one attempt, the retry is queued again after the backoff
+// so a dead publisher does not hold the workers
+func deliver(pb postback) {
+	pb.Attempt++
+	d := Delivery{
+		Tid:       pb.Tid,
+		Publisher: pb.Publisher,
+		Pixel:     pb.Pixel,
+		Url:       pb.Url,
+		Attempt:   pb.Attempt,
+		SentAt:    time.Now().UTC(),
+	}
+	err := get(pb.Url, &d)
+	writeDelivery(d)
+	if err == nil {
+		m.PostbackSent.Inc()
+		sent.SetDefault(pendingKey(pb), pb.Tid)
+		setDone(pb)
+		log.WithFields(log.Fields{
+			"tid":       pb.Tid,
+			"publisher": pb.Publisher,
+			"attempt":   pb.Attempt,
+		}).Info("postback sent")
+		return
+	}
+	log.WithFields(log.Fields{
+		"tid":       pb.Tid,
+		"publisher": pb.Publisher,
+		"attempt":   pb.Attempt,
+		"error":     err.Error(),
+	}).Error("postback")
+	if pb.Attempt > conf.Retries {
+		m.PostbackErrors.Inc()
+		setDone(pb)
+		return
+	}
+	setRetry(pb)
+	backoff := time.Duration(conf.BackoffSec) * time.Second << uint(pb.Attempt-1)
+	time.AfterFunc(backoff, func() {
+		queue <- pb
+	})
+}
+
+func get(postbackUrl string, d *Delivery) (err error) {
+	defer func() {
+		if err != nil {
+			d.Error = err.Error()
+		}
+	}()
+	begin := time.Now()
+	resp, err := httpClient.Get(postbackUrl)
+	m.ObserveUpstream("postback", d.Publisher, time.Since(begin), err)
+	if err != nil {
+		err = fmt.Errorf("httpClient.Get: %s", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	d.Status = resp.StatusCode
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("status: %s", resp.Status)
+	}
+	return
+}
+
+func writeDelivery(d Delivery) {
+	if deliveryLog == nil {
+		return
+	}
+	line, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	deliveryLogMutex.Lock()
+	defer deliveryLogMutex.Unlock()
+	if _, err := deliveryLog.Write(append(line, '\n')); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("write postback delivery log")
+	}
+}
+
+func loadState() {
+	expiration := time.Duration(conf.DedupHours) * time.Hour
+	if conf.DedupPath == "" {
+		sent = cache.New(expiration, time.Minute)
+		return
+	}
+	data, err := ioutil.ReadFile(conf.DedupPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Debug("load postback state")
+		sent = cache.New(expiration, time.Minute)
+		return
+	}
+	var items map[string]cache.Item
+	if err = json.Unmarshal(data, &items); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("load postback state")
+		sent = cache.New(expiration, time.Minute)
+		return
+	}
+	sent = cache.NewFrom(expiration, time.Minute, items)
+	log.WithFields(log.Fields{
+		"len": len(items),
+	}).Debug("load postback state")
+}
+
+func SaveState() {
+	if !conf.Enabled {
+		return
+	}
+	savePending()
+	if conf.DedupPath == "" {
+		return
+	}
+	data, err := json.Marshal(sent.Items())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": fmt.Errorf("json.Marshal: %s", err.Error()),
+		}).Error("postback save state")
+		return
+	}
+	if err := ioutil.WriteFile(conf.DedupPath, data, 0666); err != nil {
+		log.WithFields(log.Fields{
+			"error": fmt.Errorf("ioutil.WriteFile: %s", err.Error()),
+		}).Error("postback save state")
+		return
+	}
+	log.WithFields(log.Fields{
+		"len": len(sent.Items()),
+	}).Info("postback save state ok")
+}
+
+// loadPending queues the postbacks left undelivered on the last exit
+func loadPending() {
+	if conf.PendingPath == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(conf.PendingPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Debug("load pending postbacks")
+		return
+	}
+	var pbs []postback
+	if err = json.Unmarshal(data, &pbs); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("load pending postbacks")
+		return
+	}
+	for _, pb := range pbs {
+		setPending(pb)
+	}
+	// the workers take them as the queue frees up
+	go func() {
+		for _, pb := range pbs {
+			queue <- pb
+		}
+	}()
+	log.WithFields(log.Fields{
+		"len": len(pbs),
+	}).Info("load pending postbacks")
+}
+
+func savePending() {
+	if conf.PendingPath == "" {
+		return
+	}
+	pendingMutex.Lock()
+	pbs := make([]postback, 0, len(pending))
+	for _, pb := range pending {
+		pbs = append(pbs, pb)
+	}
+	pendingMutex.Unlock()
+
+	data, err := json.Marshal(pbs)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": fmt.Errorf("json.Marshal: %s", err.Error()),
+		}).Error("postback save pending")
+		return
+	}
+	if err := ioutil.WriteFile(conf.PendingPath, data, 0666); err != nil {
+		log.WithFields(log.Fields{
+			"error": fmt.Errorf("ioutil.WriteFile: %s", err.Error()),
+		}).Error("postback save pending")
+		return
+	}
+	log.WithFields(log.Fields{
+		"len": len(pbs),
+	}).Info("postback save pending ok")
+}
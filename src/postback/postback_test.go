@@ -0,0 +1,189 @@
+package postback
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+func TestMain(t *testing.M) {
+	m.Init("dispatcherd_test")
+	os.Exit(t.Run())
+}
+
+// publisher answers with the statuses in turn, the last one from then on
+type publisher struct {
+	sync.Mutex
+	statuses []int
+	urls     []string
+}
+
+func (p *publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+	p.urls = append(p.urls, r.URL.String())
+	status := p.statuses[0]
+	if len(p.statuses) > 1 {
+		p.statuses = p.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (p *publisher) calls() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.urls)
+}
+
+func initPostback(t *testing.T, p *publisher, retries int) *httptest.Server {
+	server := httptest.NewServer(p)
+	Init(PostbackConfig{
+		Enabled:    true,
+		Workers:    1,
+		QueueSize:  10,
+		Timeout:    1,
+		Retries:    retries,
+		DedupHours: 1,
+		Publishers: map[string]PublisherConfig{
+			"pub": {Url: server.URL + "/conv?click_id={click_id}&operator={operator_code}"},
+		},
+	})
+	return server
+}
+
+func waitDelivered(t *testing.T) {
+	assert.Eventually(t, func() bool {
+		pendingMutex.Lock()
+		defer pendingMutex.Unlock()
+		return len(pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSend(t *testing.T) {
+	p := &publisher{statuses: []int{200}}
+	server := initPostback(t, p, 0)
+	defer server.Close()
+
+	assert.NoError(t, Send(Conversion{Tid: "t1", Publisher: "pub", Pixel: "px 1", OperatorCode: 41001}))
+	waitDelivered(t)
+	assert.Equal(t, []string{"/conv?click_id=px+1&operator=41001"}, p.urls)
+
+	err := Send(Conversion{Tid: "t1", Publisher: "unknown", Pixel: "px"})
+	assert.Error(t, err)
+}
+
+func TestRetry(t *testing.T) {
+	p := &publisher{statuses: []int{500, 502, 200}}
+	server := initPostback(t, p, 3)
+	defer server.Close()
+
+	assert.NoError(t, Send(Conversion{Tid: "t1", Publisher: "pub", Pixel: "px"}))
+	waitDelivered(t)
+	assert.Equal(t, 3, p.calls(), "retried until success")
+}
+
+func TestGiveUp(t *testing.T) {
+	p := &publisher{statuses: []int{500}}
+	server := initPostback(t, p, 2)
+	defer server.Close()
+
+	assert.NoError(t, Send(Conversion{Tid: "t1", Publisher: "pub", Pixel: "px"}))
+	waitDelivered(t)
+	assert.Equal(t, 3, p.calls(), "the first attempt and two retries")
+
+	// given up: not taken for sent
+	p.Lock()
+	p.statuses = []int{200}
+	p.Unlock()
+	assert.NoError(t, Send(Conversion{Tid: "t2", Publisher: "pub", Pixel: "px"}))
+	waitDelivered(t)
+	assert.Equal(t, 4, p.calls())
+	assert.NoError(t, Send(Conversion{Tid: "t3", Publisher: "pub", Pixel: "px"}))
+	waitDelivered(t)
+	assert.Equal(t, 4, p.calls(), "sent")
+}
+
+func TestRetryBackoff(t *testing.T) {
+	dead := &publisher{statuses: []int{500}}
+	deadServer := httptest.NewServer(dead)
+	defer deadServer.Close()
+	alive := &publisher{statuses: []int{200}}
+	aliveServer := httptest.NewServer(alive)
+	defer aliveServer.Close()
+	Init(PostbackConfig{
+		Enabled:    true,
+		Workers:    1,
+		QueueSize:  10,
+		Timeout:    1,
+		Retries:    1,
+		BackoffSec: 60,
+		DedupHours: 1,
+		Publishers: map[string]PublisherConfig{
+			"dead":  {Url: deadServer.URL + "/conv?click_id={click_id}"},
+			"alive": {Url: aliveServer.URL + "/conv?click_id={click_id}"},
+		},
+	})
+
+	assert.NoError(t, Send(Conversion{Tid: "t1", Publisher: "dead", Pixel: "px"}))
+	assert.Eventually(t, func() bool { return dead.calls() == 1 }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, Send(Conversion{Tid: "t2", Publisher: "alive", Pixel: "px"}))
+	assert.Eventually(t, func() bool { return alive.calls() == 1 }, time.Second, 10*time.Millisecond,
+		"the worker is not held by the backoff")
+
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	assert.Equal(t, 1, pending["dead-px"].Attempt, "waits for the retry")
+}
+
+func TestDedup(t *testing.T) {
+	p := &publisher{statuses: []int{200}}
+	server := initPostback(t, p, 0)
+	defer server.Close()
+
+	assert.NoError(t, Send(Conversion{Tid: "t1", Publisher: "pub", Pixel: "px"}))
+	assert.NoError(t, Send(Conversion{Tid: "t2", Publisher: "pub", Pixel: "px"}))
+	assert.NoError(t, Send(Conversion{Tid: "t3", Publisher: "pub", Pixel: "other"}))
+	waitDelivered(t)
+	assert.Equal(t, 2, p.calls(), "one postback a publisher and pixel")
+}
+
+func TestPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postback")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pendingPath := filepath.Join(dir, "pending.json")
+
+	p := &publisher{statuses: []int{200}}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	// not delivered before the exit
+	conf = PostbackConfig{Enabled: true, PendingPath: pendingPath}
+	pending = map[string]postback{}
+	setPending(postback{
+		Conversion: Conversion{Tid: "t1", Publisher: "pub", Pixel: "px"},
+		Url:        server.URL + "/conv?click_id=px",
+	})
+	SaveState()
+
+	Init(PostbackConfig{
+		Enabled:     true,
+		Workers:     1,
+		QueueSize:   10,
+		Timeout:     1,
+		DedupHours:  1,
+		PendingPath: pendingPath,
+	})
+	assert.Eventually(t, func() bool { return p.calls() == 1 }, time.Second, 10*time.Millisecond)
+	waitDelivered(t)
+	assert.Equal(t, []string{"/conv?click_id=px"}, p.urls)
+}
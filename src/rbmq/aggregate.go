@@ -0,0 +1,133 @@
+package rbmq
+
+// aggregation of access events
+// access_campaign events and the configured user actions (by default "access")
+// are counted per campaign, operator, publisher and outcome
+// and sent as one access_summary event every interval
+// raw events are still sent for the sampled part of the traffic
+// all other events (new subscriptions, autoclicks, content etc) are never aggregated
+
+import (
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+const EventAccessSummary = "access_summary"
+
+type AggregationConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	IntervalSec int      `default:"60" yaml:"interval_sec"`
+	SampleRate  float64  `default:"0.01" yaml:"sample_rate"`
+	Actions     []string `yaml:"actions"`
+}
+
+type summaryKey struct {
+	Event        string `json:"event"`
+	CampaignId   string `json:"campaign_id,omitempty"`
+	OperatorCode int64  `json:"operator_code,omitempty"`
+	Publisher    string `json:"publisher,omitempty"`
+	Outcome      string `json:"outcome"`
+}
+
+type SummaryRow struct {
+	summaryKey
+	Count int64 `json:"count"`
+}
+
+type AccessSummary struct {
+	From time.Time    `json:"from"`
+	To   time.Time    `json:"to"`
+	Rows []SummaryRow `json:"rows"`
+}
+
+type aggregator struct {
+	conf    AggregationConfig
+	actions map[string]struct{}
+	mu      sync.Mutex
+	from    time.Time
+	counts  map[summaryKey]int64
+}
+
+func newAggregator(conf AggregationConfig) *aggregator {
+	if len(conf.Actions) == 0 {
+		conf.Actions = []string{"access"}
+	}
+	a := &aggregator{
+		conf:    conf,
+		actions: make(map[string]struct{}, len(conf.Actions)),
+		from:    time.Now().UTC(),
+		counts:  make(map[summaryKey]int64),
+	}
+	for _, action := range conf.Actions {
+		a.actions[action] = struct{}{}
+	}
+	return a
+}
+
+func (a *aggregator) run(send func(AccessSummary)) {
+	for range time.Tick(time.Duration(a.conf.IntervalSec) * time.Second) {
+		summary := a.flush()
+		if len(summary.Rows) > 0 {
+			send(summary)
+		}
+	}
+}
+
+func (a *aggregator) aggregated(action string) bool {
+	_, ok := a.actions[action]
+	return ok
+}
+
+// add counts the event and reports whether the raw event must be dropped
+func (a *aggregator) add(key summaryKey) (drop bool) {
+	a.mu.Lock()
+	a.counts[key]++
+	a.mu.Unlock()
+
+	if rand.Float64() < a.conf.SampleRate {
+		return false
+	}
+	m.AccessAggregated.Inc()
+	return true
+}
+
+func (a *aggregator) flush() (summary AccessSummary) {
+	a.mu.Lock()
+	counts := a.counts
+	summary.From = a.from
+	a.counts = make(map[summaryKey]int64, len(counts))
+	a.from = time.Now().UTC()
+	a.mu.Unlock()
+
+	summary.To = a.from
+	summary.Rows = make([]SummaryRow, 0, len(counts))
+	for key, count := range counts {
+		summary.Rows = append(summary.Rows, SummaryRow{summaryKey: key, Count: count})
+	}
+	log.WithFields(log.Fields{
+		"rows": len(summary.Rows),
+	}).Debug("access summary")
+	return
+}
+
+func outcome(err string) string {
+	if err == "" {
+		return "ok"
+	}
+	return "error"
+}
+
+// publisher of the landing hit is taken from the aff_pr url parameter
+func publisherFromUrl(urlPath string) string {
+	u, err := url.Parse(urlPath)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("aff_pr")
+}
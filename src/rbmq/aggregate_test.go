@@ -0,0 +1,42 @@
+package rbmq
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+func TestMain(t *testing.M) {
+	m.Init("dispatcherd_test")
+	os.Exit(t.Run())
+}
+
+func TestAggregatorFlush(t *testing.T) {
+	a := newAggregator(AggregationConfig{IntervalSec: 60, SampleRate: 0})
+	assert.True(t, a.aggregated("access"), "access is aggregated by default")
+	assert.False(t, a.aggregated("autoclick"), "autoclick is sent raw")
+
+	key := summaryKey{Event: EventAccessCampaign, CampaignId: "290", OperatorCode: 41001, Publisher: "mobusi", Outcome: "ok"}
+	assert.True(t, a.add(key), "not sampled: dropped")
+	assert.True(t, a.add(key), "not sampled: dropped")
+	a.add(summaryKey{Event: EventAccessCampaign, CampaignId: "290", OperatorCode: 41001, Outcome: "error"})
+
+	summary := a.flush()
+	assert.Len(t, summary.Rows, 2, "rows")
+	for _, row := range summary.Rows {
+		if row.Outcome == "ok" {
+			assert.Equal(t, int64(2), row.Count, "ok count")
+		} else {
+			assert.Equal(t, int64(1), row.Count, "error count")
+		}
+	}
+	assert.Empty(t, a.flush().Rows, "counters reset")
+
+	sampled := newAggregator(AggregationConfig{SampleRate: 1})
+	assert.False(t, sampled.add(key), "sampled: raw event kept")
+
+	assert.Equal(t, "mobusi", publisherFromUrl("/lp/mobilink-p2?aff_pr=mobusi&aff_sub=1"), "publisher")
+}
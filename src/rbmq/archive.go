@@ -0,0 +1,167 @@
+package rbmq
+
+// local archive of published events
+// every event is written once (before fan-out) as a json line,
+// files are rotated by size and by time
+// the archive is read back by the replay command
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-dispatcherd/src/utils"
+)
+
+type ArchiveConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	Path          string `default:"/home/centos/linkit/events/" yaml:"path"`
+	RotateMB      int64  `default:"100" yaml:"rotate_mb"`
+	RotateMinutes int    `default:"60" yaml:"rotate_minutes"`
+}
+
+type ArchivedEvent struct {
+	Time         time.Time       `json:"time"`
+	Route        string          `json:"route"`
+	OperatorCode int64           `json:"operator_code,omitempty"`
+	CampaignId   string          `json:"campaign_id,omitempty"`
+	Tid          string          `json:"tid,omitempty"`
+	Queues       []string        `json:"queues"`
+	EventName    string          `json:"event_name"`
+	Body         json.RawMessage `json:"body"`
+	// amqp headers: the trace context
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type Archive struct {
+	file *utils.RotatingFile
+}
+
+const archivePrefix = "events-"
+const archiveSuffix = ".jsonl"
+
+func NewArchive(conf ArchiveConfig) (*Archive, error) {
+	file, err := utils.NewRotatingFile(conf.Path, archivePrefix, archiveSuffix,
+		conf.RotateMB<<20, time.Duration(conf.RotateMinutes)*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	return &Archive{file: file}, nil
+}
+
+func (a *Archive) Write(ev ArchivedEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+	return a.file.Write(append(line, '\n'), ev.Time)
+}
+
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
+
+type ArchiveFilter struct {
+	From  time.Time
+	To    time.Time
+	Route string
+	// the user actions are published under the action name on the user_actions route
+	EventName string
+	Queue     string
+	Tid       string
+}
+
+func (f ArchiveFilter) Match(ev ArchivedEvent) bool {
+	if !f.From.IsZero() && ev.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !ev.Time.Before(f.To) {
+		return false
+	}
+	if f.Route != "" && f.Route != ev.Route {
+		return false
+	}
+	if f.EventName != "" && f.EventName != ev.EventName {
+		return false
+	}
+	if f.Tid != "" && f.Tid != ev.Tid {
+		return false
+	}
+	if f.Queue == "" {
+		return true
+	}
+	for _, q := range ev.Queues {
+		if q == f.Queue {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadArchive calls fn for every archived event matching the filter,
+// files are read in the order they were written
+// the lines that are not an event (i.e. cut by a crash) are skipped and counted
+func ReadArchive(path string, filter ArchiveFilter, fn func(ArchivedEvent) error) (skipped int, err error) {
+	files, err := filepath.Glob(filepath.Join(path, archivePrefix+"*"+archiveSuffix))
+	if err != nil {
+		return 0, fmt.Errorf("filepath.Glob: %s", err.Error())
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		n, err := readArchiveFile(name, filter, fn)
+		skipped += n
+		if err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+func readArchiveFile(name string, filter ArchiveFilter, fn func(ArchivedEvent) error) (skipped int, err error) {
+	// the whole file is after the range: the file name is the time of its first event
+	if !filter.To.IsZero() {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), archivePrefix), archiveSuffix)
+		if openedAt, err := time.Parse(utils.RotateTimeFormat, stamp); err == nil && !openedAt.Before(filter.To) {
+			return 0, nil
+		}
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, fmt.Errorf("os.Open: %s", err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var ev ArchivedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			skipped++
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+				"file":  name,
+				"line":  line,
+			}).Warn("archive: skip the line")
+			continue
+		}
+		if !filter.Match(ev) {
+			continue
+		}
+		if err := fn(ev); err != nil {
+			return skipped, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return skipped, fmt.Errorf("scanner.Err: %s, file %s", err.Error(), name)
+	}
+	return skipped, nil
+}
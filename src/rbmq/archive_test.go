@@ -0,0 +1,78 @@
+package rbmq
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.NoError(t, err, "temp dir")
+	defer os.RemoveAll(dir)
+
+	archive, err := NewArchive(ArchiveConfig{Path: dir, RotateMB: 1, RotateMinutes: 60})
+	assert.NoError(t, err, "new archive")
+
+	start := time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC)
+	events := []ArchivedEvent{
+		{Time: start, Route: "user_actions", EventName: "agree", Tid: "1", Queues: []string{"user_actions"}},
+		{Time: start.Add(30 * time.Minute), Route: "new_subscription", Tid: "2", Queues: []string{"mobilink_mo", "audit"}},
+		{Time: start.Add(2 * time.Hour), Route: "new_subscription", Tid: "3", Queues: []string{"mobilink_mo"}},
+	}
+	for _, ev := range events {
+		if ev.EventName == "" {
+			ev.EventName = ev.Route
+		}
+		ev.Body = json.RawMessage(`{"event_name":"` + ev.Route + `"}`)
+		assert.NoError(t, archive.Write(ev), "write")
+	}
+	assert.NoError(t, archive.Close(), "close")
+
+	read := func(filter ArchiveFilter) (tids []string) {
+		skipped, err := ReadArchive(dir, filter, func(ev ArchivedEvent) error {
+			tids = append(tids, ev.Tid)
+			return nil
+		})
+		assert.NoError(t, err, "read archive")
+		assert.Equal(t, 0, skipped, "no bad lines")
+		return
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, read(ArchiveFilter{}), "all, rotated")
+	assert.Equal(t, []string{"2", "3"}, read(ArchiveFilter{Route: "new_subscription"}), "route")
+	assert.Equal(t, []string{"1"}, read(ArchiveFilter{EventName: "agree"}), "user action")
+	assert.Equal(t, []string{"2"}, read(ArchiveFilter{Queue: "audit"}), "queue")
+	assert.Equal(t, []string{"3"}, read(ArchiveFilter{Tid: "3"}), "tid")
+	assert.Equal(t, []string{"2"}, read(ArchiveFilter{
+		From: start.Add(time.Minute),
+		To:   start.Add(time.Hour),
+	}), "time range")
+}
+
+func TestArchiveBadLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.NoError(t, err, "temp dir")
+	defer os.RemoveAll(dir)
+
+	// the last line of a file cut by a crash
+	lines := `{"time":"2017-05-01T10:00:00Z","route":"new_subscription","tid":"1","queues":["mobilink_mo"],"body":{}}
+{"time":"2017-05-01T10:01:00Z","route":"new_sub
+{"time":"2017-05-01T10:02:00Z","route":"new_subscription","tid":"3","queues":["mobilink_mo"],"body":{}}
+`
+	name := filepath.Join(dir, archivePrefix+"20170501-100000.000000000"+archiveSuffix)
+	assert.NoError(t, ioutil.WriteFile(name, []byte(lines), 0644), "write")
+
+	var tids []string
+	skipped, err := ReadArchive(dir, ArchiveFilter{}, func(ev ArchivedEvent) error {
+		tids = append(tids, ev.Tid)
+		return nil
+	})
+	assert.NoError(t, err, "read archive")
+	assert.Equal(t, 1, skipped, "bad line")
+	assert.Equal(t, []string{"1", "3"}, tids, "the rest is read")
+}
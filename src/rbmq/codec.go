@@ -0,0 +1,126 @@
+package rbmq
+
+// payload encodings, chosen per queue in notifier.encodings
+// json is the default, msgpack uses the same field names as json
+// consumers get the field list from the schemas (see schema.go)
+// the content type of the codec is set in the amqp message properties
+// and listed per queue in content_types on /schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeMsgpack = "application/x-msgpack"
+)
+
+type Codec interface {
+	Name() string
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string        { return "json" }
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string        { return "msgpack" }
+func (msgpackCodec) ContentType() string { return ContentTypeMsgpack }
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf).UseJSONTag(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var codecs = map[string]Codec{
+	"json":    jsonCodec{},
+	"msgpack": msgpackCodec{},
+}
+
+// queue name -> codec
+type Encodings map[string]Codec
+
+func NewEncodings(conf map[string]string) (Encodings, error) {
+	enc := make(Encodings, len(conf))
+	for queue, name := range conf {
+		codec, ok := codecs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown encoding %s for queue %s", name, queue)
+		}
+		enc[queue] = codec
+	}
+	return enc, nil
+}
+
+func (enc Encodings) Codec(queue string) Codec {
+	if codec, ok := enc[queue]; ok {
+		return codec
+	}
+	return jsonCodec{}
+}
+
+// Encode marshals the event once per codec used by the destinations
+// json body is always returned: it is what the archive keeps
+func (enc Encodings) Encode(v interface{}, dst []Destination) (jsonBody []byte, bodies map[string][]byte, err error) {
+	if jsonBody, err = json.Marshal(v); err != nil {
+		return nil, nil, fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+	bodies = map[string][]byte{"json": jsonBody}
+	for _, d := range dst {
+		codec := enc.Codec(d.Queue)
+		if _, ok := bodies[codec.Name()]; ok {
+			continue
+		}
+		body, err := codec.Marshal(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s marshal: %s", codec.Name(), err.Error())
+		}
+		bodies[codec.Name()] = body
+	}
+	return
+}
+
+// DecodeArchived turns archived json body into a value
+// that encodes to the same payload with any codec
+func DecodeArchived(body []byte) (v interface{}, err error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err = dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("json.Decode: %s", err.Error())
+	}
+	return normalizeNumbers(v), nil
+}
+
+func normalizeNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = normalizeNumbers(item)
+		}
+	}
+	return v
+}
@@ -0,0 +1,61 @@
+package rbmq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestEncodings(t *testing.T) {
+	_, err := NewEncodings(map[string]string{"q": "xml"})
+	assert.Error(t, err, "unknown encoding")
+
+	enc, err := NewEncodings(map[string]string{"binary": "msgpack"})
+	assert.NoError(t, err, "encodings")
+	assert.Equal(t, ContentTypeJSON, enc.Codec("other").ContentType(), "json by default")
+	assert.Equal(t, ContentTypeMsgpack, enc.Codec("binary").ContentType(), "msgpack")
+
+	event := EventNotify{
+		EventName: "access",
+		EventData: UserActionsNotify{Tid: "1", CampaignId: "290", OperatorCode: 41001, SentAt: time.Now().UTC()},
+	}
+	jsonBody, bodies, err := enc.Encode(event, []Destination{{Queue: "binary"}, {Queue: "other"}})
+	assert.NoError(t, err, "encode")
+	assert.Len(t, bodies, 2, "json and msgpack")
+
+	var decoded map[string]interface{}
+	assert.NoError(t, msgpack.Unmarshal(bodies["msgpack"], &decoded), "msgpack decode")
+	assert.Equal(t, "access", decoded["event_name"], "json field names")
+	data := decoded["event_data"].(map[string]interface{})
+	assert.Equal(t, "290", data["campaign_id"], "nested json field names")
+
+	v, err := DecodeArchived(jsonBody)
+	assert.NoError(t, err, "decode archived")
+	replayed, err := msgpackCodec{}.Marshal(v)
+	assert.NoError(t, err, "replay encode")
+	var decodedReplay map[string]interface{}
+	assert.NoError(t, msgpack.Unmarshal(replayed, &decodedReplay), "replay decode")
+	assert.EqualValues(t, 41001, decodedReplay["event_data"].(map[string]interface{})["operator_code"], "numbers stay integers")
+}
+
+func TestSchema(t *testing.T) {
+	schema, ok := Schema(EventAccessSummary)
+	assert.True(t, ok, "known event")
+	data := schema["properties"].(map[string]interface{})["event_data"].(map[string]interface{})
+	rows := data["properties"].(map[string]interface{})["rows"].(map[string]interface{})
+	row := rows["items"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Contains(t, row, "campaign_id", "embedded struct fields are inlined")
+	assert.Contains(t, row, "count", "own fields")
+
+	name := schema["properties"].(map[string]interface{})["event_name"].(map[string]interface{})
+	assert.Equal(t, []string{EventAccessSummary}, name["enum"])
+	actions, _ := Schema(EventUserActions)
+	name = actions["properties"].(map[string]interface{})["event_name"].(map[string]interface{})
+	assert.Nil(t, name["enum"], "any action name")
+
+	_, ok = Schema("unknown")
+	assert.False(t, ok, "unknown event")
+	assert.Len(t, Schemas(), len(eventTypes), "all events")
+}
@@ -0,0 +1,243 @@
+package rbmq
+
+// publisher of the notifier and of the replay
+// go-utils amqp.Notifier only queues the messages and has no way to know
+// they reached the broker: this one puts the channel in confirm mode,
+// keeps the published messages until the broker confirms them
+// and publishes them again on the next connection when it is lost
+// Close returns when everything queued before it is confirmed
+//
+// the connection is configured as before: notifier.rbmq conn and chan_capacity
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	streadway "github.com/streadway/amqp"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-utils/amqp"
+)
+
+const reconnectDelay = 5 * time.Second
+
+type Message struct {
+	QueueName   string
+	Priority    uint8
+	Body        []byte
+	EventName   string
+	ContentType string
+	Headers     map[string]string
+}
+
+// channel is the part of the amqp channel the publisher uses
+type channel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args streadway.Table) (streadway.Queue, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg streadway.Publishing) error
+	NotifyPublish(confirm chan streadway.Confirmation) chan streadway.Confirmation
+	Close() error
+}
+
+// dial opens a channel in confirm mode, replaced in tests
+var dial = dialChannel
+
+type Publisher struct {
+	conf    amqp.NotifierConfig
+	queue   chan Message
+	stop    chan struct{}
+	done    chan struct{}
+	closing int32
+	// taken from the queue, not confirmed yet
+	unconfirmed int64
+	closeOnce   sync.Once
+}
+
+func NewPublisher(conf amqp.NotifierConfig) *Publisher {
+	p := &Publisher{
+		conf:  conf,
+		queue: make(chan Message, conf.ChanCapacity),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Publish queues the message, it blocks when chan_capacity messages are queued
+func (p *Publisher) Publish(msg Message) error {
+	if atomic.LoadInt32(&p.closing) == 1 {
+		return fmt.Errorf("rbmq.Publish: publisher is closed, queue %s", msg.QueueName)
+	}
+	p.queue <- msg
+	return nil
+}
+
+// Len is the number of the messages not confirmed yet: queued and published
+func (p *Publisher) Len() int {
+	return len(p.queue) + int(atomic.LoadInt64(&p.unconfirmed))
+}
+
+// Close stops taking messages and waits for the queued ones to be confirmed
+func (p *Publisher) Close(timeout time.Duration) error {
+	p.closeOnce.Do(func() {
+		atomic.StoreInt32(&p.closing, 1)
+		close(p.stop)
+	})
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("rbmq.Close: %d messages are not confirmed in %s", p.Len(), timeout)
+	}
+}
+
+func (p *Publisher) run() {
+	defer close(p.done)
+	var unconfirmed []Message
+	for {
+		ch, err := dial(p.conf)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err.Error(),
+				"queued": p.Len(),
+			}).Error("rbmq: connect")
+			if atomic.LoadInt32(&p.closing) == 1 && p.Len() == 0 {
+				return
+			}
+			time.Sleep(reconnectDelay)
+			continue
+		}
+		unconfirmed, err = p.serve(ch, unconfirmed)
+		ch.Close()
+		if err == nil {
+			return
+		}
+		m.NotifyError.Inc()
+		log.WithFields(log.Fields{
+			"error":       err.Error(),
+			"unconfirmed": len(unconfirmed),
+		}).Error("rbmq: publish, reconnect")
+	}
+}
+
+// serve publishes on the channel until it is lost or the publisher is closed and drained,
+// the messages not confirmed are returned to be published again
+func (p *Publisher) serve(ch channel, resend []Message) ([]Message, error) {
+	confirms := ch.NotifyPublish(make(chan streadway.Confirmation, cap(p.queue)+len(resend)+1))
+	declared := map[string]bool{}
+	// published on the channel, in the order of the delivery tags
+	var sent []Message
+	publish := func(msg Message) error {
+		if !declared[msg.QueueName] {
+			if _, err := ch.QueueDeclare(msg.QueueName, true, false, false, false, nil); err != nil {
+				return fmt.Errorf("QueueDeclare: %s, queue %s", err.Error(), msg.QueueName)
+			}
+			declared[msg.QueueName] = true
+		}
+		var headers streadway.Table
+		if len(msg.Headers) > 0 {
+			headers = make(streadway.Table, len(msg.Headers))
+			for k, v := range msg.Headers {
+				headers[k] = v
+			}
+		}
+		if err := ch.Publish("", msg.QueueName, false, false, streadway.Publishing{
+			Headers:      headers,
+			DeliveryMode: streadway.Persistent,
+			ContentType:  msg.ContentType,
+			Priority:     msg.Priority,
+			Type:         msg.EventName,
+			Body:         msg.Body,
+		}); err != nil {
+			return fmt.Errorf("Publish: %s, queue %s", err.Error(), msg.QueueName)
+		}
+		sent = append(sent, msg)
+		return nil
+	}
+	lost := func(rest ...Message) []Message {
+		return append(sent, rest...)
+	}
+
+	for i, msg := range resend {
+		if err := publish(msg); err != nil {
+			return lost(resend[i:]...), err
+		}
+	}
+	limit := cap(p.queue)
+	if limit == 0 {
+		limit = 1
+	}
+	stop := p.stop
+	for {
+		in := p.queue
+		if len(sent) >= limit {
+			in = nil
+		}
+		if stop == nil && len(p.queue) == 0 && len(sent) == 0 {
+			return nil, nil
+		}
+		select {
+		case msg := <-in:
+			atomic.AddInt64(&p.unconfirmed, 1)
+			if err := publish(msg); err != nil {
+				return lost(msg), err
+			}
+		case c, ok := <-confirms:
+			if !ok {
+				return lost(), fmt.Errorf("channel closed, %d messages not confirmed", len(sent))
+			}
+			msg := sent[0]
+			sent = sent[1:]
+			if c.Ack {
+				atomic.AddInt64(&p.unconfirmed, -1)
+			} else {
+				m.NotifyError.Inc()
+				log.WithField("queue", msg.QueueName).Warn("rbmq: nack, publish again")
+				if err := publish(msg); err != nil {
+					return lost(msg), err
+				}
+			}
+		case <-stop:
+			stop = nil
+		}
+	}
+}
+
+// connChannel closes the connection with the channel
+type connChannel struct {
+	*streadway.Channel
+	conn *streadway.Connection
+}
+
+func (c connChannel) Close() error {
+	c.Channel.Close()
+	return c.conn.Close()
+}
+
+func dialChannel(conf amqp.NotifierConfig) (channel, error) {
+	u := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(conf.Conn.User, conf.Conn.Pass),
+		Host:   net.JoinHostPort(conf.Conn.Host, conf.Conn.Port),
+		Path:   "/",
+	}
+	conn, err := streadway.Dial(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("amqp.Dial: %s", err.Error())
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("conn.Channel: %s", err.Error())
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ch.Confirm: %s", err.Error())
+	}
+	return connChannel{Channel: ch, conn: conn}, nil
+}
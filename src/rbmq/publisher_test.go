@@ -0,0 +1,121 @@
+package rbmq
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	streadway "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-utils/amqp"
+)
+
+// broker confirms the publishings, it can nack a body once and lose a channel
+type broker struct {
+	sync.Mutex
+	published []string
+	// the properties of the last publishing
+	contentType string
+	headers     streadway.Table
+	nack        map[string]bool
+	// the channel is lost on this publishing, 0 - never
+	loseOn int
+}
+
+type fakeChannel struct {
+	b        *broker
+	tag      uint64
+	lost     bool
+	confirms chan streadway.Confirmation
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args streadway.Table) (streadway.Queue, error) {
+	return streadway.Queue{Name: name}, nil
+}
+
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg streadway.Publishing) error {
+	ch.b.Lock()
+	defer ch.b.Unlock()
+	if ch.lost {
+		return fmt.Errorf("channel is lost")
+	}
+	ch.tag++
+	ch.b.published = append(ch.b.published, string(msg.Body))
+	ch.b.contentType = msg.ContentType
+	ch.b.headers = msg.Headers
+	if len(ch.b.published) == ch.b.loseOn {
+		ch.b.loseOn = 0
+		ch.lost = true
+		close(ch.confirms)
+		return nil
+	}
+	ack := !ch.b.nack[string(msg.Body)]
+	delete(ch.b.nack, string(msg.Body))
+	ch.confirms <- streadway.Confirmation{DeliveryTag: ch.tag, Ack: ack}
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan streadway.Confirmation) chan streadway.Confirmation {
+	ch.confirms = confirm
+	return confirm
+}
+
+func (ch *fakeChannel) Close() error {
+	return nil
+}
+
+func (b *broker) bodies() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string{}, b.published...)
+}
+
+func newTestPublisher(b *broker) *Publisher {
+	dial = func(conf amqp.NotifierConfig) (channel, error) {
+		return &fakeChannel{b: b}, nil
+	}
+	return NewPublisher(amqp.NotifierConfig{ChanCapacity: 2})
+}
+
+func TestPublisherClose(t *testing.T) {
+	defer func() { dial = dialChannel }()
+	b := &broker{}
+	p := newTestPublisher(b)
+	headers := map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, p.Publish(Message{
+			QueueName:   "q",
+			Body:        []byte(fmt.Sprint(i)),
+			ContentType: ContentTypeMsgpack,
+			Headers:     headers,
+		}))
+	}
+	assert.NoError(t, p.Close(time.Second), "all confirmed")
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, b.bodies())
+	assert.Equal(t, ContentTypeMsgpack, b.contentType, "message property")
+	assert.Equal(t, streadway.Table{"traceparent": headers["traceparent"]}, b.headers, "trace context")
+	assert.Equal(t, 0, p.Len())
+	assert.Error(t, p.Publish(Message{QueueName: "q", Body: []byte("6")}), "closed")
+}
+
+func TestPublisherRepublish(t *testing.T) {
+	defer func() { dial = dialChannel }()
+	b := &broker{nack: map[string]bool{"2": true}, loseOn: 4}
+	p := newTestPublisher(b)
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, p.Publish(Message{QueueName: "q", Body: []byte(fmt.Sprint(i))}))
+	}
+	assert.NoError(t, p.Close(time.Second), "all confirmed")
+	assert.Equal(t, 0, p.Len())
+
+	published := map[string]int{}
+	for _, body := range b.bodies() {
+		published[body]++
+	}
+	for i := 1; i <= 5; i++ {
+		assert.NotZero(t, published[fmt.Sprint(i)], "published at least once: %d", i)
+	}
+	assert.True(t, published["2"] >= 2, "nacked, published again")
+}
@@ -1,13 +1,18 @@
 package rbmq
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/linkit360/go-dispatcherd/src/capture"
 	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/timing"
+	"github.com/linkit360/go-dispatcherd/src/tracing"
 	redirect_service "github.com/linkit360/go-partners/service"
 	"github.com/linkit360/go-utils/amqp"
 	"github.com/linkit360/go-utils/rec"
@@ -15,36 +20,52 @@ import (
 )
 
 type Notifier interface {
-	RedirectNotify(msg redirect_service.DestinationHit) error
+	RedirectNotify(ctx context.Context, msg redirect_service.DestinationHit) error
 
-	NewSubscriptionNotify(string, rec.Record) error
+	NewSubscriptionNotify(ctx context.Context, r rec.Record) error
 
-	AccessCampaignNotify(msg structs.AccessCampaignNotify) error
+	AccessCampaignNotify(ctx context.Context, msg structs.AccessCampaignNotify) error
 
-	ActionNotify(msg UserActionsNotify) error
+	ActionNotify(ctx context.Context, msg UserActionsNotify) error
 
-	ContentSentNotify(msg structs.ContentSentProperties) error
+	ContentSentNotify(ctx context.Context, msg ContentSent) error
 
-	PixelBufferNotify(r rec.Record) error
+	ContentLinkIssuedNotify(ctx context.Context, msg ContentLinkIssued) error
 
-	Notify(queue, eventName string, r rec.Record) error
+	PixelBufferNotify(ctx context.Context, r rec.Record) error
+
+	Notify(ctx context.Context, eventName string, r rec.Record) error
+
+	// Close waits for the published events to be confirmed by the broker
+	Close() error
 }
 
 type NotifierConfig struct {
-	Queues       Queues              `yaml:"queues"`
+	Routes       []Route             `yaml:"routes"`
+	Encodings    map[string]string   `yaml:"encodings"`
+	Archive      ArchiveConfig       `yaml:"archive"`
+	Aggregation  AggregationConfig   `yaml:"aggregation"`
 	RBMQNotifier amqp.NotifierConfig `yaml:"rbmq"`
+	// on the exit, wait at most for the published events to be confirmed
+	CloseTimeoutSec int `default:"10" yaml:"close_timeout_sec"`
 }
 
-type Queues struct {
-	AccessCampaign   string `yaml:"access_campaign" default:"access_campaign"`
-	UserAction       string `yaml:"user_actions" default:"user_actions"`
-	ContentSent      string `yaml:"content_sent" default:"content_sent"`
-	PixelSent        string `yaml:"pixel_sent" default:"pixel_sent"`
-	TrafficRedirects string `yaml:"traffic_redirects" default:"traffic_redirects"`
-}
 type notifier struct {
-	q  Queues
-	mq *amqp.Notifier
+	router  *Router
+	enc     Encodings
+	archive *Archive
+	agg     *aggregator
+	mq      *Publisher
+	// Close waits at most
+	closeTimeout time.Duration
+}
+
+// what the router needs to choose queues, tid is for the archive
+type eventKey struct {
+	route        string
+	operatorCode int64
+	campaignId   string
+	tid          string
 }
 
 type EventNotify struct {
@@ -52,141 +73,264 @@ type EventNotify struct {
 	EventData interface{} `json:"event_data,omitempty"`
 }
 
-func init() {
-	log.SetLevel(log.DebugLevel)
-}
-
 func NewNotifierService(conf NotifierConfig) Notifier {
 	var n Notifier
 	{
-		rabbit := amqp.NewNotifier(conf.RBMQNotifier)
-		n = &notifier{
-			q:  conf.Queues,
-			mq: rabbit,
+		rabbit := NewPublisher(conf.RBMQNotifier)
+		enc, err := NewEncodings(conf.Encodings)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Fatal("cannot init notifier encodings")
+		}
+		var archive *Archive
+		if conf.Archive.Enabled {
+			var err error
+			if archive, err = NewArchive(conf.Archive); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+					"path":  conf.Archive.Path,
+				}).Fatal("cannot init event archive")
+			}
+		}
+		nf := &notifier{
+			router:  NewRouter(conf.Routes),
+			enc:     enc,
+			archive: archive,
+			mq:      rabbit,
+
+			closeTimeout: time.Duration(conf.CloseTimeoutSec) * time.Second,
+		}
+		if conf.Aggregation.Enabled {
+			nf.agg = newAggregator(conf.Aggregation)
+			go nf.agg.run(nf.accessSummaryNotify)
 		}
+		n = nf
 	}
 	return n
 }
 
-func (service notifier) RedirectNotify(msg redirect_service.DestinationHit) error {
-	event := EventNotify{
-		EventName: service.q.TrafficRedirects,
-		EventData: msg,
+// publish sends the event to every queue the router gives for it
+func (service notifier) publish(ctx context.Context, key eventKey, event EventNotify) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "publish "+key.route,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(tracing.Attributes(key.tid, key.campaignId, key.operatorCode)...),
+	)
+	begin := time.Now()
+	var queues []string
+	defer func() {
+		timing.FromContext(ctx).Since(timing.Notify, begin)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		capture.FromContext(ctx).Add(capture.KindEvent, key.route, 0, err, map[string]interface{}{
+			"queues": queues,
+			"event":  event,
+		})
+	}()
+
+	dst := service.router.Match(key.route, key.operatorCode, key.campaignId)
+	if len(dst) == 0 {
+		m.NotifyError.Inc()
+		return fmt.Errorf("no route: event %s, operator %d, campaign %s", key.route, key.operatorCode, key.campaignId)
 	}
 
-	body, err := json.Marshal(event)
+	// w3c trace context of the publish span
+	headers := tracing.Inject(ctx)
+	body, bodies, err := service.enc.Encode(event, dst)
 	if err != nil {
 		m.NotifyError.Inc()
-		return fmt.Errorf("json.Marshal: %s", err.Error())
+		return err
+	}
+	for _, d := range dst {
+		codec := service.enc.Codec(d.Queue)
+		if err = service.mq.Publish(Message{
+			QueueName:   d.Queue,
+			Priority:    d.Priority,
+			Body:        bodies[codec.Name()],
+			EventName:   event.EventName,
+			ContentType: codec.ContentType(),
+			Headers:     headers,
+		}); err != nil {
+			m.NotifyError.Inc()
+			return err
+		}
+	}
+
+	queues = make([]string, 0, len(dst))
+	for _, d := range dst {
+		queues = append(queues, d.Queue)
+	}
+	if service.archive != nil {
+		if err := service.archive.Write(ArchivedEvent{
+			Time:         time.Now().UTC(),
+			Route:        key.route,
+			OperatorCode: key.operatorCode,
+			CampaignId:   key.campaignId,
+			Tid:          key.tid,
+			Queues:       queues,
+			EventName:    event.EventName,
+			Headers:      headers,
+			Body:         body,
+		}); err != nil {
+			m.ArchiveErrors.Inc()
+			log.WithFields(log.Fields{
+				"tid":   key.tid,
+				"error": err.Error(),
+			}).Error("archive event")
+		}
 	}
-	service.mq.Publish(amqp.AMQPMessage{service.q.TrafficRedirects, uint8(1), body, event.EventName})
 	return nil
 }
 
-func (service notifier) NewSubscriptionNotify(queue string, msg rec.Record) error {
-	msg.SentAt = time.Now().UTC()
+func (service notifier) Close() error {
+	err := service.mq.Close(service.closeTimeout)
+	if service.archive != nil {
+		if archiveErr := service.archive.Close(); archiveErr != nil && err == nil {
+			err = fmt.Errorf("archive.Close: %s", archiveErr.Error())
+		}
+	}
+	return err
+}
+
+func (service notifier) RedirectNotify(ctx context.Context, msg redirect_service.DestinationHit) error {
 	event := EventNotify{
-		EventName: "new_subscription",
+		EventName: EventTrafficRedirects,
 		EventData: msg,
 	}
-	body, err := json.Marshal(event)
-	if err != nil {
-		m.NotifyError.Inc()
-		return fmt.Errorf("json.Marshal: %s", err.Error())
-	}
-	log.Debugf("new subscription %s", body)
-	service.mq.Publish(amqp.AMQPMessage{queue, 0, body, event.EventName})
-	return nil
+	return service.publish(ctx, eventKey{EventTrafficRedirects, msg.OperatorCode, "", msg.Tid}, event)
 }
 
-func (service notifier) AccessCampaignNotify(msg structs.AccessCampaignNotify) error {
+func (service notifier) NewSubscriptionNotify(ctx context.Context, msg rec.Record) error {
 	msg.SentAt = time.Now().UTC()
 	event := EventNotify{
-		EventName: "access_campaign",
+		EventName: EventNewSubscription,
 		EventData: msg,
 	}
+	log.WithField("tid", msg.Tid).Debug("new subscription")
+	return service.publish(ctx, eventKey{EventNewSubscription, msg.OperatorCode, msg.CampaignId, msg.Tid}, event)
+}
 
-	body, err := json.Marshal(event)
-	if err != nil {
-		m.NotifyError.Inc()
-		return fmt.Errorf("json.Marshal: %s", err.Error())
+func (service notifier) AccessCampaignNotify(ctx context.Context, msg structs.AccessCampaignNotify) error {
+	if service.agg != nil && service.agg.add(summaryKey{
+		Event:        EventAccessCampaign,
+		CampaignId:   msg.CampaignId,
+		OperatorCode: msg.OperatorCode,
+		Publisher:    publisherFromUrl(msg.UrlPath),
+		Outcome:      outcome(msg.Error),
+	}) {
+		return nil
 	}
-
-	service.mq.Publish(amqp.AMQPMessage{service.q.AccessCampaign, 0, body, event.EventName})
-	return nil
+	msg.SentAt = time.Now().UTC()
+	event := EventNotify{
+		EventName: EventAccessCampaign,
+		EventData: msg,
+	}
+	return service.publish(ctx, eventKey{EventAccessCampaign, msg.OperatorCode, msg.CampaignId, msg.Tid}, event)
 }
 
 type UserActionsNotify struct {
-	Tid        string    `json:"tid,omitempty"`
-	CampaignId string    `json:"campaign_id,omitempty"`
-	Msisdn     string    `json:"msisdn,omitempty"`
-	Error      string    `json:"err,omitempty"`
-	Action     string    `json:"action,omitempty"`
-	SentAt     time.Time `json:"sent_at,omitempty"`
+	Tid          string    `json:"tid,omitempty"`
+	CampaignId   string    `json:"campaign_id,omitempty"`
+	OperatorCode int64     `json:"operator_code,omitempty"`
+	Publisher    string    `json:"publisher,omitempty"`
+	Msisdn       string    `json:"msisdn,omitempty"`
+	Error        string    `json:"err,omitempty"`
+	Action       string    `json:"action,omitempty"`
+	SentAt       time.Time `json:"sent_at,omitempty"`
 }
 
-func (service notifier) ActionNotify(msg UserActionsNotify) error {
+func (service notifier) ActionNotify(ctx context.Context, msg UserActionsNotify) error {
 	if msg.Tid == "" {
 		return fmt.Errorf("No tid%s", "")
 	}
+	if service.agg != nil && service.agg.aggregated(msg.Action) && service.agg.add(summaryKey{
+		Event:        msg.Action,
+		CampaignId:   msg.CampaignId,
+		OperatorCode: msg.OperatorCode,
+		Publisher:    msg.Publisher,
+		Outcome:      outcome(msg.Error),
+	}) {
+		return nil
+	}
 	msg.SentAt = time.Now().UTC()
 	event := EventNotify{
 		EventName: msg.Action,
 		EventData: msg,
 	}
-	body, err := json.Marshal(event)
-	if err != nil {
-		m.NotifyError.Inc()
-		return fmt.Errorf("json.Marshal: %s", err.Error())
+	return service.publish(ctx, eventKey{EventUserActions, msg.OperatorCode, msg.CampaignId, msg.Tid}, event)
+}
+
+func (service notifier) accessSummaryNotify(summary AccessSummary) {
+	event := EventNotify{
+		EventName: EventAccessSummary,
+		EventData: summary,
 	}
-	service.mq.Publish(amqp.AMQPMessage{service.q.UserAction, 0, body, event.EventName})
-	return nil
+	if err := service.publish(context.Background(), eventKey{route: EventAccessSummary}, event); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+			"rows":  len(summary.Rows),
+		}).Error("notify access summary")
+	}
+}
+
+// ContentSent is the content sent event: the contentd properties
+// and what was actually delivered
+type ContentSent struct {
+	structs.ContentSentProperties
+	// 200 - file, 206 - byte range, 304 - not modified
+	HttpStatus int `json:"http_status,omitempty"`
+	// byte range or interrupted download
+	Partial   bool   `json:"partial"`
+	BytesSent int64  `json:"bytes_sent"`
+	FileSize  int64  `json:"file_size,omitempty"`
+	Range     string `json:"range,omitempty"`
+	Variant   string `json:"variant,omitempty"`
 }
 
-func (service notifier) ContentSentNotify(msg structs.ContentSentProperties) error {
+func (service notifier) ContentSentNotify(ctx context.Context, msg ContentSent) error {
 	msg.SentAt = time.Now().UTC()
 
 	event := EventNotify{
-		EventName: "content_sent",
+		EventName: EventContentSent,
 		EventData: msg,
 	}
+	return service.publish(ctx, eventKey{EventContentSent, msg.OperatorCode, msg.CampaignId, msg.Tid}, event)
+}
 
-	body, err := json.Marshal(event)
-	if err != nil {
-		m.NotifyError.Inc()
-		return fmt.Errorf("json.Marshal: %s", err.Error())
-	}
+// ContentLinkIssued is the content link issued by the api,
+// the sms with it is sent by the api client
+type ContentLinkIssued struct {
+	structs.ContentSentProperties
+	Url     string `json:"url"`
+	SMSText string `json:"sms_text"`
+	// api account
+	Client string `json:"client"`
+}
 
-	service.mq.Publish(amqp.AMQPMessage{service.q.ContentSent, 0, body, event.EventName})
-	return nil
+func (service notifier) ContentLinkIssuedNotify(ctx context.Context, msg ContentLinkIssued) error {
+	msg.SentAt = time.Now().UTC()
+
+	event := EventNotify{
+		EventName: EventContentLinkIssued,
+		EventData: msg,
+	}
+	return service.publish(ctx, eventKey{EventContentLinkIssued, msg.OperatorCode, msg.CampaignId, msg.Tid}, event)
 }
 
-func (service notifier) PixelBufferNotify(r rec.Record) error {
+func (service notifier) PixelBufferNotify(ctx context.Context, r rec.Record) error {
 	event := EventNotify{
 		EventName: "buffer",
 		EventData: r,
 	}
-
-	body, err := json.Marshal(event)
-	if err != nil {
-		m.NotifyError.Inc()
-		return fmt.Errorf("json.Marshal: %s", err.Error())
-	}
-	service.mq.Publish(amqp.AMQPMessage{service.q.PixelSent, uint8(1), body, event.EventName})
-	return nil
+	return service.publish(ctx, eventKey{EventPixelSent, r.OperatorCode, r.CampaignId, r.Tid}, event)
 }
 
-func (service notifier) Notify(queue, eventName string, r rec.Record) error {
+func (service notifier) Notify(ctx context.Context, eventName string, r rec.Record) error {
 	event := EventNotify{
 		EventName: eventName,
 		EventData: r,
 	}
-
-	body, err := json.Marshal(event)
-	if err != nil {
-		m.NotifyError.Inc()
-		return fmt.Errorf("json.Marshal: %s", err.Error())
-	}
-	service.mq.Publish(amqp.AMQPMessage{queue, uint8(1), body, event.EventName})
-	return nil
+	return service.publish(ctx, eventKey{eventName, r.OperatorCode, r.CampaignId, r.Tid}, event)
 }
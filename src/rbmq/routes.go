@@ -0,0 +1,100 @@
+package rbmq
+
+// routing table: which queues receive an event
+// routes are matched by event name, operator code and campaign id,
+// event "*", empty operator code (0) and campaign id ("") match any
+// every matching enabled route adds its queues (fan-out)
+// if no configured route matches, the event goes to its default queue
+// (only for the events listed in defaultQueues): the queue named after the event,
+// the subscription events go where they went before the routing table
+
+const (
+	EventAccessCampaign    = "access_campaign"
+	EventUserActions       = "user_actions"
+	EventContentSent       = "content_sent"
+	EventPixelSent         = "pixel_sent"
+	EventTrafficRedirects  = "traffic_redirects"
+	EventNewSubscription   = "new_subscription"
+	EventUnreg             = "unreg"
+	EventPurge             = "purge"
+	EventContentLinkIssued = "content_link_issued"
+	// the sms sender, i.e. the content history login pin; no default queue
+	EventSendSMS = "send_sms"
+)
+
+var defaultQueues = map[string]Destination{
+	EventAccessCampaign:    {Queue: EventAccessCampaign},
+	EventUserActions:       {Queue: EventUserActions},
+	EventContentSent:       {Queue: EventContentSent},
+	EventPixelSent:         {Queue: EventPixelSent, Priority: 1},
+	EventTrafficRedirects:  {Queue: EventTrafficRedirects, Priority: 1},
+	EventAccessSummary:     {Queue: EventAccessSummary},
+	EventContentLinkIssued: {Queue: EventContentLinkIssued},
+	EventNewSubscription:   {Queue: "mobilink_new_subscriptions"},
+	EventUnreg:             {Queue: "mobilink_responses", Priority: 1},
+	EventPurge:             {Queue: "mobilink_responses", Priority: 1},
+}
+
+type Route struct {
+	Event        string   `yaml:"event"`
+	OperatorCode int64    `yaml:"operator_code"`
+	CampaignId   string   `yaml:"campaign_id"`
+	Queues       []string `yaml:"queues"`
+	Priority     uint8    `yaml:"priority"`
+	Disabled     bool     `yaml:"disabled"`
+}
+
+type Destination struct {
+	Queue    string
+	Priority uint8
+}
+
+type Router struct {
+	routes []Route
+}
+
+func NewRouter(routes []Route) *Router {
+	return &Router{routes: routes}
+}
+
+func (r Route) match(event string, operatorCode int64, campaignId string) bool {
+	if r.Event != event && r.Event != "*" {
+		return false
+	}
+	if r.OperatorCode != 0 && r.OperatorCode != operatorCode {
+		return false
+	}
+	if r.CampaignId != "" && r.CampaignId != campaignId {
+		return false
+	}
+	return true
+}
+
+// a matching disabled route switches off the default queue as well
+func (router *Router) Match(event string, operatorCode int64, campaignId string) (dst []Destination) {
+	matched := false
+	seen := make(map[string]struct{})
+	for _, route := range router.routes {
+		if !route.match(event, operatorCode, campaignId) {
+			continue
+		}
+		matched = true
+		if route.Disabled {
+			continue
+		}
+		for _, queue := range route.Queues {
+			if _, ok := seen[queue]; ok {
+				continue
+			}
+			seen[queue] = struct{}{}
+			dst = append(dst, Destination{Queue: queue, Priority: route.Priority})
+		}
+	}
+	if matched {
+		return
+	}
+	if d, ok := defaultQueues[event]; ok {
+		dst = append(dst, d)
+	}
+	return
+}
@@ -0,0 +1,34 @@
+package rbmq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouterMatch(t *testing.T) {
+	router := NewRouter([]Route{
+		{Event: "new_subscription", OperatorCode: 41001, Queues: []string{"mobilink_mo"}},
+		{Event: "new_subscription", CampaignId: "290", Queues: []string{"mobilink_mo", "audit"}, Priority: 1},
+		{Event: "*", Queues: []string{"all"}, Disabled: true},
+		{Event: "access_campaign", OperatorCode: 25099, Disabled: true},
+	})
+
+	assert.Equal(t, []Destination{{Queue: "mobilink_mo"}},
+		router.Match("new_subscription", 41001, "1"), "operator route")
+	assert.Equal(t, []Destination{{Queue: "mobilink_mo"}, {Queue: "audit", Priority: 1}},
+		router.Match("new_subscription", 41001, "290"), "fan-out without duplicates")
+	assert.Empty(t, router.Match("new_subscription", 25099, "1"), "no route")
+	assert.Empty(t, router.Match("access_campaign", 25099, "1"), "disabled route")
+	assert.Empty(t, router.Match("pixel_sent", 25099, "1"), "disabled wildcard route")
+
+	assert.Equal(t, []Destination{{Queue: "access_campaign"}},
+		NewRouter(nil).Match("access_campaign", 41001, "1"), "default queue")
+	assert.Equal(t, []Destination{{Queue: "pixel_sent", Priority: 1}},
+		NewRouter(nil).Match("pixel_sent", 41001, "1"), "default queue priority")
+	assert.Equal(t, []Destination{{Queue: "mobilink_new_subscriptions"}},
+		NewRouter(nil).Match("new_subscription", 0, "1"), "subscription default, no operator code")
+	assert.Equal(t, []Destination{{Queue: "mobilink_responses", Priority: 1}},
+		NewRouter(nil).Match("purge", 0, ""), "responses default")
+	assert.Empty(t, NewRouter(nil).Match("send_sms", 41001, ""), "no default queue")
+}
@@ -0,0 +1,137 @@
+package rbmq
+
+// json schemas of the event payloads, generated from the go types
+// so they never drift from what is actually published
+// served on /schema for consumers written in other languages
+//
+// the schemas are keyed by the route (see routes.go), not by event_name:
+// the user_actions route publishes every action under the action name
+// ("access", "agree", "content_history"...), all of them are UserActionsNotify
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	redirect_service "github.com/linkit360/go-partners/service"
+	"github.com/linkit360/go-utils/rec"
+	"github.com/linkit360/go-utils/structs"
+)
+
+var eventTypes = map[string]interface{}{
+	EventAccessCampaign:    structs.AccessCampaignNotify{},
+	EventUserActions:       UserActionsNotify{},
+	EventContentSent:       ContentSent{},
+	EventPixelSent:         rec.Record{},
+	EventTrafficRedirects:  redirect_service.DestinationHit{},
+	EventNewSubscription:   rec.Record{},
+	EventUnreg:             rec.Record{},
+	EventPurge:             rec.Record{},
+	EventAccessSummary:     AccessSummary{},
+	EventContentLinkIssued: ContentLinkIssued{},
+}
+
+// Schemas returns the schema of the message (event_name + event_data) for every event
+func Schemas() map[string]interface{} {
+	res := make(map[string]interface{}, len(eventTypes))
+	for event := range eventTypes {
+		res[event], _ = Schema(event)
+	}
+	return res
+}
+
+func Schema(event string) (map[string]interface{}, bool) {
+	data, ok := eventTypes[event]
+	if !ok {
+		return nil, false
+	}
+	return map[string]interface{}{
+		"$schema": "http://json-schema.org/draft-04/schema#",
+		"title":   event,
+		"type":    "object",
+		"properties": map[string]interface{}{
+			"event_name": eventNameSchema(event),
+			"event_data": typeSchema(reflect.TypeOf(data)),
+		},
+	}, true
+}
+
+func eventNameSchema(route string) map[string]interface{} {
+	if route == EventUserActions {
+		return map[string]interface{}{
+			"type":        "string",
+			"description": "the user action, every action of the user_actions route has this schema",
+		}
+	}
+	name := route
+	if route == EventPixelSent {
+		name = "buffer"
+	}
+	return map[string]interface{}{"type": "string", "enum": []string{name}}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		// msgpack encodes time as the timestamp extension
+		return map[string]interface{}{"type": "string", "format": "date-time", "x-msgpack": "timestamp"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		structProperties(t, properties)
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	return map[string]interface{}{}
+}
+
+// fields are named the way encoding/json names them
+func structProperties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				structProperties(ft, properties)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = typeSchema(field.Type)
+	}
+}
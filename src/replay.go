@@ -0,0 +1,175 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/linkit360/go-dispatcherd/src/config"
+	"github.com/linkit360/go-dispatcherd/src/rbmq"
+	"github.com/linkit360/go-dispatcherd/src/tracing"
+)
+
+// dispatcherd replay -config dispatcherd.yml -from 2017-05-01T10:00:00Z -route new_subscription
+// dispatcherd replay -config dispatcherd.yml -route user_actions -event agree
+// republishes archived events, queues are chosen by the current routing table
+// the replay span of an event is a child of the span the event was published in
+func Replay() {
+	archivePath := flag.String("archive", "", "archive directory, default is notifier.archive.path")
+	from := flag.String("from", "", "replay events archived at or after, RFC3339")
+	to := flag.String("to", "", "replay events archived before, RFC3339")
+	route := flag.String("route", "", "replay only the events of this route, i.e. new_subscription, user_actions")
+	eventName := flag.String("event", "", "replay only the events with this event name, i.e. the user action agree")
+	queue := flag.String("queue", "", "replay only events sent to this queue and publish only to it")
+	tid := flag.String("tid", "", "replay only events with this tid")
+	dryRun := flag.Bool("dry-run", false, "log matched events, do not publish")
+	rate := flag.Int("rate", 100, "events per second, 0 - no limit")
+	drainSec := flag.Int("drain-sec", 60, "wait at most before the exit for the queued events to be confirmed by the broker")
+
+	conf = config.LoadConfig()
+	tracing.Init(conf.AppName, conf.Tracing)
+
+	filter := rbmq.ArchiveFilter{
+		Route:     *route,
+		EventName: *eventName,
+		Queue:     *queue,
+		Tid:       *tid,
+	}
+	var err error
+	if *from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			log.WithField("error", err.Error()).Fatal("wrong -from")
+		}
+	}
+	if *to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			log.WithField("error", err.Error()).Fatal("wrong -to")
+		}
+	}
+	if *archivePath == "" {
+		*archivePath = conf.Notifier.Archive.Path
+	}
+
+	var mq *rbmq.Publisher
+	if !*dryRun {
+		mq = rbmq.NewPublisher(conf.Notifier.RBMQNotifier)
+	}
+	var tick <-chan time.Time
+	if *rate > 0 {
+		tick = time.Tick(time.Second / time.Duration(*rate))
+	}
+
+	router := rbmq.NewRouter(conf.Notifier.Routes)
+	enc, err := rbmq.NewEncodings(conf.Notifier.Encodings)
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("wrong notifier encodings")
+	}
+	matched, queued := 0, 0
+	skipped, err := rbmq.ReadArchive(*archivePath, filter, func(ev rbmq.ArchivedEvent) error {
+		matched++
+		dst := router.Match(ev.Route, ev.OperatorCode, ev.CampaignId)
+		if *queue != "" {
+			dst = onlyQueue(dst, *queue)
+		}
+		logCtx := log.WithFields(log.Fields{
+			"tid":   ev.Tid,
+			"event": ev.EventName,
+			"route": ev.Route,
+			"time":  ev.Time,
+			"dst":   dst,
+		})
+		if len(dst) == 0 {
+			logCtx.Warn("no route")
+			return nil
+		}
+		if *dryRun {
+			logCtx.Info("dry run")
+			return nil
+		}
+		ctx, span := tracing.Tracer().Start(archivedContext(ev), "replay "+ev.Route,
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(tracing.Attributes(ev.Tid, ev.CampaignId, ev.OperatorCode)...),
+		)
+		defer span.End()
+		headers := tracing.Inject(ctx)
+		for _, d := range dst {
+			body := []byte(ev.Body)
+			codec := enc.Codec(d.Queue)
+			if codec.Name() != "json" {
+				v, err := rbmq.DecodeArchived(body)
+				if err != nil {
+					return err
+				}
+				if body, err = codec.Marshal(v); err != nil {
+					return fmt.Errorf("%s marshal: %s", codec.Name(), err.Error())
+				}
+			}
+			if tick != nil {
+				<-tick
+			}
+			if err := mq.Publish(rbmq.Message{
+				QueueName:   d.Queue,
+				Priority:    d.Priority,
+				Body:        body,
+				EventName:   ev.EventName,
+				ContentType: codec.ContentType(),
+				Headers:     headers,
+			}); err != nil {
+				return err
+			}
+			queued++
+		}
+		logCtx.Debug("replayed")
+		return nil
+	})
+	if mq != nil {
+		log.WithField("unconfirmed", mq.Len()).Info("replay: wait for the queued events to be confirmed")
+		if closeErr := mq.Close(time.Duration(*drainSec) * time.Second); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	tracing.Shutdown()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err.Error(),
+			"matched": matched,
+			"queued":  queued,
+			"skipped": skipped,
+		}).Fatal("replay")
+	}
+	log.WithFields(log.Fields{
+		"matched": matched,
+		"queued":  queued,
+		"skipped": skipped,
+		"dry_run": *dryRun,
+	}).Info("replay done")
+}
+
+// archivedContext is the trace context the event was published with,
+// the events archived before it was moved to the headers have it in the body
+func archivedContext(ev rbmq.ArchivedEvent) context.Context {
+	if len(ev.Headers) > 0 {
+		return tracing.Extract(context.Background(), ev.Headers)
+	}
+	var event struct {
+		TraceContext map[string]string `json:"trace_context"`
+	}
+	if err := json.Unmarshal(ev.Body, &event); err != nil {
+		return context.Background()
+	}
+	return tracing.Extract(context.Background(), event.TraceContext)
+}
+
+func onlyQueue(dst []rbmq.Destination, queue string) []rbmq.Destination {
+	for _, d := range dst {
+		if d.Queue == queue {
+			return []rbmq.Destination{d}
+		}
+	}
+	return []rbmq.Destination{{Queue: queue}}
+}
@@ -23,8 +23,6 @@ type SessionsConfig struct {
 }
 
 func Init(conf SessionsConfig, r *gin.Engine) {
-	log.SetLevel(log.DebugLevel)
-
 	store = sessions.NewCookieStore([]byte(conf.Secret))
 	options := sessions.Options{
 		Path:     conf.Path,
@@ -75,6 +73,11 @@ func Set(name string, val interface{}, c *gin.Context) {
 	session.Set(name, val)
 }
 
+func Save(c *gin.Context) {
+	session := sessions.Default(c)
+	session.Save()
+}
+
 func getFromParamsOrSession(
 	tid string,
 	c *gin.Context,
@@ -9,11 +9,22 @@ import (
 	//"github.com/fvbock/endless"
 	"github.com/gin-gonic/gin"
 
+	"github.com/linkit360/go-dispatcherd/src/accesslog"
+	"github.com/linkit360/go-dispatcherd/src/anomaly"
+	"github.com/linkit360/go-dispatcherd/src/breaker"
+	"github.com/linkit360/go-dispatcherd/src/capture"
 	"github.com/linkit360/go-dispatcherd/src/config"
+	"github.com/linkit360/go-dispatcherd/src/guard"
 	"github.com/linkit360/go-dispatcherd/src/handlers"
+	"github.com/linkit360/go-dispatcherd/src/history"
+	"github.com/linkit360/go-dispatcherd/src/links"
 	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/postback"
 	"github.com/linkit360/go-dispatcherd/src/sessions"
-	"github.com/linkit360/go-utils/metrics"
+	"github.com/linkit360/go-dispatcherd/src/store"
+	"github.com/linkit360/go-dispatcherd/src/throttle"
+	"github.com/linkit360/go-dispatcherd/src/tracing"
+	"github.com/linkit360/go-dispatcherd/src/variants"
 )
 
 var conf config.AppConfig
@@ -25,13 +36,39 @@ func RunServer() {
 
 	conf = config.LoadConfig()
 	m.Init(conf.AppName)
+	m.InitFunnel(conf.Funnel)
+	tracing.Init(conf.AppName, conf.Tracing)
+	breaker.Init(conf.Breakers)
+	accesslog.Init(conf.AccessLog)
+	capture.Init(conf.Capture)
+	anomaly.Init(conf.Anomaly)
+	if err := store.Init(conf.Store); err != nil {
+		log.WithField("error", err.Error()).Fatal("cannot init content store")
+	}
+	if err := links.Init(conf.Links); err != nil {
+		log.WithField("error", err.Error()).Fatal("cannot init signed links")
+	}
+	guard.Init(conf.Guard)
+	throttle.Init(conf.Throttle)
+	if err := variants.Init(conf.Variants); err != nil {
+		log.WithField("error", err.Error()).Fatal("cannot init content variants")
+	}
+	if err := history.Init(conf.History); err != nil {
+		log.WithField("error", err.Error()).Fatal("cannot init content history")
+	}
+	postback.Init(conf.Postback)
 
 	e := gin.New()
 	handlers.Init(conf, e)
 
 	sessions.Init(conf.Server.Sessions, e)
-	metrics.AddHandler(e)
+	m.AddHandler(e)
 	handlers.AddContentHandlers()
+	handlers.AddHistoryHandlers()
+	handlers.AddLinkApiHandlers()
+	handlers.AddSchemaHandlers()
+	handlers.AddAdminHandlers()
+	handlers.AddHealthHandlers()
 
 	rg := e.Group("/campaign/:campaign_hash")
 	handlers.AddCampaignHandler(rg)
@@ -51,9 +88,15 @@ func RunServer() {
 func notFound(c *gin.Context) {
 	c.Error(errors.New("Not found"))
 	m.PageNotFoundError.Inc()
+	anomaly.Count("", anomaly.NotFound)
 	http.Redirect(c.Writer, c.Request, conf.Service.NotFoundRedirectUrl, 303)
 }
 
 func OnExit() {
 	handlers.SaveState()
+	postback.SaveState()
+	guard.SaveState()
+	handlers.CloseNotifier()
+	tracing.Shutdown()
+	accesslog.Close()
 }
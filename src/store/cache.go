@@ -0,0 +1,293 @@
+package store
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+// lru disk cache of the hot s3 objects
+// objects are immutable: a cached object is not revalidated,
+// the files left from the previous run are used in the order of their mtime
+
+type CacheConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+	MaxMB   int64  `default:"1024" yaml:"max_mb"`
+	// larger objects are always proxied
+	MaxItemMB int64 `default:"100" yaml:"max_item_mb"`
+}
+
+type cacheEntry struct {
+	key  string
+	file string
+	size int64
+}
+
+type diskCache struct {
+	conf     CacheConfig
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	size     int64
+	inflight map[string]*sync.WaitGroup
+}
+
+func newDiskCache(conf CacheConfig) (*diskCache, error) {
+	if conf.Path == "" {
+		return nil, fmt.Errorf("cache path required")
+	}
+	if err := os.MkdirAll(conf.Path, 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %s", err.Error())
+	}
+	c := &diskCache{
+		conf:     conf,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*sync.WaitGroup),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// the files are named by the key hash, the key is in the .key file near
+func (c *diskCache) load() error {
+	files, err := ioutil.ReadDir(c.conf.Path)
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadDir: %s", err.Error())
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) == ".key" || filepath.Ext(f.Name()) == ".tmp" {
+			continue
+		}
+		file := filepath.Join(c.conf.Path, f.Name())
+		key, err := ioutil.ReadFile(file + ".key")
+		if err != nil {
+			os.Remove(file)
+			continue
+		}
+		c.add(string(key), file, f.Size())
+	}
+	log.WithFields(log.Fields{
+		"path":  c.conf.Path,
+		"items": c.lru.Len(),
+		"mb":    c.size >> 20,
+	}).Info("content cache loaded")
+	return nil
+}
+
+func (c *diskCache) fits(size int64) bool {
+	return size <= c.conf.MaxItemMB<<20 && size <= c.conf.MaxMB<<20
+}
+
+func (c *diskCache) fileName(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return filepath.Join(c.conf.Path, hex.EncodeToString(hash[:])+path.Ext(key))
+}
+
+func (c *diskCache) open(key string) (Content, bool) {
+	c.mu.Lock()
+	if wg, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		wg.Wait()
+		c.mu.Lock()
+	}
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		m.StoreCacheMisses.Inc()
+		return nil, false
+	}
+	content, err := OpenFile(el.Value.(*cacheEntry).file)
+	if err != nil {
+		c.remove(key)
+		return nil, false
+	}
+	m.StoreCacheHits.Inc()
+	return &cachedContent{Content: content, key: key}, true
+}
+
+// fetch downloads the object into the cache, the concurrent fetches
+// of the same object wait for the first one
+func (c *diskCache) fetch(key string, obj *s3Object) (Content, error) {
+	c.mu.Lock()
+	if _, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		if content, ok := c.open(key); ok {
+			return content, nil
+		}
+		return obj, nil
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	c.inflight[key] = wg
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, key)
+		c.mu.Unlock()
+		wg.Done()
+	}()
+
+	// the object is proxied when it cannot be cached
+	file := c.fileName(key)
+	err := c.download(obj, file)
+	if err == nil {
+		if err = ioutil.WriteFile(file+".key", []byte(key), 0644); err != nil {
+			err = fmt.Errorf("ioutil.WriteFile: %s", err.Error())
+			os.Remove(file)
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"key":   key,
+			"error": err.Error(),
+		}).Error("cannot cache content")
+		if _, err := obj.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+	obj.Close()
+	c.mu.Lock()
+	c.add(key, file, obj.size)
+	c.evict()
+	c.mu.Unlock()
+
+	content, err := OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedContent{Content: content, key: key}, nil
+}
+
+func (c *diskCache) download(obj *s3Object, file string) error {
+	tmp, err := ioutil.TempFile(c.conf.Path, "download-*.tmp")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, obj); err != nil {
+		tmp.Close()
+		return fmt.Errorf("io.Copy: %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("tmp.Close: %s", err.Error())
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	return nil
+}
+
+// add is called under the lock
+func (c *diskCache) add(key, file string, size int64) {
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*cacheEntry).size
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, file: file, size: size})
+	c.size += size
+}
+
+// evict is called under the lock, the open files stay readable after the removal
+func (c *diskCache) evict() {
+	for c.size > c.conf.MaxMB<<20 && c.lru.Len() > 1 {
+		el := c.lru.Back()
+		entry := el.Value.(*cacheEntry)
+		c.lru.Remove(el)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		os.Remove(entry.file)
+		os.Remove(entry.file + ".key")
+		m.StoreCacheEvicted.Inc()
+	}
+}
+
+func (c *diskCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		c.size -= entry.size
+	}
+}
+
+// cachedContent is named by the object key, not by the cache file
+type cachedContent struct {
+	Content
+	key string
+}
+
+func (c *cachedContent) Name() string {
+	return c.key
+}
+
+// FileCache is the lru disk cache of the files made locally, i.e. the resized images
+type FileCache struct {
+	c *diskCache
+}
+
+func NewFileCache(conf CacheConfig) (*FileCache, error) {
+	c, err := newDiskCache(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &FileCache{c: c}, nil
+}
+
+// File is where the file of the key is to be written
+func (f *FileCache) File(key string) string {
+	return f.c.fileName(key)
+}
+
+// Get returns the cached file of the key
+func (f *FileCache) Get(key string) (string, bool) {
+	f.c.mu.Lock()
+	defer f.c.mu.Unlock()
+	el, ok := f.c.entries[key]
+	if !ok {
+		return "", false
+	}
+	f.c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).file, true
+}
+
+// Add keeps the file written to File(key), the least recently used files are removed
+func (f *FileCache) Add(key string, size int64) error {
+	file := f.c.fileName(key)
+	if err := ioutil.WriteFile(file+".key", []byte(key), 0644); err != nil {
+		os.Remove(file)
+		return fmt.Errorf("ioutil.WriteFile: %s", err.Error())
+	}
+	f.c.mu.Lock()
+	f.c.add(key, file, size)
+	f.c.evict()
+	f.c.mu.Unlock()
+	return nil
+}
+
+// Remove forgets the file of the key, i.e. removed from the disk
+func (f *FileCache) Remove(key string) {
+	f.c.remove(key)
+}
@@ -0,0 +1,342 @@
+package store
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+// s3 compatible bucket (aws, minio, ceph): signature v4, no sdk
+
+type S3Config struct {
+	// http://localhost:9000 for minio
+	Endpoint  string `default:"https://s3.amazonaws.com" yaml:"endpoint"`
+	Region    string `default:"us-east-1" yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// bucket in the path, not in the host: minio
+	PathStyle bool `yaml:"path_style"`
+	Timeout   int  `default:"30" yaml:"timeout"`
+}
+
+const (
+	upstreamStore   = "store"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptySha256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type s3Store struct {
+	conf     S3Config
+	endpoint *url.URL
+	client   *http.Client
+	cache    *diskCache
+	now      func() time.Time
+}
+
+func NewS3Store(conf S3Config, cacheConf CacheConfig) (*s3Store, error) {
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket required")
+	}
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %s", err.Error())
+	}
+	s := &s3Store{
+		conf:     conf,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Duration(conf.Timeout) * time.Second},
+		now:      time.Now,
+	}
+	if cacheConf.Enabled {
+		if s.cache, err = newDiskCache(cacheConf); err != nil {
+			return nil, fmt.Errorf("newDiskCache: %s", err.Error())
+		}
+	}
+	return s, nil
+}
+
+func (s *s3Store) key(p string) string {
+	return path.Join(s.conf.Prefix, cleanKey(p))
+}
+
+// objectURL is the url of the object, the bucket is in the host or in the path
+func (s *s3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.conf.PathStyle {
+		u.Path = "/" + s.conf.Bucket + "/" + key
+	} else {
+		u.Host = s.conf.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	return &u
+}
+
+func (s *s3Store) Open(ctx context.Context, p string) (Content, error) {
+	key := s.key(p)
+	if s.cache != nil {
+		if c, ok := s.cache.open(key); ok {
+			return c, nil
+		}
+	}
+	obj, err := s.head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if s.cache != nil && s.cache.fits(obj.size) {
+		return s.cache.fetch(key, obj)
+	}
+	return obj, nil
+}
+
+func (s *s3Store) PresignedURL(p string, ttl time.Duration, disposition string) (string, error) {
+	query := url.Values{}
+	if disposition != "" {
+		query.Set("response-content-disposition", disposition)
+	}
+	return s.presign("GET", s.key(p), query, ttl, s.now().UTC()), nil
+}
+
+func (s *s3Store) head(ctx context.Context, key string) (*s3Object, error) {
+	req, err := http.NewRequest("HEAD", s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %s", err.Error())
+	}
+	resp, err := s.do(ctx, "HeadObject", req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3Object{
+		store:   s,
+		ctx:     ctx,
+		key:     key,
+		size:    resp.ContentLength,
+		modTime: modTime,
+		etag:    resp.Header.Get("ETag"),
+	}, nil
+}
+
+// get reads the object from the offset to the end
+func (s *s3Store) get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %s", err.Error())
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := s.do(ctx, "GetObject", req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) do(ctx context.Context, call string, req *http.Request) (*http.Response, error) {
+	begin := time.Now()
+	s.sign(req, emptySha256, s.now().UTC())
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err == nil && resp.StatusCode >= 300 {
+		resp.Body.Close()
+		err = fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	m.ObserveUpstream(upstreamStore, call, time.Since(begin), err)
+	if err != nil {
+		return nil, fmt.Errorf("s3.%s: %s", call, err.Error())
+	}
+	return resp, nil
+}
+
+// s3Object is the proxied stream: every seek starts a ranged get on the next read
+type s3Object struct {
+	store   *s3Store
+	ctx     context.Context
+	key     string
+	size    int64
+	modTime time.Time
+	etag    string
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Name() string       { return o.key }
+func (o *s3Object) Size() int64        { return o.size }
+func (o *s3Object) ModTime() time.Time { return o.modTime }
+func (o *s3Object) ETag() string       { return o.etag }
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		body, err := o.store.get(o.ctx, o.key, o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return o.offset, fmt.Errorf("seek: negative offset")
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// signature v4 in the authorization header
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		name := strings.ToLower(k)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	signedHeaders, canonicalHeaders := canonicalHeaders(headers)
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := s.scope(now)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.conf.AccessKey, scope, signedHeaders, s.signature(now, amzDate, scope, canonical),
+	))
+}
+
+// signature v4 in the query string
+func (s *s3Store) presign(method, key string, query url.Values, ttl time.Duration, now time.Time) string {
+	u := s.objectURL(key)
+	amzDate := now.Format("20060102T150405Z")
+	scope := s.scope(now)
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.conf.AccessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	_, canonicalHeaders := canonicalHeaders(map[string]string{"host": u.Host})
+	canonical := strings.Join([]string{
+		method,
+		uriEncode(u.Path, false),
+		canonicalQuery(query),
+		canonicalHeaders,
+		"host",
+		unsignedPayload,
+	}, "\n")
+	u.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + s.signature(now, amzDate, scope, canonical)
+	return u.String()
+}
+
+func (s *s3Store) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.conf.Region + "/s3/aws4_request"
+}
+
+func (s *s3Store) signature(now time.Time, amzDate, scope, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSha256([]byte("AWS4"+s.conf.SecretKey), now.Format("20060102"))
+	key = hmacSha256(key, s.conf.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	return hex.EncodeToString(hmacSha256(key, stringToSign))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalHeaders(headers map[string]string) (signed, canonical string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		canonical += name + ":" + headers[name] + "\n"
+	}
+	return strings.Join(names, ";"), canonical
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// aws uri encoding: everything but the unreserved characters, slash is kept in paths
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch >= 'A' && ch <= 'Z', ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package store
+
+// uploaded content storage: the local disk or an s3 compatible bucket
+// content path is the ContentPath from contentd, relative to the store root
+//
+// s3 content is either proxied (streamed through the dispatcher, hot items
+// are kept in the local lru disk cache) or the client is redirected to
+// the presigned url
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type StoreConfig struct {
+	// local | s3
+	Type string `default:"local" yaml:"type"`
+	// local root, default: <server.path>/uploaded_content/
+	Path string `yaml:"path"`
+	// proxy | redirect (s3 only)
+	Delivery   string      `default:"proxy" yaml:"delivery"`
+	PresignTTL int         `default:"300" yaml:"presign_ttl_sec"`
+	S3         S3Config    `yaml:"s3"`
+	Cache      CacheConfig `yaml:"cache"`
+}
+
+const (
+	DeliveryProxy    = "proxy"
+	DeliveryRedirect = "redirect"
+)
+
+var ErrNoPresign = errors.New("store cannot presign urls")
+
+// ContentStore is where the content files are
+type ContentStore interface {
+	// Open opens the content for reading, seeks are needed for byte ranges
+	Open(ctx context.Context, path string) (Content, error)
+	// PresignedURL is the temporary direct download url,
+	// disposition overrides the stored Content-Disposition when not empty
+	PresignedURL(path string, ttl time.Duration, disposition string) (string, error)
+}
+
+type Content interface {
+	io.ReadSeeker
+	io.Closer
+	Name() string
+	Size() int64
+	ModTime() time.Time
+	ETag() string
+}
+
+var (
+	conf StoreConfig
+	cs   ContentStore
+)
+
+func Init(storeConf StoreConfig) error {
+	conf = storeConf
+	switch conf.Type {
+	case "", "local":
+		cs = NewLocalStore(conf.Path)
+	case "s3":
+		s3, err := NewS3Store(conf.S3, conf.Cache)
+		if err != nil {
+			return fmt.Errorf("NewS3Store: %s", err.Error())
+		}
+		cs = s3
+	default:
+		return fmt.Errorf("unknown store type: %s", conf.Type)
+	}
+	if conf.Delivery == DeliveryRedirect && conf.Type != "s3" {
+		return fmt.Errorf("redirect delivery needs s3 store")
+	}
+	log.WithFields(log.Fields{
+		"type":     conf.Type,
+		"delivery": conf.Delivery,
+	}).Info("content store init")
+	return nil
+}
+
+func Open(ctx context.Context, path string) (Content, error) {
+	return cs.Open(ctx, path)
+}
+
+// Redirect is true when the clients download from the store directly
+func Redirect() bool {
+	return conf.Delivery == DeliveryRedirect
+}
+
+func PresignedURL(path, disposition string) (string, error) {
+	return cs.PresignedURL(path, time.Duration(conf.PresignTTL)*time.Second, disposition)
+}
@@ -0,0 +1,285 @@
+package throttle
+
+// concurrency and bandwidth limits of the content downloads
+//
+// max_downloads downloads are sent at once, max_per_ip of one ip; a download
+// waits for a free slot up to queue_sec (max_queue downloads wait), then it is
+// rejected with 503 and Retry-After
+// bandwidth_kbps is shared by all the downloads, per_ip_kbps by the downloads of one ip
+//
+// the landing routes are never limited: while landing_busy landing requests
+// are in flight no new download starts and the running ones are sent
+// at busy_bandwidth_kbps, so a content spike cannot starve the acquisition traffic
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+type ThrottleConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// concurrent downloads, 0: unlimited
+	MaxDownloads int `default:"200" yaml:"max_downloads"`
+	MaxPerIP     int `default:"2" yaml:"max_per_ip"`
+	// the wait for a free slot, 0: rejected at once
+	QueueSec      int `default:"5" yaml:"queue_sec"`
+	MaxQueue      int `default:"100" yaml:"max_queue"`
+	RetryAfterSec int `default:"30" yaml:"retry_after_sec"`
+	// KB/s, 0: unlimited
+	BandwidthKBps int `yaml:"bandwidth_kbps"`
+	PerIPKBps     int `yaml:"per_ip_kbps"`
+	// landing requests in flight to give way to them, 0: never
+	LandingBusy       int `default:"100" yaml:"landing_busy"`
+	BusyBandwidthKBps int `yaml:"busy_bandwidth_kbps"`
+}
+
+var (
+	ErrBusy   = errors.New("too many downloads")
+	ErrIPBusy = errors.New("too many downloads of the ip")
+)
+
+var (
+	conf ThrottleConfig
+	mu   sync.Mutex
+	// closed and replaced when a slot is freed or the landings calm down
+	freed   chan struct{}
+	active  int
+	waiting int
+	landing int
+	ips     map[string]*ipState
+	global  *bucket
+)
+
+type ipState struct {
+	downloads int
+	bucket    *bucket
+}
+
+func Init(throttleConf ThrottleConfig) {
+	conf = throttleConf
+	if !conf.Enabled {
+		return
+	}
+	freed = make(chan struct{})
+	ips = make(map[string]*ipState)
+	global = newBucket(globalRate)
+	log.WithFields(log.Fields{
+		"max_downloads":  conf.MaxDownloads,
+		"max_per_ip":     conf.MaxPerIP,
+		"bandwidth_kbps": conf.BandwidthKBps,
+		"landing_busy":   conf.LandingBusy,
+	}).Info("download throttle init")
+}
+
+func Enabled() bool {
+	return conf.Enabled
+}
+
+func RetryAfter() int {
+	return conf.RetryAfterSec
+}
+
+// Landing is called when a landing request begins, the returned func when it ends
+func Landing() func() {
+	if !conf.Enabled {
+		return func() {}
+	}
+	mu.Lock()
+	landing++
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		landing--
+		if waiting > 0 && !landingBusy() {
+			broadcast()
+		}
+		mu.Unlock()
+	}
+}
+
+// Slot is the download allowed to be sent
+type Slot struct {
+	ip       string
+	ipBucket *bucket
+	started  bool
+	once     sync.Once
+}
+
+// Acquire waits for a free download slot of the ip
+func Acquire(ctx context.Context, ip string) (*Slot, error) {
+	if !conf.Enabled {
+		return &Slot{}, nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if conf.MaxPerIP > 0 && ips[ip] != nil && ips[ip].downloads >= conf.MaxPerIP {
+		return nil, ErrIPBusy
+	}
+	if free() {
+		return start(ip), nil
+	}
+	if conf.QueueSec <= 0 || (conf.MaxQueue > 0 && waiting >= conf.MaxQueue) {
+		return nil, ErrBusy
+	}
+
+	waiting++
+	m.DownloadsActive.WithLabelValues("queued").Set(float64(waiting))
+	defer func() {
+		waiting--
+		m.DownloadsActive.WithLabelValues("queued").Set(float64(waiting))
+	}()
+	timeout := time.NewTimer(time.Duration(conf.QueueSec) * time.Second)
+	defer timeout.Stop()
+	for {
+		wait := freed
+		mu.Unlock()
+		select {
+		case <-wait:
+		case <-timeout.C:
+			mu.Lock()
+			return nil, ErrBusy
+		case <-ctx.Done():
+			mu.Lock()
+			return nil, ctx.Err()
+		}
+		mu.Lock()
+		if conf.MaxPerIP > 0 && ips[ip] != nil && ips[ip].downloads >= conf.MaxPerIP {
+			return nil, ErrIPBusy
+		}
+		if free() {
+			return start(ip), nil
+		}
+	}
+}
+
+// Release frees the slot, safe to call more than once
+func (s *Slot) Release() {
+	if !s.started {
+		return
+	}
+	s.once.Do(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		active--
+		m.DownloadsActive.WithLabelValues("active").Set(float64(active))
+		if state := ips[s.ip]; state != nil {
+			state.downloads--
+			if state.downloads <= 0 {
+				delete(ips, s.ip)
+			}
+		}
+		broadcast()
+	})
+}
+
+// Wait blocks until n bytes may be sent
+func (s *Slot) Wait(ctx context.Context, n int) error {
+	if !s.started {
+		return nil
+	}
+	if err := global.wait(ctx, n); err != nil {
+		return err
+	}
+	if s.ipBucket != nil {
+		return s.ipBucket.wait(ctx, n)
+	}
+	return nil
+}
+
+// the caller holds mu
+func free() bool {
+	if landingBusy() {
+		return false
+	}
+	return conf.MaxDownloads <= 0 || active < conf.MaxDownloads
+}
+
+func landingBusy() bool {
+	return conf.LandingBusy > 0 && landing >= conf.LandingBusy
+}
+
+func start(ip string) *Slot {
+	active++
+	m.DownloadsActive.WithLabelValues("active").Set(float64(active))
+	state := ips[ip]
+	if state == nil {
+		state = &ipState{}
+		if conf.PerIPKBps > 0 {
+			state.bucket = newBucket(func() int { return conf.PerIPKBps * 1024 })
+		}
+		ips[ip] = state
+	}
+	state.downloads++
+	return &Slot{ip: ip, ipBucket: state.bucket, started: true}
+}
+
+func broadcast() {
+	close(freed)
+	freed = make(chan struct{})
+}
+
+// bytes a second of all the downloads, 0: unlimited
+func globalRate() int {
+	mu.Lock()
+	busy := landingBusy()
+	mu.Unlock()
+	if busy && conf.BusyBandwidthKBps > 0 {
+		return conf.BusyBandwidthKBps * 1024
+	}
+	return conf.BandwidthKBps * 1024
+}
+
+// bucket is the token bucket of a second burst, the tokens may go below zero:
+// the writer that took them sleeps until they are refilled
+type bucket struct {
+	sync.Mutex
+	rate   func() int
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate func() int) *bucket {
+	return &bucket{rate: rate, tokens: float64(rate()), last: time.Now()}
+}
+
+func (b *bucket) wait(ctx context.Context, n int) error {
+	delay := b.take(n, time.Now())
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take returns the time to wait before sending n bytes
+func (b *bucket) take(n int, now time.Time) time.Duration {
+	rate := float64(b.rate())
+	b.Lock()
+	defer b.Unlock()
+	if rate <= 0 {
+		b.last = now
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
@@ -0,0 +1,78 @@
+package throttle
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+)
+
+func TestMain(t *testing.M) {
+	m.Init("dispatcherd_test")
+	os.Exit(t.Run())
+}
+
+func TestAcquire(t *testing.T) {
+	Init(ThrottleConfig{Enabled: true, MaxDownloads: 2, MaxPerIP: 1, QueueSec: 1, MaxQueue: 1})
+	ctx := context.Background()
+
+	first, err := Acquire(ctx, "10.0.0.1")
+	assert.NoError(t, err)
+	_, err = Acquire(ctx, "10.0.0.1")
+	assert.Equal(t, ErrIPBusy, err)
+	second, err := Acquire(ctx, "10.0.0.2")
+	assert.NoError(t, err)
+
+	// queued until the first one is done
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Release()
+		first.Release()
+	}()
+	third, err := Acquire(ctx, "10.0.0.3")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, active)
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = Acquire(timeout, "10.0.0.4")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	second.Release()
+	third.Release()
+	assert.Equal(t, 0, active)
+	assert.Empty(t, ips)
+}
+
+func TestLandingFirst(t *testing.T) {
+	Init(ThrottleConfig{Enabled: true, MaxDownloads: 10, LandingBusy: 1,
+		BandwidthKBps: 100, BusyBandwidthKBps: 10})
+	assert.Equal(t, 100*1024, globalRate())
+
+	done := Landing()
+	_, err := Acquire(context.Background(), "10.0.0.1")
+	assert.Equal(t, ErrBusy, err, "no queue")
+	assert.Equal(t, 10*1024, globalRate())
+
+	done()
+	slot, err := Acquire(context.Background(), "10.0.0.1")
+	assert.NoError(t, err)
+	slot.Release()
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := &bucket{rate: func() int { return 1000 }, tokens: 1000, last: now}
+	assert.Equal(t, time.Duration(0), b.take(1000, now))
+	assert.Equal(t, 500*time.Millisecond, b.take(500, now))
+	assert.Equal(t, time.Duration(0), b.take(500, now.Add(time.Second)), "refilled")
+	assert.Equal(t, time.Duration(0), b.take(1000, now.Add(time.Hour)), "one second burst")
+	assert.Equal(t, time.Second, b.take(1000, now.Add(time.Hour)))
+
+	unlimited := &bucket{rate: func() int { return 0 }, last: now}
+	assert.Equal(t, time.Duration(0), unlimited.take(1<<20, now))
+}
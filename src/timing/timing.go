@@ -0,0 +1,113 @@
+package timing
+
+// Server-Timing response header: durations of the request steps,
+// the calls of the same step are summed up
+//
+//	Server-Timing: session;dur=0.4, gather;dur=0.2, mid;dur=12.1;desc="2 calls", render;dur=1.3, total;dur=15.2
+//
+// the timings are kept in the request context, so the packages
+// without gin (notifier) can add their steps
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TimingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// the response is buffered up to this size to send the header after the handler,
+	// larger responses get the timings known at the moment
+	MaxBufferKB int `default:"64" yaml:"max_buffer_kb"`
+}
+
+// steps
+const (
+	Session  = "session"
+	Gather   = "gather"
+	Mid      = "mid"
+	Contentd = "contentd"
+	Partners = "partners"
+	Operator = "operator"
+	Render   = "render"
+	Notify   = "notify"
+	Total    = "total"
+)
+
+type step struct {
+	name  string
+	took  time.Duration
+	calls int
+}
+
+type Timings struct {
+	mu    sync.Mutex
+	steps []*step
+}
+
+func New() *Timings {
+	return &Timings{}
+}
+
+// Add is safe to call on nil: timings are off
+func (t *Timings) Add(name string, took time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.steps {
+		if s.name == name {
+			s.took += took
+			s.calls++
+			return
+		}
+	}
+	t.steps = append(t.steps, &step{name: name, took: took, calls: 1})
+}
+
+func (t *Timings) Since(name string, begin time.Time) {
+	t.Add(name, time.Since(begin))
+}
+
+// Header is the Server-Timing value, total is added when it's not zero
+func (t *Timings) Header(total time.Duration) string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, 0, len(t.steps)+1)
+	for _, s := range t.steps {
+		part := fmt.Sprintf("%s;dur=%.1f", s.name, ms(s.took))
+		if s.calls > 1 {
+			part += fmt.Sprintf(";desc=\"%d calls\"", s.calls)
+		}
+		parts = append(parts, part)
+	}
+	if total > 0 {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.1f", Total, ms(total)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type timingsKey struct{}
+
+func NewContext(ctx context.Context, t *Timings) context.Context {
+	return context.WithValue(ctx, timingsKey{}, t)
+}
+
+// FromContext returns nil when the timings are off
+func FromContext(ctx context.Context) *Timings {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(timingsKey{}).(*Timings)
+	return t
+}
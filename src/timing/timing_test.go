@@ -0,0 +1,25 @@
+package timing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeader(t *testing.T) {
+	var off *Timings
+	off.Add(Mid, time.Second)
+	assert.Equal(t, "", off.Header(time.Second))
+	assert.Nil(t, FromContext(context.Background()))
+
+	timings := New()
+	ctx := NewContext(context.Background(), timings)
+	FromContext(ctx).Add(Session, 400*time.Microsecond)
+	FromContext(ctx).Add(Mid, 5*time.Millisecond)
+	FromContext(ctx).Add(Mid, 7100*time.Microsecond)
+	assert.Equal(t,
+		`session;dur=0.4, mid;dur=12.1;desc="2 calls", total;dur=15.2`,
+		timings.Header(15200*time.Microsecond))
+}
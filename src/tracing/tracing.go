@@ -0,0 +1,143 @@
+package tracing
+
+// opentelemetry spans for the handled requests and the outbound calls
+// exporters: stdout (local runs) and otlp over http
+// trace context is propagated in outbound http headers
+// and in the amqp headers of the published events
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type TracingConfig struct {
+	Enabled     bool    `yaml:"enabled"`
+	Exporter    string  `yaml:"exporter" default:"stdout"`
+	Endpoint    string  `yaml:"endpoint" default:"localhost:4318"`
+	Insecure    bool    `yaml:"insecure"`
+	SampleRatio float64 `yaml:"sample_ratio" default:"1"`
+}
+
+const (
+	AttrTid          = attribute.Key("tid")
+	AttrCampaignId   = attribute.Key("campaign_id")
+	AttrOperatorCode = attribute.Key("operator_code")
+	AttrUpstream     = attribute.Key("upstream")
+	AttrCall         = attribute.Key("call")
+)
+
+var provider *sdktrace.TracerProvider
+var tracer trace.Tracer = otel.Tracer("dispatcherd")
+var propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{}, propagation.Baggage{})
+
+// when disabled the global no-op tracer is used, spans cost nothing
+func Init(appName string, conf TracingConfig) {
+	otel.SetTextMapPropagator(propagator)
+	if !conf.Enabled {
+		return
+	}
+	exporter, err := newExporter(conf)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"exporter": conf.Exporter,
+			"error":    err.Error(),
+		}).Fatal("cannot init tracing exporter")
+	}
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(appName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("dispatcherd")
+	log.WithFields(log.Fields{
+		"exporter": conf.Exporter,
+		"endpoint": conf.Endpoint,
+		"ratio":    conf.SampleRatio,
+	}).Info("tracing init")
+}
+
+func newExporter(conf TracingConfig) (sdktrace.SpanExporter, error) {
+	switch conf.Exporter {
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.Endpoint)}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(context.Background(), opts...)
+	}
+	return nil, fmt.Errorf("unknown exporter: %s", conf.Exporter)
+}
+
+// Shutdown flushes the spans not exported yet
+func Shutdown() {
+	if provider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		log.WithField("error", err.Error()).Error("tracing shutdown")
+	}
+}
+
+func Tracer() trace.Tracer {
+	return tracer
+}
+
+func Attributes(tid, campaignId string, operatorCode int64) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, 3)
+	if tid != "" {
+		attrs = append(attrs, AttrTid.String(tid))
+	}
+	if campaignId != "" {
+		attrs = append(attrs, AttrCampaignId.String(campaignId))
+	}
+	if operatorCode != 0 {
+		attrs = append(attrs, AttrOperatorCode.String(strconv.FormatInt(operatorCode, 10)))
+	}
+	return attrs
+}
+
+// Inject returns the trace context of ctx to be sent with an event,
+// nil when there is no span
+func Inject(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier
+}
+
+// Extract is the reverse of Inject, the replay spans are children of the archived trace context
+func Extract(ctx context.Context, traceContext map[string]string) context.Context {
+	if len(traceContext) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(traceContext))
+}
+
+func Propagator() propagation.TextMapPropagator {
+	return propagator
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const RotateTimeFormat = "20060102-150405.000000000"
+
+// RotatingFile appends lines to <dir>/<prefix><time of the first line><suffix>,
+// a new file is opened when the size or the age limit is reached
+type RotatingFile struct {
+	dir      string
+	prefix   string
+	suffix   string
+	maxBytes int64
+	maxAge   time.Duration
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func NewRotatingFile(dir, prefix, suffix string, maxBytes int64, maxAge time.Duration) (*RotatingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %s", err.Error())
+	}
+	return &RotatingFile{
+		dir:      dir,
+		prefix:   prefix,
+		suffix:   suffix,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}, nil
+}
+
+func (r *RotatingFile) Write(line []byte, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.rotate(now); err != nil {
+		return err
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("file.Write: %s", err.Error())
+	}
+	return nil
+}
+
+func (r *RotatingFile) rotate(now time.Time) error {
+	if r.file != nil &&
+		r.size < r.maxBytes &&
+		now.Sub(r.openedAt) < r.maxAge {
+		return nil
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	name := filepath.Join(r.dir, r.prefix+now.UTC().Format(RotateTimeFormat)+r.suffix)
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		r.file = nil
+		return fmt.Errorf("os.OpenFile: %s", err.Error())
+	}
+	r.file = file
+	r.size = 0
+	r.openedAt = now
+	return nil
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
@@ -2,37 +2,157 @@ package utils
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-dispatcherd/src/store"
 )
 
-func ServeAttachment(filePath, name string, c *gin.Context, logCtx *log.Entry) error {
+// Delivery is what was actually sent: range and conditional requests
+// may get a part of the file or no body at all
+type Delivery struct {
+	Status   int    // 200 - file, 206 - byte range, 304 - not modified
+	Bytes    int64  // body bytes written
+	Expected int64  // Content-Length of the response
+	Size     int64  // file size
+	Range    string // Range request header
+	Variant  string // rendition or image size sent, empty for the original
+}
+
+// Partial is a byte range or a download interrupted by the client
+func (d Delivery) Partial() bool {
+	return d.Status == http.StatusPartialContent || d.Bytes < d.Expected
+}
+
+// ServeAttachment streams the content with byte ranges, ETag and Last-Modified,
+// name is the download name without the extension
+func ServeAttachment(content store.Content, name string, c *gin.Context, logCtx *log.Entry) (d Delivery, err error) {
 	logCtx.WithFields(log.Fields{
-		"path": filePath,
+		"path": content.Name(),
 		"name": name,
 	}).Debug("serve file")
 
-	w := c.Writer
-
-	content, err := ioutil.ReadFile(filePath)
+	contentType, err := detectContentType(content)
 	if err != nil {
-		log.WithField("error", err.Error()).Error("ioutil.ReadFile serve file error")
-		err := fmt.Errorf("ioutil.ReadFile: %s", err.Error())
-		return err
+		return d, fmt.Errorf("detectContentType: %s", err.Error())
 	}
 
-	ff := strings.Split(filePath, ".")
-	fileName := name + "." + ff[len(ff)-1]
-
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
-	w.Header().Set("Content-Type", "application; charset-utf-8")
-	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0, must-revalidate")
+	fileName := name + filepath.Ext(content.Name())
+	w := &countingWriter{ResponseWriter: c.Writer}
+	w.Header().Set("Content-Disposition", ContentDisposition(fileName))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", content.ETag())
+	// cached copies must be revalidated: If-None-Match / If-Modified-Since
+	w.Header().Set("Cache-Control", "private, no-cache, max-age=0, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
-	w.WriteHeader(200)
-	w.Write(content)
-	return nil
+	http.ServeContent(w, c.Request, fileName, content.ModTime(), content)
+
+	d = Delivery{
+		Status: w.status,
+		Bytes:  w.bytes,
+		Size:   content.Size(),
+		Range:  c.Request.Header.Get("Range"),
+	}
+	if d.Status == 0 {
+		d.Status = http.StatusOK
+	}
+	if c.Request.Method != "HEAD" {
+		d.Expected, _ = strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	}
+	return d, nil
+}
+
+// content types of the handsets, not in the go table and often missing in /etc/mime.types
+var contentTypes = map[string]string{
+	".3gp": "video/3gpp",
+	".mp4": "video/mp4",
+	".mp3": "audio/mpeg",
+	".m4a": "audio/mp4",
+	".amr": "audio/amr",
+	".jar": "application/java-archive",
+	".jad": "text/vnd.sun.j2me.app-descriptor",
+	".apk": "application/vnd.android.package-archive",
+}
+
+func init() {
+	for ext, ct := range contentTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, ct)
+		}
+	}
+}
+
+// by the extension, the content sniffing for the unknown ones
+func detectContentType(content store.Content) (string, error) {
+	if ct := mime.TypeByExtension(filepath.Ext(content.Name())); ct != "" {
+		return ct, nil
+	}
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(content, buf)
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// ContentDisposition is the RFC 6266 attachment header: the quoted ascii
+// filename for the old handsets and the utf-8 filename* for the rest
+func ContentDisposition(fileName string) string {
+	fallback := make([]byte, 0, len(fileName))
+	ascii := true
+	for _, r := range fileName {
+		switch {
+		case r == '"' || r == '\\' || r < 0x20 || r == 0x7f:
+			fallback = append(fallback, '_')
+		case r > 0x7f:
+			fallback = append(fallback, '_')
+			ascii = false
+		default:
+			fallback = append(fallback, byte(r))
+		}
+	}
+	header := fmt.Sprintf("attachment; filename=\"%s\"", fallback)
+	if !ascii {
+		header += "; filename*=UTF-8''" + encodeRFC5987(fileName)
+	}
+	return header
+}
+
+func encodeRFC5987(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", ch) >= 0 {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
 }
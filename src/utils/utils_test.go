@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/linkit360/go-dispatcherd/src/store"
+)
+
+func serve(t *testing.T, path string, header http.Header) (*httptest.ResponseRecorder, Delivery) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/u/get", nil)
+	for k := range header {
+		c.Request.Header.Set(k, header.Get(k))
+	}
+	content, err := store.OpenFile(path)
+	assert.NoError(t, err)
+	defer content.Close()
+	d, err := ServeAttachment(content, "Видео", c, log.WithField("test", t.Name()))
+	assert.NoError(t, err)
+	c.Writer.WriteHeaderNow()
+	return w, d
+}
+
+func TestServeAttachment(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir, err := ioutil.TempDir("", "serve")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "content.3gp")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("0123456789"), 0644))
+
+	w, d := serve(t, path, nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "video/3gpp", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="_____.3gp"; filename*=UTF-8''%D0%92%D0%B8%D0%B4%D0%B5%D0%BE.3gp`,
+		w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	assert.Equal(t, Delivery{Status: 200, Bytes: 10, Expected: 10, Size: 10}, d)
+	assert.False(t, d.Partial())
+
+	w, d = serve(t, path, http.Header{"Range": {"bytes=4-"}})
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "456789", w.Body.String())
+	assert.True(t, d.Partial())
+	assert.Equal(t, "bytes=4-", d.Range)
+
+	etag := w.Header().Get("ETag")
+	w, d = serve(t, path, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, 304, w.Code)
+	assert.Equal(t, 304, d.Status)
+	assert.Equal(t, int64(0), d.Bytes)
+	assert.False(t, d.Partial())
+}
+
+func TestContentDisposition(t *testing.T) {
+	assert.Equal(t, `attachment; filename="song.mp3"`, ContentDisposition("song.mp3"))
+	assert.Equal(t, `attachment; filename="a_b_.jar"`, ContentDisposition(`a"b\.jar`))
+}
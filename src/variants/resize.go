@@ -0,0 +1,307 @@
+package variants
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/linkit360/go-dispatcherd/src/store"
+)
+
+// images are resized by the box filter, downscale only; gifs are not resized to keep the animation
+// images over max_megapixels are not decoded, the resized copies are in the lru cache of cache_max_mb
+// a copy is made once for the concurrent requests of it, max_resizes images are decoded at once
+
+type size struct {
+	W, H int
+}
+
+func (s size) String() string {
+	return strconv.Itoa(s.W) + "x" + strconv.Itoa(s.H)
+}
+
+func parseSize(v string) (size, bool) {
+	w, h, ok := parsePair(v)
+	return size{W: w, H: h}, ok
+}
+
+func resizable(ext string) bool {
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".png"
+}
+
+// chooseSize returns the largest size fitting the screen, the smallest one when none fits,
+// the sizes are turned to the orientation of the screen
+func chooseSize(sizes []size, d Device, explicit string) (size, bool) {
+	if explicit != "" {
+		s, ok := parseSize(explicit)
+		if !ok {
+			return s, false
+		}
+		for _, allowed := range sizes {
+			if allowed == s {
+				return s, true
+			}
+		}
+		return s, false
+	}
+	if d.Width == 0 || len(sizes) == 0 {
+		return size{}, false
+	}
+	landscape := d.Height > 0 && d.Width > d.Height
+	var best, smallest size
+	for _, s := range sizes {
+		if landscape != (s.W > s.H) {
+			s = size{W: s.H, H: s.W}
+		}
+		if smallest.W == 0 || s.W*s.H < smallest.W*smallest.H {
+			smallest = s
+		}
+		if s.W <= d.Width && (d.Height == 0 || s.H <= d.Height) && s.W*s.H > best.W*best.H {
+			best = s
+		}
+	}
+	if best.W == 0 {
+		return smallest, true
+	}
+	return best, true
+}
+
+var imageCache *store.FileCache
+
+// tooLargeError: the image is over max_megapixels, it is remembered and sent as it is
+type tooLargeError struct {
+	W, H int
+}
+
+func (e tooLargeError) Error() string {
+	return fmt.Sprintf("image is too large: %dx%d", e.W, e.H)
+}
+
+// resizing is the copy being made, the requests of it wait for done
+type resizing struct {
+	done chan struct{}
+	file string
+	err  error
+}
+
+var (
+	resizeMutex sync.Mutex
+	inFlight    map[string]*resizing
+	// content path: tooLargeError
+	oversized map[string]error
+	// a slot is taken for the decoding and encoding
+	resizeSlots chan struct{}
+	// replaced in tests
+	decode = image.Decode
+)
+
+func initResize(imagesConf ImagesConfig) {
+	slots := imagesConf.MaxResizes
+	if slots <= 0 {
+		slots = runtime.NumCPU()
+	}
+	resizeMutex.Lock()
+	defer resizeMutex.Unlock()
+	inFlight = map[string]*resizing{}
+	oversized = map[string]error{}
+	resizeSlots = make(chan struct{}, slots)
+}
+
+func initImageCache(imagesConf ImagesConfig) (err error) {
+	if imagesConf.CachePath == "" {
+		return fmt.Errorf("images cache path required")
+	}
+	imageCache, err = store.NewFileCache(store.CacheConfig{
+		Enabled:   true,
+		Path:      imagesConf.CachePath,
+		MaxMB:     imagesConf.CacheMaxMB,
+		MaxItemMB: imagesConf.CacheMaxMB,
+	})
+	if err != nil {
+		return fmt.Errorf("store.NewFileCache: %s", err.Error())
+	}
+	return nil
+}
+
+// resizeImage returns the resized copy in the cache, made on the first request
+func resizeImage(ctx context.Context, contentPath string, s size) (string, error) {
+	ext := filepath.Ext(contentPath)
+	key := strings.TrimSuffix(contentPath, ext) + "_" + s.String() + strings.ToLower(ext)
+	if file, ok := imageCache.Get(key); ok {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+		imageCache.Remove(key)
+	}
+
+	resizeMutex.Lock()
+	if err, ok := oversized[contentPath]; ok {
+		resizeMutex.Unlock()
+		return "", err
+	}
+	if r, ok := inFlight[key]; ok {
+		resizeMutex.Unlock()
+		select {
+		case <-r.done:
+			return r.file, r.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	r := &resizing{done: make(chan struct{})}
+	inFlight[key] = r
+	resizeMutex.Unlock()
+
+	r.file, r.err = resize(ctx, contentPath, key, s)
+
+	resizeMutex.Lock()
+	delete(inFlight, key)
+	if _, ok := r.err.(tooLargeError); ok {
+		oversized[contentPath] = r.err
+	}
+	resizeMutex.Unlock()
+	close(r.done)
+	return r.file, r.err
+}
+
+func resize(ctx context.Context, contentPath, key string, s size) (string, error) {
+	content, err := store.Open(ctx, contentPath)
+	if err != nil {
+		return "", fmt.Errorf("store.Open: %s", err.Error())
+	}
+	defer content.Close()
+	config, _, err := image.DecodeConfig(content)
+	if err != nil {
+		return "", fmt.Errorf("image.DecodeConfig: %s", err.Error())
+	}
+	if max := conf.Images.MaxMegapixels; max > 0 && int64(config.Width)*int64(config.Height) > int64(max)*1000000 {
+		return "", tooLargeError{W: config.Width, H: config.Height}
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("content.Seek: %s", err.Error())
+	}
+	select {
+	case resizeSlots <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-resizeSlots }()
+	src, format, err := decode(content)
+	if err != nil {
+		return "", fmt.Errorf("image.Decode: %s", err.Error())
+	}
+	dst := cover(src, s.W, s.H)
+
+	file := imageCache.File(key)
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "resize-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("ioutil.TempFile: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if format == "png" {
+		err = png.Encode(tmp, dst)
+	} else {
+		err = jpeg.Encode(tmp, dst, &jpeg.Options{Quality: conf.Images.Quality})
+	}
+	if err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("%s.Encode: %s", format, err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("tmp.Close: %s", err.Error())
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return "", fmt.Errorf("os.Stat: %s", err.Error())
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return "", fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	if err := imageCache.Add(key, info.Size()); err != nil {
+		return "", fmt.Errorf("imageCache.Add: %s", err.Error())
+	}
+	return file, nil
+}
+
+// cover scales the image to cover w x h and crops the center,
+// the smaller images are cropped only
+func cover(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	scale := float64(w) / float64(b.Dx())
+	if hs := float64(h) / float64(b.Dy()); hs > scale {
+		scale = hs
+	}
+	if scale > 1 {
+		scale = 1
+	}
+	// the part of the source shown
+	cropW, cropH := int(float64(w)/scale), int(float64(h)/scale)
+	if cropW > b.Dx() {
+		cropW = b.Dx()
+	}
+	if cropH > b.Dy() {
+		cropH = b.Dy()
+	}
+	crop := image.Rect(0, 0, cropW, cropH).Add(b.Min).Add(image.Pt((b.Dx()-cropW)/2, (b.Dy()-cropH)/2))
+
+	rgba := image.NewRGBA(image.Rect(0, 0, cropW, cropH))
+	draw.Draw(rgba, rgba.Bounds(), src, crop.Min, draw.Src)
+	dw, dh := int(float64(cropW)*scale+0.5), int(float64(cropH)*scale+0.5)
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	return boxResize(rgba, dw, dh)
+}
+
+// boxResize averages the source pixels of every destination pixel
+func boxResize(src *image.RGBA, w, h int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw == w && sh == h {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					b += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,334 @@
+package variants
+
+// renditions of the content for the handset
+//
+// renditions are stored near the content: <content path without extension><suffix>,
+// 123.mp4 has 123_240p.3gp, 123_480p.mp4 ...
+// the rendition is chosen by ?variant=<name>, else by the screen of the handset:
+// ?w=&h= hints, UA-Pixels, X-Up-Devcap-Screenpixels, client hints, WxH in the user agent;
+// the largest rendition fitting the screen is sent, the original one when the screen
+// is larger than all of them, feature phones get the smallest one when nothing fits
+//
+// images are resized (cover and crop) to the largest of images.sizes fitting the screen,
+// resized copies are kept in images.cache_path up to images.cache_max_mb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/store"
+)
+
+type VariantsConfig struct {
+	Enabled    bool         `yaml:"enabled"`
+	Renditions []Rendition  `yaml:"renditions"`
+	Images     ImagesConfig `yaml:"images"`
+	// the renditions found (or not) in the store are remembered for
+	ProbeCacheSec int `default:"300" yaml:"probe_cache_sec"`
+}
+
+type Rendition struct {
+	// ?variant=<name>
+	Name string `yaml:"name"`
+	// replaces the extension of the content: _240p.3gp
+	Suffix string `yaml:"suffix"`
+	Width  int    `yaml:"width"`
+	Height int    `yaml:"height"`
+	// extensions of the content having the rendition: [.mp4, .avi]
+	For []string `yaml:"for"`
+	// for feature phones only: 3gp
+	FeaturePhones bool `yaml:"feature_phones"`
+}
+
+type ImagesConfig struct {
+	Resize bool `yaml:"resize"`
+	// portrait WxH, the landscape screens get them rotated
+	Sizes     []string `yaml:"sizes"`
+	CachePath string   `yaml:"cache_path"`
+	// the least recently used copies are removed over it
+	CacheMaxMB int64 `default:"512" yaml:"cache_max_mb"`
+	Quality    int   `default:"85" yaml:"quality"`
+	// larger images are sent as they are, 0: no limit
+	MaxMegapixels int `default:"24" yaml:"max_megapixels"`
+	// images decoded at once, the other requests wait; 0: the number of cpus
+	MaxResizes int `default:"2" yaml:"max_resizes"`
+}
+
+// Variant is the file sent: the stored content or rendition,
+// or the resized image in the local cache (Local)
+type Variant struct {
+	Path  string
+	Name  string
+	Local bool
+}
+
+// Device is the screen of the handset, zero when unknown
+type Device struct {
+	Width        int
+	Height       int
+	FeaturePhone bool
+}
+
+// AcceptCH asks the browsers for the screen hints of the next requests
+const AcceptCH = "Viewport-Width, DPR, Sec-CH-Viewport-Width, Sec-CH-DPR"
+
+var defaultSizes = []string{"128x160", "176x220", "240x320", "320x480", "480x800", "720x1280", "1080x1920"}
+
+var (
+	conf   VariantsConfig
+	sizes  []size
+	probes *cache.Cache
+)
+
+func Init(variantsConf VariantsConfig) error {
+	conf = variantsConf
+	if !conf.Enabled {
+		return nil
+	}
+	probes = cache.New(time.Duration(conf.ProbeCacheSec)*time.Second, time.Minute)
+	for i, r := range conf.Renditions {
+		if r.Name == "" || r.Suffix == "" {
+			return fmt.Errorf("rendition %d: name and suffix required", i)
+		}
+		for j, ext := range r.For {
+			conf.Renditions[i].For[j] = strings.ToLower(ext)
+		}
+	}
+	if conf.Images.Resize {
+		if len(conf.Images.Sizes) == 0 {
+			conf.Images.Sizes = defaultSizes
+		}
+		sizes = sizes[:0]
+		for _, s := range conf.Images.Sizes {
+			parsed, ok := parseSize(s)
+			if !ok {
+				return fmt.Errorf("wrong image size: %s", s)
+			}
+			sizes = append(sizes, parsed)
+		}
+		if err := initImageCache(conf.Images); err != nil {
+			return err
+		}
+		initResize(conf.Images)
+	}
+	log.WithFields(log.Fields{
+		"renditions": len(conf.Renditions),
+		"resize":     conf.Images.Resize,
+		"sizes":      conf.Images.Sizes,
+	}).Info("content variants init")
+	return nil
+}
+
+func Enabled() bool {
+	return conf.Enabled
+}
+
+// Select chooses the file of the content for the request
+func Select(r *http.Request, contentPath string) Variant {
+	original := Variant{Path: contentPath}
+	if !conf.Enabled {
+		return original
+	}
+	explicit := r.URL.Query().Get("variant")
+	device := DetectDevice(r)
+	ext := strings.ToLower(filepath.Ext(contentPath))
+
+	logCtx := log.WithFields(log.Fields{
+		"path":    contentPath,
+		"variant": explicit,
+		"device":  fmt.Sprintf("%dx%d", device.Width, device.Height),
+	})
+	if conf.Images.Resize && resizable(ext) {
+		s, ok := chooseSize(sizes, device, explicit)
+		if !ok {
+			return original
+		}
+		file, err := resizeImage(r.Context(), contentPath, s)
+		if _, ok := err.(tooLargeError); ok {
+			m.ImageResizeOversized.Inc()
+			logCtx.WithField("error", err.Error()).Debug("image not resized, original sent")
+			return original
+		}
+		if err != nil {
+			m.ImageResizeErrors.Inc()
+			logCtx.WithField("error", err.Error()).Error("cannot resize image, original sent")
+			return original
+		}
+		m.ContentVariants.Inc()
+		return Variant{Path: file, Name: s.String(), Local: true}
+	}
+	for _, rendition := range chooseRenditions(conf.Renditions, ext, device, explicit) {
+		p := renditionPath(contentPath, rendition)
+		if exists(r.Context(), p) {
+			m.ContentVariants.Inc()
+			logCtx.WithField("rendition", rendition.Name).Debug("rendition chosen")
+			return Variant{Path: p, Name: rendition.Name}
+		}
+	}
+	return original
+}
+
+func renditionPath(contentPath string, r Rendition) string {
+	return strings.TrimSuffix(contentPath, filepath.Ext(contentPath)) + r.Suffix
+}
+
+func exists(ctx context.Context, p string) bool {
+	if found, ok := probes.Get(p); ok {
+		return found.(bool)
+	}
+	content, err := store.Open(ctx, p)
+	if err == nil {
+		content.Close()
+	}
+	probes.Set(p, err == nil, cache.DefaultExpiration)
+	return err == nil
+}
+
+var (
+	screenInUA   = regexp.MustCompile(`\b(\d{3,4})[xX*](\d{3,4})\b`)
+	featurePhone = regexp.MustCompile(`(?i)MIDP|CLDC|Series ?40|J2ME|Nokia\d|SymbianOS|BlackBerry\d|Opera Mini`)
+)
+
+// DetectDevice reads the screen from the hints, the first one found is used
+func DetectDevice(r *http.Request) Device {
+	ua := r.Header.Get("User-Agent")
+	d := Device{FeaturePhone: featurePhone.MatchString(ua)}
+
+	q := r.URL.Query()
+	if w, _ := strconv.Atoi(q.Get("w")); w > 0 {
+		d.Width = w
+		d.Height, _ = strconv.Atoi(q.Get("h"))
+		return d
+	}
+	for _, h := range []string{"UA-Pixels", "X-Up-Devcap-Screenpixels"} {
+		if w, h, ok := parsePair(r.Header.Get(h)); ok {
+			d.Width, d.Height = w, h
+			return d
+		}
+	}
+	if w := headerInt(r, "Sec-CH-Viewport-Width", "Viewport-Width"); w > 0 {
+		dpr, err := strconv.ParseFloat(firstHeader(r, "Sec-CH-DPR", "DPR"), 64)
+		if err != nil || dpr < 1 {
+			dpr = 1
+		}
+		d.Width = int(float64(w) * dpr)
+		return d
+	}
+	if found := screenInUA.FindStringSubmatch(ua); found != nil {
+		d.Width, _ = strconv.Atoi(found[1])
+		d.Height, _ = strconv.Atoi(found[2])
+	}
+	return d
+}
+
+func firstHeader(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if v := r.Header.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func headerInt(r *http.Request, names ...string) int {
+	v, _ := strconv.Atoi(firstHeader(r, names...))
+	return v
+}
+
+// 240x320, 240,320
+func parsePair(v string) (int, int, bool) {
+	parts := strings.FieldsFunc(v, func(r rune) bool { return r == 'x' || r == 'X' || r == ',' })
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	w, errW := strconv.Atoi(strings.TrimSpace(parts[0]))
+	h, errH := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+// fits compares the short and the long sides: the orientation does not matter,
+// the viewport width of the hints is the short side
+func fits(w, h int, d Device) bool {
+	short, long := w, h
+	if short > long {
+		short, long = long, short
+	}
+	if d.Height == 0 {
+		return short <= d.Width
+	}
+	dShort, dLong := d.Width, d.Height
+	if dShort > dLong {
+		dShort, dLong = dLong, dShort
+	}
+	return short <= dShort && long <= dLong
+}
+
+// chooseRenditions returns the renditions to try, the best one first
+func chooseRenditions(renditions []Rendition, ext string, d Device, explicit string) []Rendition {
+	var candidates []Rendition
+	for _, r := range renditions {
+		if !hasExt(r.For, ext) {
+			continue
+		}
+		if explicit != "" {
+			if r.Name == explicit {
+				return []Rendition{r}
+			}
+			continue
+		}
+		if r.FeaturePhones && !d.FeaturePhone {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+	if explicit != "" || len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Width*candidates[i].Height > candidates[j].Width*candidates[j].Height
+	})
+	if d.Width == 0 {
+		if d.FeaturePhone {
+			return []Rendition{candidates[len(candidates)-1]}
+		}
+		return nil
+	}
+	var fitting []Rendition
+	for i, r := range candidates {
+		if !fits(r.Width, r.Height, d) {
+			continue
+		}
+		// the screen is larger than all the renditions: the original
+		if i == 0 && !d.FeaturePhone {
+			return nil
+		}
+		fitting = append(fitting, r)
+	}
+	if len(fitting) == 0 && d.FeaturePhone {
+		return []Rendition{candidates[len(candidates)-1]}
+	}
+	return fitting
+}
+
+func hasExt(exts []string, ext string) bool {
+	for _, e := range exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
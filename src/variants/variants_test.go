@@ -0,0 +1,211 @@
+package variants
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	m "github.com/linkit360/go-dispatcherd/src/metrics"
+	"github.com/linkit360/go-dispatcherd/src/store"
+)
+
+func TestMain(t *testing.M) {
+	m.Init("dispatcherd_test")
+	os.Exit(t.Run())
+}
+
+func request(url string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest("GET", url, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestDetectDevice(t *testing.T) {
+	for name, tc := range map[string]struct {
+		r      *http.Request
+		device Device
+	}{
+		"query": {request("/u/x?w=240&h=320", nil), Device{Width: 240, Height: 320}},
+		"ua pixels": {request("/u/x", map[string]string{"UA-Pixels": "176x220"}),
+			Device{Width: 176, Height: 220}},
+		"openwave": {request("/u/x", map[string]string{"X-Up-Devcap-Screenpixels": "128,160"}),
+			Device{Width: 128, Height: 160}},
+		"client hints": {request("/u/x", map[string]string{"Sec-CH-Viewport-Width": "360", "Sec-CH-DPR": "2"}),
+			Device{Width: 720}},
+		"feature phone ua": {request("/u/x", map[string]string{"User-Agent": "Nokia2700c-2/2.0 (07.80) Profile/MIDP-2.1 Configuration/CLDC-1.1 240x320"}),
+			Device{Width: 240, Height: 320, FeaturePhone: true}},
+		"unknown": {request("/u/x", map[string]string{"User-Agent": "Mozilla/5.0 (Linux; Android 9)"}), Device{}},
+	} {
+		assert.Equal(t, tc.device, DetectDevice(tc.r), name)
+	}
+}
+
+var testRenditions = []Rendition{
+	{Name: "240p", Suffix: "_240p.3gp", Width: 320, Height: 240, For: []string{".mp4"}, FeaturePhones: true},
+	{Name: "360p", Suffix: "_360p.mp4", Width: 640, Height: 360, For: []string{".mp4"}},
+	{Name: "720p", Suffix: "_720p.mp4", Width: 1280, Height: 720, For: []string{".mp4"}},
+}
+
+func names(renditions []Rendition) []string {
+	res := []string{}
+	for _, r := range renditions {
+		res = append(res, r.Name)
+	}
+	return res
+}
+
+func TestChooseRenditions(t *testing.T) {
+	assert.Equal(t, []string{"360p"}, names(chooseRenditions(testRenditions, ".mp4", Device{Width: 480, Height: 800}, "")))
+	assert.Equal(t, []string{}, names(chooseRenditions(testRenditions, ".mp4", Device{Width: 1080, Height: 1920}, "")), "original")
+	assert.Equal(t, []string{}, names(chooseRenditions(testRenditions, ".mp4", Device{}, "")), "unknown screen")
+	assert.Equal(t, []string{"240p"}, names(chooseRenditions(testRenditions, ".mp4", Device{Width: 176, Height: 220, FeaturePhone: true}, "")),
+		"nothing fits the feature phone")
+	assert.Equal(t, []string{"360p", "240p"}, names(chooseRenditions(testRenditions, ".mp4", Device{Width: 360, Height: 640, FeaturePhone: true}, "")))
+	assert.Equal(t, []string{"720p"}, names(chooseRenditions(testRenditions, ".mp4", Device{Width: 240}, "720p")), "explicit")
+	assert.Equal(t, []string{}, names(chooseRenditions(testRenditions, ".jpg", Device{Width: 240}, "")))
+}
+
+func TestChooseSize(t *testing.T) {
+	sizes := []size{{128, 160}, {240, 320}, {480, 800}}
+	s, ok := chooseSize(sizes, Device{Width: 360, Height: 640}, "")
+	assert.True(t, ok)
+	assert.Equal(t, size{240, 320}, s)
+	s, _ = chooseSize(sizes, Device{Width: 800, Height: 480}, "")
+	assert.Equal(t, size{800, 480}, s, "landscape")
+	s, _ = chooseSize(sizes, Device{Width: 100, Height: 100}, "")
+	assert.Equal(t, size{128, 160}, s, "smallest")
+	_, ok = chooseSize(sizes, Device{}, "")
+	assert.False(t, ok)
+	s, ok = chooseSize(sizes, Device{}, "480x800")
+	assert.True(t, ok)
+	assert.Equal(t, size{480, 800}, s)
+	_, ok = chooseSize(sizes, Device{}, "500x500")
+	assert.False(t, ok, "not allowed size")
+}
+
+func TestSelect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "variants")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	img := image.NewRGBA(image.Rect(0, 0, 600, 900))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(300, 450, color.Black)
+	f, _ := os.Create(filepath.Join(dir, "wall.jpg"))
+	assert.NoError(t, jpeg.Encode(f, img, nil))
+	f.Close()
+	for _, name := range []string{"clip.mp4", "clip_360p.mp4"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("video"), 0644))
+	}
+
+	assert.NoError(t, store.Init(store.StoreConfig{Type: "local", Path: dir}))
+	assert.NoError(t, Init(VariantsConfig{
+		Enabled:       true,
+		Renditions:    testRenditions,
+		ProbeCacheSec: 60,
+		Images: ImagesConfig{
+			Resize:        true,
+			Sizes:         []string{"240x320", "480x800"},
+			CachePath:     filepath.Join(dir, "cache"),
+			CacheMaxMB:    16,
+			Quality:       85,
+			MaxMegapixels: 24,
+		},
+	}))
+
+	v := Select(request("/u/x?w=360&h=640", nil), "clip.mp4")
+	assert.Equal(t, Variant{Path: "clip_360p.mp4", Name: "360p"}, v)
+	v = Select(request("/u/x?variant=720p", nil), "clip.mp4")
+	assert.Equal(t, Variant{Path: "clip.mp4"}, v, "no such rendition stored")
+
+	v = Select(request("/u/x?w=240&h=320", nil), "wall.jpg")
+	assert.True(t, v.Local)
+	assert.Equal(t, "240x320", v.Name)
+	resized, err := os.Open(v.Path)
+	assert.NoError(t, err)
+	config, _, err := image.DecodeConfig(resized)
+	resized.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 240, config.Width)
+	assert.Equal(t, 320, config.Height)
+
+	again := Select(request("/u/x?w=240&h=320", nil), "wall.jpg")
+	assert.Equal(t, v, again, "cached")
+
+	conf.Images.MaxMegapixels = 1
+	huge := image.NewRGBA(image.Rect(0, 0, 1001, 1000))
+	f, _ = os.Create(filepath.Join(dir, "huge.png"))
+	assert.NoError(t, png.Encode(f, huge))
+	f.Close()
+	_, err = resizeImage(context.Background(), "huge.png", size{W: 240, H: 320})
+	assert.EqualError(t, err, "image is too large: 1001x1000")
+	assert.NoError(t, os.Remove(filepath.Join(dir, "huge.png")))
+	_, err = resizeImage(context.Background(), "huge.png", size{W: 480, H: 800})
+	assert.EqualError(t, err, "image is too large: 1001x1000", "remembered, not opened")
+	v = Select(request("/u/x?w=240&h=320", nil), "huge.png")
+	assert.Equal(t, Variant{Path: "huge.png"}, v, "original")
+}
+
+func TestResizeOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "variants")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	f, _ := os.Create(filepath.Join(dir, "wall.png"))
+	assert.NoError(t, png.Encode(f, image.NewRGBA(image.Rect(0, 0, 600, 900))))
+	f.Close()
+
+	assert.NoError(t, store.Init(store.StoreConfig{Type: "local", Path: dir}))
+	assert.NoError(t, Init(VariantsConfig{
+		Enabled:       true,
+		ProbeCacheSec: 60,
+		Images: ImagesConfig{
+			Resize:     true,
+			Sizes:      []string{"240x320"},
+			CachePath:  filepath.Join(dir, "cache"),
+			CacheMaxMB: 16,
+			MaxResizes: 1,
+		},
+	}))
+	var decoded int32
+	decode = func(r io.Reader) (image.Image, string, error) {
+		atomic.AddInt32(&decoded, 1)
+		time.Sleep(50 * time.Millisecond)
+		return image.Decode(r)
+	}
+	defer func() { decode = image.Decode }()
+
+	files := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file, err := resizeImage(context.Background(), "wall.png", size{W: 240, H: 320})
+			assert.NoError(t, err)
+			files[i] = file
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&decoded), "one decode for the concurrent requests")
+	for _, file := range files {
+		assert.Equal(t, files[0], file)
+	}
+}